@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/sys/cpu"
+)
+
+// Data channel frame layout (integers are big-endian):
+//
+//	[TYPE (1)][SUITE (1)][RESERVED (2)][RECEIVER_INDEX (4)][COUNTER (8)][CIPHERTEXT][TAG (16)]
+//
+// The whole 16-byte header is authenticated as associated data. The receiver
+// index selects the session keys established by the handshake. The nonce is
+// the 64-bit counter left-padded with zeros, so it never repeats for a given
+// key as long as the sender never reuses a counter value.
+const (
+	MSG_TYPE_DATA = 4
+
+	HEADER_LEN     = 16
+	AEAD_KEY_LEN   = 32
+	AEAD_TAG_LEN   = 16
+	AEAD_NONCE_LEN = 12
+
+	// Bytes a data frame adds to the packet it carries
+	FRAME_OVERHEAD = HEADER_LEN + AEAD_TAG_LEN
+)
+
+// cipherSuite identifies the AEAD used on the data channel
+type cipherSuite uint8
+
+const (
+	// suiteLegacyCFB is the pre-AEAD AES-256-CFB + HMAC-SHA256 format. It has no
+	// header and never appears on the wire; it only tags legacy peers.
+	suiteLegacyCFB        cipherSuite = 0
+	suiteChaCha20Poly1305 cipherSuite = 1
+	suiteAES256GCM        cipherSuite = 2
+)
+
+var errFrameAuth = errors.New("frame authentication failed")
+
+func (s cipherSuite) String() string {
+	switch s {
+	case suiteLegacyCFB:
+		return "legacy-cfb"
+	case suiteChaCha20Poly1305:
+		return "chacha20-poly1305"
+	case suiteAES256GCM:
+		return "aes-256-gcm"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(s))
+	}
+}
+
+// MarshalText encodes a suite by name in handshake payloads and config files
+func (s cipherSuite) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *cipherSuite) UnmarshalText(text []byte) error {
+	suite, err := parseCipherSuite(string(text))
+	if err != nil {
+		return err
+	}
+	*s = suite
+	return nil
+}
+
+// parseCipherSuite maps a suite name to its identifier. "auto" picks the
+// fastest suite for this CPU.
+func parseCipherSuite(name string) (cipherSuite, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "auto":
+		return preferredCipherSuite(), nil
+	case "chacha20-poly1305", "chacha20poly1305", "chacha":
+		return suiteChaCha20Poly1305, nil
+	case "aes-256-gcm", "aes256gcm", "aes-gcm":
+		return suiteAES256GCM, nil
+	case "legacy-cfb", "legacy":
+		return suiteLegacyCFB, nil
+	default:
+		return 0, fmt.Errorf("unknown cipher suite %q", name)
+	}
+}
+
+// parseCipherSuites parses a comma-separated list of suite names
+func parseCipherSuites(list string) ([]cipherSuite, error) {
+	var suites []cipherSuite
+	for _, name := range strings.Split(list, ",") {
+		if strings.TrimSpace(name) == "" {
+			continue
+		}
+		suite, err := parseCipherSuite(name)
+		if err != nil {
+			return nil, err
+		}
+		suites = append(suites, suite)
+	}
+	if len(suites) == 0 {
+		return nil, errors.New("no cipher suites configured")
+	}
+	return suites, nil
+}
+
+// offeredCipherSuites expands a suite choice into the list a client
+// proposes: "auto" offers both AEAD suites, fastest first
+func offeredCipherSuites(name string) ([]cipherSuite, error) {
+	suite, err := parseCipherSuite(name)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "auto":
+		if suite == suiteAES256GCM {
+			return []cipherSuite{suiteAES256GCM, suiteChaCha20Poly1305}, nil
+		}
+		return []cipherSuite{suiteChaCha20Poly1305, suiteAES256GCM}, nil
+	}
+	return []cipherSuite{suite}, nil
+}
+
+// selectCipherSuite picks the first suite offered by the client that is also
+// allowed locally
+func selectCipherSuite(offered, allowed []cipherSuite) (cipherSuite, bool) {
+	for _, o := range offered {
+		if o == suiteLegacyCFB {
+			continue
+		}
+		for _, a := range allowed {
+			if o == a {
+				return o, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// preferredCipherSuite returns AES-256-GCM when the CPU has hardware AES and
+// carry-less multiplication, and ChaCha20-Poly1305 otherwise
+func preferredCipherSuite() cipherSuite {
+	hasAESGCM := (cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ) ||
+		(cpu.ARM64.HasAES && cpu.ARM64.HasPMULL) ||
+		(cpu.S390X.HasAES && cpu.S390X.HasAESGCM)
+	if hasAESGCM {
+		return suiteAES256GCM
+	}
+	return suiteChaCha20Poly1305
+}
+
+// newAEAD builds the AEAD for a suite from a 32-byte key
+func (s cipherSuite) newAEAD(key []byte) (cipher.AEAD, error) {
+	switch s {
+	case suiteChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	case suiteAES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create cipher: %w", err)
+		}
+		return cipher.NewGCM(block)
+	default:
+		return nil, fmt.Errorf("cipher suite %s has no AEAD", s)
+	}
+}
+
+// frameHeader is the cleartext, authenticated prefix of every data frame
+type frameHeader struct {
+	Type          uint8
+	Suite         cipherSuite
+	ReceiverIndex uint32
+	Counter       uint64
+}
+
+func (h frameHeader) marshal(b []byte) {
+	b[0] = h.Type
+	b[1] = uint8(h.Suite)
+	b[2], b[3] = 0, 0
+	binary.BigEndian.PutUint32(b[4:8], h.ReceiverIndex)
+	binary.BigEndian.PutUint64(b[8:16], h.Counter)
+}
+
+func parseFrameHeader(b []byte) (frameHeader, error) {
+	if len(b) < HEADER_LEN+AEAD_TAG_LEN {
+		return frameHeader{}, fmt.Errorf("frame too short: %d bytes", len(b))
+	}
+	h := frameHeader{
+		Type:          b[0],
+		Suite:         cipherSuite(b[1]),
+		ReceiverIndex: binary.BigEndian.Uint32(b[4:8]),
+		Counter:       binary.BigEndian.Uint64(b[8:16]),
+	}
+	if h.Type != MSG_TYPE_DATA {
+		return frameHeader{}, fmt.Errorf("unexpected message type %d", h.Type)
+	}
+	return h, nil
+}
+
+func counterNonce(counter uint64) []byte {
+	nonce := make([]byte, AEAD_NONCE_LEN)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+func randomUint32() (uint32, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		return 0, fmt.Errorf("failed to generate random id: %w", err)
+	}
+	return binary.BigEndian.Uint32(b[:]), nil
+}
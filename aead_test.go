@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// aeadPair returns matching sender and receiver keys for a suite
+func aeadPair(t *testing.T, suite cipherSuite) (sender, receiver *keypair) {
+	t.Helper()
+	k1, k2 := bytes.Repeat([]byte{1}, AEAD_KEY_LEN), bytes.Repeat([]byte{2}, AEAD_KEY_LEN)
+	sender, err := newKeypair(suite, k1, k2, 7, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err = newKeypair(suite, k2, k1, 9, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sender, receiver
+}
+
+func TestKeypairRoundTrip(t *testing.T) {
+	for _, suite := range []cipherSuite{suiteChaCha20Poly1305, suiteAES256GCM} {
+		sender, receiver := aeadPair(t, suite)
+		for i, plaintext := range [][]byte{nil, []byte("x"), bytes.Repeat([]byte{0x45}, 1400)} {
+			frame, err := sender.seal(plaintext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(frame) != len(plaintext)+FRAME_OVERHEAD {
+				t.Fatalf("%s: frame of %d bytes for %d bytes of plaintext", suite, len(frame), len(plaintext))
+			}
+			hdr, err := parseFrameHeader(frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Suite != suite || hdr.ReceiverIndex != 9 || hdr.Counter != uint64(i) {
+				t.Fatalf("%s: header %+v", suite, hdr)
+			}
+			opened, err := receiver.open(hdr, frame)
+			if err != nil {
+				t.Fatalf("%s: %v", suite, err)
+			}
+			if !bytes.Equal(opened, plaintext) {
+				t.Fatalf("%s: opened %x, want %x", suite, opened, plaintext)
+			}
+		}
+	}
+}
+
+// Every byte of a frame is authenticated, the header included
+func TestKeypairRejectsTampering(t *testing.T) {
+	for _, suite := range []cipherSuite{suiteChaCha20Poly1305, suiteAES256GCM} {
+		sender, receiver := aeadPair(t, suite)
+		frame, err := sender.seal([]byte("payload"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range frame {
+			if i < 2 {
+				continue // Type and suite are checked before decryption
+			}
+			tampered := append([]byte(nil), frame...)
+			tampered[i] ^= 0x80
+			hdr, err := parseFrameHeader(tampered)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := receiver.open(hdr, tampered); !errors.Is(err, errFrameAuth) {
+				t.Fatalf("%s: byte %d flipped: %v", suite, i, err)
+			}
+		}
+
+		hdr, err := parseFrameHeader(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := receiver.open(hdr, frame); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := receiver.open(hdr, frame); !errors.Is(err, errReplay) {
+			t.Fatalf("%s: replayed frame: %v", suite, err)
+		}
+	}
+
+	// A frame claiming another suite never reaches the AEAD
+	sender, _ := aeadPair(t, suiteChaCha20Poly1305)
+	_, receiver := aeadPair(t, suiteAES256GCM)
+	frame, err := sender.seal([]byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr, err := parseFrameHeader(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiver.open(hdr, frame); err == nil {
+		t.Fatal("frame of another suite accepted")
+	}
+	frame[0] = MSG_TYPE_HANDSHAKE_INIT
+	if _, err := parseFrameHeader(frame); err == nil {
+		t.Fatal("handshake message parsed as a data frame")
+	}
+	if _, err := parseFrameHeader(frame[:HEADER_LEN+AEAD_TAG_LEN-1]); err == nil {
+		t.Fatal("truncated frame parsed")
+	}
+}
+
+func TestKeypairLifetime(t *testing.T) {
+	sender, _ := aeadPair(t, suiteChaCha20Poly1305)
+	if sender.needsRekey(0) {
+		t.Fatal("fresh keys need a rekey")
+	}
+	if _, err := sender.seal(make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if !sender.needsRekey(100) || sender.needsRekey(101) {
+		t.Fatal("byte limit not applied")
+	}
+
+	sender.created = time.Now().Add(-REKEY_AFTER_TIME)
+	if !sender.needsRekey(0) || sender.expired() {
+		t.Fatal("keys at the rekey age must rekey but still work")
+	}
+	sender.created = time.Now().Add(-REJECT_AFTER_TIME)
+	if _, err := sender.seal(nil); !errors.Is(err, errKeypairExpired) {
+		t.Fatalf("expired keys sealed: %v", err)
+	}
+
+	sender, _ = aeadPair(t, suiteChaCha20Poly1305)
+	sender.revoke()
+	if _, err := sender.seal(nil); !errors.Is(err, errKeypairExpired) {
+		t.Fatalf("revoked keys sealed: %v", err)
+	}
+}
+
+func TestCipherSuiteNegotiation(t *testing.T) {
+	preferred := preferredCipherSuite()
+	tests := []struct {
+		choice string
+		want   []cipherSuite
+	}{
+		{"chacha20-poly1305", []cipherSuite{suiteChaCha20Poly1305}},
+		{"AES-256-GCM", []cipherSuite{suiteAES256GCM}},
+		{"legacy", []cipherSuite{suiteLegacyCFB}},
+		{"auto", []cipherSuite{preferred, suiteChaCha20Poly1305 + suiteAES256GCM - preferred}},
+		{"", []cipherSuite{preferred, suiteChaCha20Poly1305 + suiteAES256GCM - preferred}},
+	}
+	for _, tt := range tests {
+		got, err := offeredCipherSuites(tt.choice)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.choice, err)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%q offers %v, want %v", tt.choice, got, tt.want)
+		}
+	}
+	if _, err := offeredCipherSuites("rot13"); err == nil {
+		t.Error("unknown suite accepted")
+	}
+	if _, err := parseCipherSuites(" , "); err == nil {
+		t.Error("empty suite list accepted")
+	}
+
+	both := []cipherSuite{suiteChaCha20Poly1305, suiteAES256GCM}
+	if suite, ok := selectCipherSuite([]cipherSuite{suiteAES256GCM, suiteChaCha20Poly1305}, both); !ok || suite != suiteAES256GCM {
+		t.Errorf("selected %s, want the client's first choice", suite)
+	}
+	if suite, ok := selectCipherSuite(both, []cipherSuite{suiteAES256GCM}); !ok || suite != suiteAES256GCM {
+		t.Errorf("selected %s, want the only allowed suite", suite)
+	}
+	if _, ok := selectCipherSuite([]cipherSuite{suiteLegacyCFB}, []cipherSuite{suiteLegacyCFB}); ok {
+		t.Error("legacy suite negotiated in a handshake")
+	}
+}
+
+func TestLegacyRoundTrip(t *testing.T) {
+	aesKey, hmacKey := bytes.Repeat([]byte{3}, KEY_LEN), bytes.Repeat([]byte{4}, KEY_LEN)
+	packet, err := legacySeal(aesKey, hmacKey, []byte("legacy payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packet) != len("legacy payload")+LEGACY_OVERHEAD {
+		t.Fatalf("legacy packet of %d bytes", len(packet))
+	}
+	plaintext, err := legacyOpen(aesKey, hmacKey, packet)
+	if err != nil || string(plaintext) != "legacy payload" {
+		t.Fatalf("opened %q, %v", plaintext, err)
+	}
+
+	packet[len(packet)-1] ^= 1
+	if _, err := legacyOpen(aesKey, hmacKey, packet); err == nil {
+		t.Fatal("tampered legacy packet accepted")
+	}
+	if _, err := legacyOpen(aesKey, hmacKey, packet[:LEGACY_OVERHEAD-1]); err == nil {
+		t.Fatal("truncated legacy packet accepted")
+	}
+}
@@ -4,102 +4,321 @@
 package main
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/hmac"
-	"crypto/rand"
 	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/netip"
 	"os"
 	"os/exec"
 	"os/signal"
 	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/songgao/water"
 	"golang.org/x/crypto/pbkdf2"
 )
 
 const (
-	// MUST be 32 bytes for AES-256
-	PSK         = "this-is-strong-32byte-secret-key" // Exactly 32 bytes - MUST match server
-	CLIENT_IP   = "10.8.0.2/24"
-	BUFFER_SIZE = 1500
-	KEY_LEN     = 32            // For AES-256
-	HMAC_LEN    = 32            // SHA256 output size
-	IV_LEN      = aes.BlockSize // 16 bytes for AES
-
-	// PBKDF2 parameters - MUST match server
-	PBKDF2_ITERATIONS = 100000
-	PBKDF2_SALT       = "cipherwall-salt-2025"
+	KEY_LEN = 32 // For AES-256
+
+	// Tunnel address used when the server leases none (legacy mode)
+	DEFAULT_CLIENT_IP = "10.8.0.2/24"
+
+	// Consecutive TUN read errors after which the interface counts as dead
+	TUN_READ_ERROR_LIMIT = 10
+
+	// How often the routes kept outside the tunnel are checked for underlay
+	// changes
+	UNDERLAY_CHECK_INTERVAL = 2 * time.Second
+
+	// Policy routing rules: the main table without its default routes, then
+	// the tunnel table for unmarked packets
+	POLICY_RULE_PRIORITY = 1194
+
+	// Lets reverse path filtering see the socket mark, as policy routing
+	// needs for replies to the marked UDP socket
+	SYSCTL_SRC_VALID_MARK = "/proc/sys/net/ipv4/conf/all/src_valid_mark"
 )
 
 // Global variables for derived keys and the TUN interface pointer
 var (
-	aesKey  []byte
-	hmacKey []byte
-	iface   *water.Interface
+	aesKey    []byte
+	hmacKey   []byte
+	masterKey []byte
+	iface     *water.Interface
+
+	// Handshake and data channel state
+	staticKey    noisePrivateKey
+	serverKey    noisePublicKey
+	handshakePSK [NOISE_KEY_LEN]byte
+	suites       []cipherSuite // Suites offered to the server
+	legacyMode   bool
+	rekeyBytes   uint64 // Rekey after this much traffic on one keypair (0 = off)
+	tunMTU       int
+	fragmentSize int // Largest datagram sent, bigger frames are fragmented (0 = off)
+
+	// Dead peer detection: keepalives go out after keepalive without hearing
+	// from the server, and a new handshake starts after deadPeerTimeout
+	keepalive       time.Duration
+	deadPeerTimeout time.Duration
+	lastReceived    atomic.Int64 // Unix nanoseconds of the last authenticated message from the server
+
+	// Socket to the server, replaced when reconnecting
+	serverConn atomic.Pointer[net.UDPConn]
+
+	// Fragmented frames from the server
+	fragments = newReassembler()
+
+	// Routes and interface settings applied by the client, reverted on exit
+	netChanges netJournal
+
+	// Session keys: the newest keypair sends, the previous one is still
+	// accepted on receive until it expires so a rekey loses no packets
+	currentKeypair  atomic.Pointer[keypair]
+	previousKeypair atomic.Pointer[keypair]
+
+	handshakeMu      sync.Mutex
+	pendingHandshake *handshakeState // Initiation waiting for a response
+	handshakeSentAt  time.Time
+	tunnelAddrs      []netip.Prefix // Leased by the server in the first handshake
+	pushedRoutes     []netip.Prefix // Pushed by the server in the first handshake
+	pushedDNS        []netip.Addr
+	pushedSearch     []string
+	sessionReady     = make(chan struct{}, 1)
+	tunReady         = make(chan struct{}) // Closed once the TUN interface is configured
+
+	// Routes pinned to the underlay, kept current by watchUnderlay
+	pinsMu       sync.Mutex
+	underlayPins []netChange
+	watchPins    sync.Once
 )
 
 func main() {
-	// Command line flags
-	serverAddr := flag.String("server", "", "VPN server address (IP:PORT)")
+	// Command line flags; anything set here overrides the profile
+	configPath := flag.String("config", defaultClientConfigPath(), "Configuration file with connection profiles (YAML)")
+	profileName := flag.String("profile", "", "Profile to use (default: the config file's default profile)")
+	checkOnly := flag.Bool("check-config", false, "Validate the configuration and selected profile, then exit")
+	cleanupOnly := flag.Bool("cleanup", false, "Revert the routes and DNS settings left behind by a client that crashed, then exit")
+	stateFile := flag.String("state-file", DEFAULT_STATE_FILE, "Journal of the client's network changes, for crash recovery")
+	flag.String("server", "", "VPN server address (IP:PORT)")
+	flag.String("server-key", "", "Server public key (base64, printed by the server at startup)")
+	flag.String("key", "", "Client private key file (created if missing, default "+DEFAULT_CLIENT_KEY+")")
+	flag.String("psk-file", "", "File with this client's own handshake PSK (base64), if the server registered one")
+	flag.String("cipher", "", "Data channel cipher: auto, chacha20-poly1305, aes-256-gcm or legacy-cfb")
+	flag.Uint64("rekey-bytes", DEFAULT_REKEY_BYTES, "Rekey after this many bytes on one session key (0 to disable)")
+	flag.Int("mtu", 0, "TUN interface MTU (0: the underlay MTU minus the tunnel overhead)")
+	flag.Int("fragment", 0, "Fragment frames bigger than this many bytes, for networks that drop IP fragments (0 to disable)")
+	flag.Duration("keepalive", DEFAULT_KEEPALIVE, "Send a keepalive after this long without hearing from the server (0 to disable)")
+	flag.Duration("dead-peer-timeout", DEFAULT_DEAD_PEER_TIMEOUT, "Reconnect after this long without hearing from the server (0 to disable)")
+	flag.Bool("pmtu-discovery", true, "Probe the path MTU and lower the TUN MTU to it")
+	flag.String("dns-mode", DNS_MODE_AUTO, "DNS setup: auto, resolved (systemd-resolved), file (/etc/resolv.conf) or off")
+	flag.Bool("kill-switch", false, "Block all traffic outside the tunnel until you disconnect (Linux)")
+	flag.String("underlay", UNDERLAY_AUTO, "IP version used to reach the server: auto, ipv4 or ipv6")
+	flag.String("routing", ROUTING_MAIN, "Routing mode: main, or policy for fwmark-based policy routing (Linux)")
+	flag.String("log-level", LOG_LEVEL_INFO, "Log level: info, or debug for per-packet logs")
 	flag.Parse()
+	defer cleanupOnPanic()
 
-	if *serverAddr == "" {
-		log.Fatal("❌ Server address is required. Usage: ./cipherwall-client -server <SERVER_IP>:1194")
+	if *cleanupOnly {
+		if err := recoverNetwork(*stateFile, false); err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		log.Println("✅ Host network configuration is clean")
+		return
+	}
+
+	prof, err := loadProfile(*configPath, *profileName)
+	if err != nil {
+		log.Fatalf("❌ Invalid configuration: %v", err)
+	}
+	if *checkOnly {
+		log.Printf("✅ Configuration is valid (profile %q, server %s)", prof.name, prof.Server)
+		return
+	}
+	if err := setupLogging(prof.LogLevel, ""); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	rekeyBytes = *prof.RekeyBytes
+	keepalive, deadPeerTimeout = *prof.Keepalive, *prof.DeadPeerTimeout
+	tunMTU = prof.MTU
+
+	// Undo whatever a previous run that crashed or was killed left behind,
+	// before making any changes of our own
+	if err := recoverNetwork(*stateFile, prof.KillSwitch); err != nil {
+		log.Fatalf("❌ %v", err)
 	}
 
 	log.Println("🛡️  CipherWall VPN Client Starting...")
-	log.Printf("📡 Connecting to server: %s", *serverAddr)
+	if prof.name != "" {
+		log.Printf("📄 Using profile %q", prof.name)
+	}
+	log.Printf("📡 Connecting to server: %s", prof.Server)
 
 	// 1. Derive Keys
 	log.Println("📦 Deriving encryption and authentication keys from PSK...")
-	deriveKeys([]byte(PSK))
+	psk := prof.PSK
+	if psk == "" {
+		psk = DEFAULT_PSK
+		log.Println("⚠️  Using default PSK. Set psk in the profile or VPN_PSK!")
+	}
+	deriveKeys([]byte(psk), prof.PBKDF2Iterations, prof.PBKDF2Salt)
 	log.Printf("✅ Keys derived successfully (AES: %d bytes, HMAC: %d bytes)", len(aesKey), len(hmacKey))
 
-	// 2. Setup TUN Interface
-	log.Println("🌐 Setting up TUN interface...")
-	var err error
-	iface, err = setupTUN()
-	if err != nil {
-		log.Fatalf("❌ Failed to setup TUN interface: %v", err)
+	if err = setupDataChannel(prof.Cipher, prof.ServerKey, prof.KeyFile, prof.PSKFile); err != nil {
+		log.Fatalf("❌ Failed to setup data channel: %v", err)
+	}
+	if prof.Fragment != 0 {
+		if legacyMode {
+			log.Println("⚠️  Legacy servers cannot reassemble fragments, fragment is ignored")
+		} else {
+			fragmentSize = prof.Fragment
+			log.Printf("🧩 Frames bigger than %d bytes are sent in fragments", fragmentSize)
+		}
 	}
-	log.Printf("✅ TUN interface '%s' created and configured with IP %s", iface.Name(), CLIENT_IP)
 
-	// 3. Setup UDP Connection
-	log.Printf("🔌 Connecting to server %s...", *serverAddr)
-	serverUDPAddr, err := net.ResolveUDPAddr("udp", *serverAddr)
+	// 2. Setup UDP Connection
+	log.Printf("🔌 Connecting to server %s...", prof.Server)
+	serverUDPAddr, err := net.ResolveUDPAddr(prof.underlayNetwork(), prof.Server)
 	if err != nil {
 		log.Fatalf("❌ Failed to resolve server address: %v", err)
 	}
+	server := netip.AddrPortFrom(serverUDPAddr.AddrPort().Addr().Unmap(), serverUDPAddr.AddrPort().Port())
+	if tunMTU == 0 {
+		if tunMTU, err = autoMTU(server.Addr()); err != nil {
+			tunMTU = DEFAULT_MTU
+			log.Printf("⚠️  Failed to detect the underlay MTU, using %d: %v", tunMTU, err)
+		}
+	}
 
-	conn, err := net.DialUDP("udp", nil, serverUDPAddr)
+	// Engage the kill switch before anything else goes out; a kill switch
+	// left by an earlier run is replaced in one step
+	if prof.KillSwitch {
+		if err := enableKillSwitch(server, "", prof.exclude); err != nil {
+			log.Fatalf("❌ Failed to enable kill switch: %v", err)
+		}
+		log.Printf("🔒 Kill switch on: only the tunnel, the server and %v are reachable", prof.exclude)
+	}
+
+	// With policy routing the socket's mark keeps the tunnel's own packets
+	// out of the tunnel, whatever the underlay route is. Path MTU probes
+	// must not be fragmented, and with fragments there is nothing to probe.
+	pmtuDiscovery := *prof.PMTUDiscovery && !legacyMode && fragmentSize == 0
+	var dialer net.Dialer
+	dialer.Control = func(network, address string, c syscall.RawConn) error {
+		if prof.Routing == ROUTING_POLICY {
+			if err := markSocket(prof.FwMark)(network, address, c); err != nil {
+				return err
+			}
+		}
+		if pmtuDiscovery {
+			return dontFragment(network, address, c)
+		}
+		return nil
+	}
+	udpConn, err := dialer.Dial(prof.underlayNetwork(), serverUDPAddr.String())
 	if err != nil {
 		log.Fatalf("❌ Failed to connect to server: %v", err)
 	}
-	defer conn.Close()
+	conn := udpConn.(*net.UDPConn)
+	serverConn.Store(conn)
 	log.Printf("✅ Connected to server successfully")
 
-	// 4. Setup routing for all traffic through VPN
+	// Establish session keys before any data is exchanged
+	go handleIncomingPackets(conn) // UDP -> TUN
+	if !legacyMode {
+		log.Println("🤝 Performing handshake...")
+		if err := initiateHandshake(conn); err != nil {
+			log.Fatalf("❌ Handshake failed: %v", err)
+		}
+		go maintainSession()
+
+		select {
+		case <-sessionReady:
+		case <-time.After(HANDSHAKE_TIMEOUT * HANDSHAKE_ATTEMPTS):
+			log.Fatalf("❌ Handshake failed: no response after %d attempts", HANDSHAKE_ATTEMPTS)
+		}
+		log.Printf("✅ Handshake complete (suite %s)", currentKeypair.Load().suite)
+	}
+
+	// 3. Setup TUN Interface with the addresses leased by the server
+	handshakeMu.Lock()
+	addrs, pushed := tunnelAddrs, pushedRoutes
+	dnsServers, dnsSearch := prof.dnsSettings(pushedDNS, pushedSearch)
+	handshakeMu.Unlock()
+	if len(addrs) == 0 {
+		addrs = []netip.Prefix{netip.MustParsePrefix(DEFAULT_CLIENT_IP)}
+	}
+
+	log.Println("🌐 Setting up TUN interface...")
+	iface, err = setupTUN(addrs, tunMTU)
+	if err != nil {
+		log.Fatalf("❌ Failed to setup TUN interface: %v", err)
+	}
+	close(tunReady)
+	metrics.tunMTU.Store(int64(tunMTU))
+	log.Printf("✅ TUN interface '%s' created and configured with IP %v (MTU %d)", iface.Name(), addrs, tunMTU)
+	if prof.KillSwitch {
+		if err := enableKillSwitch(server, iface.Name(), prof.exclude); err != nil {
+			cleanupNetwork()
+			log.Fatalf("❌ Failed to open the kill switch for %s: %v", iface.Name(), err)
+		}
+	}
+
+	// 4. Setup routing through the VPN
 	log.Println("🔀 Configuring routing...")
-	if err := setupRouting(*serverAddr); err != nil {
-		log.Printf("⚠️  Failed to setup routing: %v", err)
-		log.Println("⚠️  You may need to manually configure routes")
-	} else {
-		log.Println("✅ Routing configured successfully")
+	if len(pushed) > 0 && !*prof.AcceptRoutes {
+		log.Printf("⚠️  Ignoring routes %v pushed by the server (accept_routes is off)", pushed)
+	}
+	routes := prof.includeRoutes(pushed)
+	if err := setupRouting(server.Addr(), prof, routes); err != nil {
+		cleanupNetwork()
+		log.Fatalf("❌ Failed to setup routing: %v", err)
 	}
+	log.Println("✅ Routing configured successfully")
 
-	// 5. Start Packet Handlers (bidirectional)
+	// 5. Point the host's resolver at the tunnel's DNS servers
+	if err := setupDNS(prof.DNSMode, dnsServers, dnsSearch, fullTunnel(routes)); err != nil {
+		cleanupNetwork()
+		log.Fatalf("❌ Failed to setup DNS: %v", err)
+	}
+
+	// 6. Start Packet Handlers (bidirectional)
 	log.Println("🚀 Starting packet handlers...")
-	go handleIncomingPackets(conn) // UDP -> TUN
-	go handleOutgoingPackets(conn) // TUN -> UDP
+	go handleOutgoingPackets() // TUN -> UDP
+	if !legacyMode {
+		go reconnector(prof, &dialer, server)
+		go watchLocalAddress(&dialer, prof.underlayNetwork())
+	}
+	go watchStatusSignal()
+	if pmtuDiscovery {
+		// Linux drops the IPv6 addresses of a link below the IPv6 minimum
+		floor := MIN_MTU
+		if slices.ContainsFunc(addrs, func(p netip.Prefix) bool { return p.Addr().Is6() }) {
+			floor = min(IPV6_MIN_MTU, tunMTU)
+		}
+		go discoverPathMTU(floor, tunMTU)
+		go watchBlackHole()
+	}
 	log.Println("✅ CipherWall VPN Client is running!")
-	log.Println("🌐 All internet traffic is now routed through the VPN")
+	if fullTunnel(routes) {
+		log.Println("🌐 All internet traffic is now routed through the VPN")
+	} else {
+		log.Printf("🌐 Traffic to %v is now routed through the VPN", routes)
+	}
+	if len(prof.exclude) > 0 {
+		log.Printf("🌐 Traffic to %v stays on the local network", prof.exclude)
+	}
 
 	// Handle graceful shutdown
 	sigChan := make(chan os.Signal, 1)
@@ -107,38 +326,353 @@ func main() {
 	<-sigChan
 
 	log.Println("\n👋 Shutting down gracefully...")
-	cleanupRouting(*serverAddr)
+	disconnectNetwork()
 	log.Println("✅ Cleanup complete. Goodbye!")
 }
 
-// executeCommand runs a system command
-func executeCommand(name string, args ...string) error {
-	cmd := exec.Command(name, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+// loadProfile loads the config file, selects a profile, applies command
+// line overrides and defaults, and validates the result. The config file is
+// optional unless -config was given explicitly.
+func loadProfile(configPath, profileName string) (*clientProfile, error) {
+	explicit := false
+	flag.Visit(func(f *flag.Flag) {
+		explicit = explicit || f.Name == "config"
+	})
+
+	cfg, err := loadClientConfig(configPath, explicit)
+	if err != nil {
+		return nil, err
+	}
+	prof, err := cfg.selectProfile(profileName)
+	if err != nil {
+		return nil, err
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		value := f.Value.String()
+		switch f.Name {
+		case "server":
+			prof.Server = value
+		case "server-key":
+			prof.ServerKey = value
+		case "key":
+			prof.KeyFile = value
+		case "psk-file":
+			prof.PSKFile = value
+		case "cipher":
+			prof.Cipher = value
+		case "rekey-bytes":
+			limit := f.Value.(flag.Getter).Get().(uint64)
+			prof.RekeyBytes = &limit
+		case "mtu":
+			prof.MTU = f.Value.(flag.Getter).Get().(int)
+		case "log-level":
+			prof.LogLevel = value
+		case "dns-mode":
+			prof.DNSMode = value
+		case "routing":
+			prof.Routing = value
+		case "underlay":
+			prof.Underlay = value
+		case "kill-switch":
+			prof.KillSwitch = f.Value.(flag.Getter).Get().(bool)
+		case "fragment":
+			prof.Fragment = f.Value.(flag.Getter).Get().(int)
+		case "keepalive":
+			keepalive := f.Value.(flag.Getter).Get().(time.Duration)
+			prof.Keepalive = &keepalive
+		case "dead-peer-timeout":
+			timeout := f.Value.(flag.Getter).Get().(time.Duration)
+			prof.DeadPeerTimeout = &timeout
+		case "pmtu-discovery":
+			discover := f.Value.(flag.Getter).Get().(bool)
+			prof.PMTUDiscovery = &discover
+		}
+	})
+	prof.applyDefaults()
+	if err := prof.validate(); err != nil {
+		if prof.name != "" {
+			return nil, fmt.Errorf("profile %q: %w", prof.name, err)
+		}
+		return nil, err
+	}
+	return prof, nil
+}
+
+// deriveKeys uses PBKDF2 to generate keys from PSK
+func deriveKeys(psk []byte, iterations int, salt string) {
+	masterKey = pbkdf2.Key(psk, []byte(salt), iterations, KEY_LEN*2, sha256.New)
+	aesKey = masterKey[:KEY_LEN]
+	hmacKey = masterKey[KEY_LEN:]
+}
 
-	log.Printf("⚙️  Executing: %s %v", name, args)
+// setupDataChannel loads the client's static key, the server's public key
+// and the handshake PSK, and selects the cipher suites this client offers.
+// Without a PSK file the PSK is derived from the shared PSK.
+func setupDataChannel(cipherName, serverKeyB64, keyFile, pskFile string) error {
+	var err error
+	if suites, err = offeredCipherSuites(cipherName); err != nil {
+		return err
+	}
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("command '%s %v' failed: %w", name, args, err)
+	if suites[0] == suiteLegacyCFB {
+		legacyMode = true
+		log.Println("⚠️  Using legacy AES-CFB + HMAC framing; the server must enable VPN_LEGACY_CFB")
+		return nil
 	}
 
+	if serverKey, err = parsePublicKey(serverKeyB64); err != nil {
+		return err
+	}
+
+	var created bool
+	if staticKey, created, err = loadOrCreatePrivateKey(keyFile); err != nil {
+		return err
+	}
+	if created {
+		log.Printf("🔑 Generated new client key in %s", keyFile)
+	}
+	log.Printf("🔑 Client public key: %s (register it in the server's peers file)", staticKey.publicKey())
+
+	if pskFile == "" {
+		handshakePSK, err = deriveHandshakePSK(masterKey)
+		return err
+	}
+	data, err := os.ReadFile(pskFile)
+	if err != nil {
+		return fmt.Errorf("failed to read PSK file: %w", err)
+	}
+	if handshakePSK, err = parsePresharedKey(string(data)); err != nil {
+		return fmt.Errorf("invalid PSK file %s: %w", pskFile, err)
+	}
 	return nil
 }
 
-// deriveKeys uses PBKDF2 to generate keys from PSK
-func deriveKeys(psk []byte) {
-	if len(psk) != 32 {
-		log.Fatalf("❌ PSK must be exactly 32 bytes, got %d bytes", len(psk))
+// initiateHandshake sends a fresh handshake initiation to the server. Any
+// earlier initiation still waiting for a response is abandoned.
+func initiateHandshake(conn *net.UDPConn) error {
+	payload, err := json.Marshal(handshakeInit{Timestamp: time.Now().UnixNano(), Suites: suites, Fragment: fragmentSize})
+	if err != nil {
+		return err
+	}
+	index, err := randomUint32()
+	if err != nil {
+		return err
+	}
+	hs, msg, err := createInitiation(staticKey, serverKey, index, payload)
+	if err != nil {
+		return err
 	}
 
-	masterKey := pbkdf2.Key(psk, []byte(PBKDF2_SALT), PBKDF2_ITERATIONS, KEY_LEN*2, sha256.New)
-	aesKey = masterKey[:KEY_LEN]
-	hmacKey = masterKey[KEY_LEN:]
+	handshakeMu.Lock()
+	pendingHandshake = hs
+	handshakeSentAt = time.Now()
+	handshakeMu.Unlock()
+
+	if _, err := conn.Write(msg); err != nil {
+		return fmt.Errorf("failed to send handshake initiation: %w", err)
+	}
+	return nil
+}
+
+// handleHandshakeResponse completes the pending handshake, rotates the
+// session keys and confirms them to the server with an empty keepalive frame
+func handleHandshakeResponse(conn *net.UDPConn, packet []byte) error {
+	handshakeMu.Lock()
+	defer handshakeMu.Unlock()
+
+	if pendingHandshake == nil {
+		return errors.New("no handshake in progress")
+	}
+
+	respPayload, err := pendingHandshake.consumeResponse(handshakePSK, packet)
+	if err != nil {
+		return err
+	}
+
+	var resp handshakeResponse
+	if err := json.Unmarshal(respPayload, &resp); err != nil {
+		return fmt.Errorf("invalid handshake response payload: %w", err)
+	}
+	if _, ok := selectCipherSuite([]cipherSuite{resp.Suite}, suites); !ok {
+		return fmt.Errorf("server chose unoffered cipher suite %s", resp.Suite)
+	}
+
+	kp, err := pendingHandshake.deriveKeypair(resp.Suite, true)
+	if err != nil {
+		return err
+	}
+	pendingHandshake = nil
+	lastReceived.Store(time.Now().UnixNano())
+
+	// The TUN interface keeps the first lease and routes for the life of
+	// the process
+	if tunnelAddrs == nil {
+		tunnelAddrs = resp.Addresses
+		pushedRoutes = resp.Routes
+		pushedDNS, pushedSearch = resp.DNS, resp.Search
+	} else {
+		if !slices.Equal(tunnelAddrs, resp.Addresses) {
+			log.Printf("⚠️  Server leased %v, keeping %v until restart", resp.Addresses, tunnelAddrs)
+		}
+		if !slices.Equal(pushedRoutes, resp.Routes) {
+			log.Printf("⚠️  Server pushed routes %v, keeping %v until restart", resp.Routes, pushedRoutes)
+		}
+		if !slices.Equal(pushedDNS, resp.DNS) || !slices.Equal(pushedSearch, resp.Search) {
+			log.Printf("⚠️  Server pushed DNS %v %v, keeping %v %v until restart", resp.DNS, resp.Search, pushedDNS, pushedSearch)
+		}
+	}
+
+	if old := currentKeypair.Swap(kp); old != nil {
+		previousKeypair.Store(old)
+		log.Printf("🔄 Session rekeyed (suite %s)", kp.suite)
+	}
+
+	select {
+	case sessionReady <- struct{}{}:
+	default:
+	}
+
+	// The server switches to the new keys once it receives a frame under them
+	keepalive, err := kp.seal(nil)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(keepalive); err != nil {
+		return fmt.Errorf("failed to confirm new session: %w", err)
+	}
+	return nil
+}
+
+// maintainSession retransmits unanswered initiations, sends keepalives when
+// the server has been quiet, starts a new handshake once the current keys
+// reach their time, message or byte limit, and reconnects when the server
+// stops answering. The reconnect loop handles its own handshakes.
+func maintainSession() {
+	defer cleanupOnPanic()
+	ticker := time.NewTicker(KEEPALIVE_CHECK_INTERVAL)
+	defer ticker.Stop()
+	var lastKeepalive time.Time
+
+	for range ticker.C {
+		if reconnecting.Load() {
+			continue
+		}
+		conn := serverConn.Load()
+
+		handshakeMu.Lock()
+		pending := pendingHandshake != nil
+		sentAt := handshakeSentAt
+		handshakeMu.Unlock()
+
+		kp := currentKeypair.Load()
+		silent := time.Since(time.Unix(0, lastReceived.Load()))
+		if !pending && keepalive > 0 && silent >= keepalive && time.Since(lastKeepalive) >= keepalive {
+			lastKeepalive = time.Now()
+			if err := sendControl(conn, []byte{CONTROL_KEEPALIVE}); err != nil {
+				log.Printf("⚠️  Failed to send keepalive: %v", err)
+			}
+		}
+
+		switch {
+		case pending && time.Since(sentAt) >= HANDSHAKE_TIMEOUT:
+			log.Println("⚠️  No handshake response, retrying...")
+		case deadPeerTimeout > 0 && silent >= deadPeerTimeout:
+			requestReconnect(fmt.Sprintf("no answer from the server for %s", silent.Round(time.Second)))
+			continue
+		case !pending && kp != nil && kp.needsRekey(rekeyBytes):
+			log.Println("🔄 Session keys reached their limit, rekeying...")
+		default:
+			continue
+		}
+
+		if err := initiateHandshake(conn); err != nil {
+			log.Printf("⚠️  Failed to initiate handshake: %v", err)
+		}
+	}
+}
+
+// handleControl answers the server's path MTU probes and keepalives, and
+// hands path MTU acks to the prober
+func handleControl(conn *net.UDPConn, msg []byte) {
+	var reply []byte
+	switch msg[0] {
+	case CONTROL_PMTU_PROBE:
+		ack, err := pmtuAck(msg)
+		if err != nil {
+			log.Printf("⚠️  Ignoring path MTU probe: %v", err)
+			return
+		}
+		reply = ack
+	case CONTROL_PMTU_ACK:
+		id, err := parsePMTUMessage(msg)
+		if err != nil {
+			log.Printf("⚠️  Ignoring path MTU ack: %v", err)
+			return
+		}
+		select {
+		case pmtuAcks <- id:
+		default:
+		}
+		return
+	case CONTROL_KEEPALIVE:
+		reply = []byte{CONTROL_KEEPALIVE_ACK}
+	case CONTROL_KEEPALIVE_ACK:
+		return // Receiving it was the point
+	default:
+		debugf("⚠️  Ignoring unknown control message type %d", msg[0])
+		return
+	}
+	if err := sendControl(conn, reply); err != nil {
+		log.Printf("⚠️  Failed to answer the server: %v", err)
+	}
+}
+
+// sendControl sends a control message to the server
+func sendControl(conn *net.UDPConn, msg []byte) error {
+	frame, err := sealPacket(msg)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(frame)
+	return err
 }
 
-// setupTUN configures the virtual network interface
-func setupTUN() (*water.Interface, error) {
+// openPacket authenticates and decrypts a packet from the server with the
+// current or previous session keys
+func openPacket(packet []byte) ([]byte, error) {
+	if legacyMode {
+		return legacyOpen(aesKey, hmacKey, packet)
+	}
+
+	hdr, err := parseFrameHeader(packet)
+	if err != nil {
+		return nil, err
+	}
+	for _, kp := range []*keypair{currentKeypair.Load(), previousKeypair.Load()} {
+		if kp != nil && kp.localIndex == hdr.ReceiverIndex {
+			return kp.open(hdr, packet)
+		}
+	}
+	return nil, fmt.Errorf("no session for index %d", hdr.ReceiverIndex)
+}
+
+// sealPacket encrypts and authenticates a packet for the server
+func sealPacket(plaintext []byte) ([]byte, error) {
+	if legacyMode {
+		return legacySeal(aesKey, hmacKey, plaintext)
+	}
+
+	kp := currentKeypair.Load()
+	if kp == nil {
+		return nil, errors.New("no session established")
+	}
+	return kp.seal(plaintext)
+}
+
+// setupTUN configures the virtual network interface with the client's
+// tunnel addresses and MTU
+func setupTUN(addrs []netip.Prefix, mtu int) (*water.Interface, error) {
 	config := water.Config{
 		DeviceType: water.TUN,
 	}
@@ -151,175 +685,500 @@ func setupTUN() (*water.Interface, error) {
 	ifaceName := iface.Name()
 	log.Printf("📝 TUN interface created: %s", ifaceName)
 
-	// Configure IP address based on OS
+	// Configure IP addresses based on OS
 	if runtime.GOOS == "darwin" {
-		// macOS uses ifconfig
-		if err := executeCommand("ifconfig", ifaceName, "10.8.0.2", "10.8.0.1", "up"); err != nil {
-			return nil, fmt.Errorf("failed to configure TUN interface: %w", err)
+		// macOS uses ifconfig; utun is point-to-point, so IPv4 needs the
+		// server's address (the first host of the pool) as the peer
+		for _, addr := range addrs {
+			var err error
+			if addr.Addr().Is4() {
+				peer := addr.Masked().Addr().Next()
+				err = executeCommand("ifconfig", ifaceName, "inet", addr.Addr().String(), peer.String(), "up")
+			} else {
+				err = executeCommand("ifconfig", ifaceName, "inet6", addr.Addr().String(), "prefixlen", strconv.Itoa(addr.Bits()))
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to configure TUN interface: %w", err)
+			}
 		}
-	} else {
-		// Linux uses ip command
-		if err := executeCommand("ip", "addr", "add", CLIENT_IP, "dev", ifaceName); err != nil {
-			return nil, fmt.Errorf("failed to assign IP to TUN interface: %w", err)
+		if err := executeCommand("ifconfig", ifaceName, "mtu", strconv.Itoa(mtu)); err != nil {
+			return nil, fmt.Errorf("failed to set TUN interface MTU: %w", err)
 		}
-
-		// Bring interface up
-		if err := executeCommand("ip", "link", "set", "dev", ifaceName, "up"); err != nil {
-			return nil, fmt.Errorf("failed to bring up TUN interface: %w", err)
+	} else {
+		// Linux uses netlink; a partial configuration is rolled back
+		if err := configureLink(&netChanges, ifaceName, addrs, mtu); err != nil {
+			cleanupNetwork()
+			iface.Close()
+			return nil, fmt.Errorf("failed to configure TUN interface: %w", err)
 		}
 	}
 
 	return iface, nil
 }
 
-// setupRouting configures system routes to send all traffic through VPN
-func setupRouting(serverAddr string) error {
-	// Extract server IP (remove port)
-	host, _, err := net.SplitHostPort(serverAddr)
-	if err != nil {
-		return fmt.Errorf("failed to parse server address: %w", err)
-	}
+// setupRouting sends the include routes through the VPN and keeps the
+// server and the profile's excluded routes on the underlay. The most
+// specific route wins, so an exclude carves a hole in a wider include and
+// vice versa. Every route is recorded in netChanges; on error the caller
+// rolls back the routes added so far.
+func setupRouting(serverIP netip.Addr, prof *clientProfile, include []netip.Prefix) error {
+	exclude := prof.exclude
+	host := serverIP.String()
+	hostRoute := netip.PrefixFrom(serverIP, serverIP.BitLen())
 
 	if runtime.GOOS == "darwin" {
 		// macOS routing setup
-		// Get default gateway
-		cmd := exec.Command("route", "-n", "get", "default")
-		output, err := cmd.Output()
-		if err != nil {
+		// Find how everything is reached before the tunnel changes
+		// anything
+		defaultGateway, _, err := darwinRouteTo("default")
+		if err != nil && fullTunnel(include) {
 			return fmt.Errorf("failed to get default gateway: %w", err)
 		}
 
-		log.Printf("📋 Current default route: %s", string(output))
-
-		// Get the active network interface (en0 or en1)
-		activeInterface := "en1" // Your system uses en1 based on the route output
-
 		// Add specific route to VPN server through existing gateway
 		// This must be done BEFORE changing default routes
-		if err := executeCommand("route", "add", "-host", host, "-gateway", "192.168.1.1"); err != nil {
-			log.Printf("⚠️  Warning: Failed to add server route: %v", err)
-			// Try alternative method
-			if err := executeCommand("route", "add", "-host", host, "-interface", activeInterface); err != nil {
-				log.Printf("⚠️  Warning: Alternative server route also failed: %v", err)
-			}
+		if err := darwinPinHost(serverIP, serverIP); err != nil {
+			return err
 		}
 
-		// Delete existing default route temporarily and add VPN as default
-		// First, save the original gateway
-		originalGateway := "192.168.1.1"
-
-		// Delete old default route
-		if err := executeCommand("route", "delete", "default"); err != nil {
-			log.Printf("⚠️  Warning: Failed to delete default route: %v", err)
+		// Keep excluded prefixes on the route they use now
+		for _, route := range exclude {
+			gateway, ifaceName, err := darwinRouteTo(route.Addr().String())
+			if err != nil {
+				return fmt.Errorf("failed to find route to excluded %s: %w", route, err)
+			}
+			args := darwinRouteArgs("add", route, "-interface", ifaceName)
+			if gateway != "" {
+				args = darwinRouteArgs("add", route, "-gateway", gateway)
+			}
+			if err := netChanges.runCommand(darwinRouteArgs("delete", route), args[0], args[1:]...); err != nil {
+				return fmt.Errorf("failed to add excluded route %s: %w", route, err)
+			}
 		}
 
-		// Add new default route through VPN
-		if err := executeCommand("route", "add", "default", "-interface", iface.Name()); err != nil {
-			return fmt.Errorf("failed to add VPN default route: %w", err)
+		if fullTunnel(include) {
+			// Replace the default route with one through the VPN
+			if err := netChanges.runCommand([]string{"route", "add", "default", defaultGateway}, "route", "delete", "default"); err != nil {
+				log.Printf("⚠️  Warning: Failed to delete default route: %v", err)
+			}
+			if err := netChanges.runCommand([]string{"route", "delete", "default"}, "route", "add", "default", "-interface", iface.Name()); err != nil {
+				return fmt.Errorf("failed to add VPN default route: %w", err)
+			}
 		}
 
-		// Also add the /1 routes as backup
-		if err := executeCommand("route", "add", "-net", "0.0.0.0/1", "-interface", iface.Name()); err != nil {
-			log.Printf("⚠️  Warning: Failed to add 0/1 route: %v", err)
+		// Add the include routes; a default route also gets the /1 routes
+		// as backup
+		for _, route := range tunnelRoutes(include) {
+			args := darwinRouteArgs("add", route, "-interface", iface.Name())
+			if err := netChanges.runCommand(darwinRouteArgs("delete", route), args[0], args[1:]...); err != nil {
+				return fmt.Errorf("failed to add VPN route %s: %w", route, err)
+			}
 		}
+		return nil
+	}
 
-		if err := executeCommand("route", "add", "-net", "128.0.0.0/1", "-interface", iface.Name()); err != nil {
-			log.Printf("⚠️  Warning: Failed to add 128/1 route: %v", err)
+	// Linux routing setup
+	if _, err := os.Stat("/proc/sys/net/ipv6"); err != nil {
+		// Without IPv6 in the kernel there is nothing to leak
+		include = slices.DeleteFunc(slices.Clone(include), func(route netip.Prefix) bool {
+			return route.Addr().Is6()
+		})
+		debugf("⚠️  IPv6 is disabled, skipping IPv6 routes")
+	}
+	// Pin the excluded prefixes and, unless the socket mark takes care of
+	// it, the VPN server to their current underlay routes; the server pin
+	// avoids a routing loop
+	pinned := exclude
+	if prof.Routing == ROUTING_MAIN {
+		pinned = append([]netip.Prefix{hostRoute}, exclude...)
+	}
+	for _, route := range pinned {
+		what := "excluded " + route.String()
+		if route == hostRoute {
+			what = "server " + host
 		}
-
-		_ = originalGateway // Will use for cleanup
-	} else {
-		// Linux routing setup
-		// Get default gateway
-		cmd := exec.Command("ip", "route", "show", "default")
-		output, err := cmd.Output()
-		if err != nil {
-			return fmt.Errorf("failed to get default gateway: %w", err)
+		if err := pinUnderlay(route, what); err != nil {
+			return err
 		}
+	}
 
-		log.Printf("📋 Current default route: %s", string(output))
+	if prof.Routing == ROUTING_POLICY {
+		return setupPolicyRouting(include, prof.FwMark, prof.Table)
+	}
 
-		// Add route to VPN server through existing gateway to avoid routing loop
-		if err := executeCommand("ip", "route", "add", host+"/32", "via", "default"); err != nil {
-			log.Printf("⚠️  Failed to add server route (may already exist): %v", err)
+	// Route the included prefixes through the VPN
+	for _, route := range tunnelRoutes(include) {
+		if err := netChanges.addRoute(route, iface.Name(), netip.Addr{}, 0); err != nil {
+			return fmt.Errorf("failed to add VPN route: %w", err)
 		}
+	}
+	return nil
+}
 
-		// Add default route through VPN
-		if err := executeCommand("ip", "route", "add", "0.0.0.0/1", "dev", iface.Name()); err != nil {
+// setupPolicyRouting puts the include routes in their own routing table and
+// sends every packet without the client's mark there, after the main table
+// had its say with everything but its default route. The UDP socket carries
+// the mark, so the tunnel's own packets follow the main table and no server
+// route is needed, even when the underlay changes.
+func setupPolicyRouting(include []netip.Prefix, mark uint32, table int) error {
+	families := map[string]bool{}
+	for _, route := range include {
+		if err := netChanges.addRoute(route, iface.Name(), netip.Addr{}, table); err != nil {
 			return fmt.Errorf("failed to add VPN route: %w", err)
 		}
+		if route.Addr().Is4() {
+			families["ip"] = true
+		} else {
+			families["ip6"] = true
+		}
+	}
 
-		if err := executeCommand("ip", "route", "add", "128.0.0.0/1", "dev", iface.Name()); err != nil {
-			return fmt.Errorf("failed to add VPN route: %w", err)
+	if families["ip"] {
+		if err := netChanges.setSysctl(SYSCTL_SRC_VALID_MARK, "1"); err != nil {
+			return err
+		}
+	}
+	if err := netChanges.replaceNftTable("inet", NFT_TABLE, nftPolicyMarkRules(mark)); err != nil {
+		// Only hosts with strict reverse path filtering need it
+		log.Printf("⚠️  Failed to install connection mark rules, replies may be dropped under strict rp_filter: %v", err)
+	}
+	for _, family := range []string{"ip", "ip6"} {
+		if !families[family] {
+			continue
+		}
+		if err := netChanges.addSuppressRule(family, POLICY_RULE_PRIORITY); err != nil {
+			return fmt.Errorf("failed to add routing rule: %w", err)
+		}
+		if err := netChanges.addMarkRule(family, POLICY_RULE_PRIORITY+1, table, mark); err != nil {
+			return fmt.Errorf("failed to add routing rule: %w", err)
+		}
+	}
+	return nil
+}
+
+// setupDNS sends the host's DNS queries to the tunnel's servers while
+// connected, through systemd-resolved or by replacing /etc/resolv.conf. A
+// full tunnel sends every query there; with systemd-resolved a split tunnel
+// only sends queries for the search domains.
+func setupDNS(mode string, servers []netip.Addr, search []string, full bool) error {
+	if len(servers) == 0 || mode == DNS_MODE_OFF {
+		return nil
+	}
+	if runtime.GOOS != "linux" {
+		log.Printf("🌐 Use DNS servers %v (search %v) while connected; configure them in your resolver", servers, search)
+		return nil
+	}
+
+	if mode == DNS_MODE_AUTO {
+		mode = DNS_MODE_FILE
+		if resolvedRunning() {
+			mode = DNS_MODE_RESOLVED
+		}
+	}
+	if mode == DNS_MODE_RESOLVED {
+		domains := slices.Clone(search)
+		if full {
+			domains = append(domains, "~.") // Route every query to this link
 		}
+		if err := netChanges.setLinkDNS(iface.Name(), servers, domains); err != nil {
+			return err
+		}
+	} else if err := netChanges.replaceFile(RESOLV_CONF, RESOLV_CONF_BACKUP, resolvConf(servers, search)); err != nil {
+		return err
 	}
+	log.Printf("✅ DNS servers %v (search %v) configured with %s", servers, search, mode)
+	return nil
+}
 
+// resolvedRunning reports whether systemd-resolved manages the host's DNS
+func resolvedRunning() bool {
+	if _, err := exec.LookPath("resolvectl"); err != nil {
+		return false
+	}
+	info, err := os.Stat("/run/systemd/resolve")
+	return err == nil && info.IsDir()
+}
+
+// pinUnderlay keeps a route on its current underlay route, outside the
+// tunnel, and has watchUnderlay follow underlay changes for it
+func pinUnderlay(route netip.Prefix, what string) error {
+	underlay, err := lookupUnderlay(route, iface.Name(), false)
+	if err != nil {
+		return fmt.Errorf("failed to find route to %s: %w", what, err)
+	}
+	log.Printf("📋 Route to %s: %s", what, underlay)
+
+	pin, err := netChanges.addUnderlayRoute(route, underlay)
+	switch {
+	case err == nil:
+		pinsMu.Lock()
+		underlayPins = append(underlayPins, pin)
+		pinsMu.Unlock()
+		watchPins.Do(func() { go watchUnderlay() })
+	case errors.Is(err, os.ErrExist):
+		log.Printf("⚠️  Route %s already exists, leaving it in place", route)
+	default:
+		return fmt.Errorf("failed to add route to %s: %w", what, err)
+	}
 	return nil
 }
 
-// cleanupRouting removes VPN routes
-func cleanupRouting(serverAddr string) {
-	log.Println("🧹 Cleaning up routes...")
+// darwinPinHost routes a host outside the tunnel the way via is reached:
+// the server itself before the tunnel is up, the old server when the
+// server moves
+func darwinPinHost(host, via netip.Addr) error {
+	gateway, ifaceName, err := darwinRouteTo(via.String())
+	if err != nil {
+		return fmt.Errorf("failed to find route to server: %w", err)
+	}
+	log.Printf("📋 Server %s is reached via %s on %s", host, gateway, ifaceName)
 
-	if runtime.GOOS == "darwin" {
-		// macOS cleanup
-		// Delete VPN default route
-		executeCommand("route", "delete", "default")
+	family := "-inet"
+	if host.Is6() {
+		family = "-inet6"
+	}
+	undo := []string{"route", "delete", family, "-host", host.String()}
+	if gateway != "" {
+		err = netChanges.runCommand(undo, "route", "add", family, "-host", host.String(), "-gateway", gateway)
+	} else {
+		err = netChanges.runCommand(undo, "route", "add", family, "-host", host.String(), "-interface", ifaceName)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to add server route: %w", err)
+	}
+	return nil
+}
 
-		// Delete backup routes
-		executeCommand("route", "delete", "-net", "0.0.0.0/1")
-		executeCommand("route", "delete", "-net", "128.0.0.0/1")
+// watchUnderlay keeps the pinned server and exclude routes on the current
+// underlay route, e.g. after switching from Wi-Fi to Ethernet or a DHCP
+// gateway change. While no underlay route exists a pin is kept as it is.
+func watchUnderlay() {
+	defer cleanupOnPanic()
+	ticker := time.NewTicker(UNDERLAY_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		pinsMu.Lock()
+		pins := underlayPins
+		for i, pin := range pins {
+			underlay, err := lookupUnderlay(pin.Prefix, iface.Name(), true)
+			if err != nil {
+				debugf("⚠️  No underlay route to %s: %v", pin.Prefix, err)
+				continue
+			}
+			if underlay == (underlayRoute{Gateway: pin.Gateway, Link: pin.Link, Source: pin.Source}) {
+				continue
+			}
 
-		// Delete server-specific route
-		host, _, _ := net.SplitHostPort(serverAddr)
-		executeCommand("route", "delete", "-host", host)
+			repin := pin
+			repin.Gateway, repin.Link, repin.Source = underlay.Gateway, underlay.Link, underlay.Source
+			if err := netChanges.replaceRoute(pin, repin); err != nil {
+				log.Printf("⚠️  Failed to re-pin route %s: %v", pin.Prefix, err)
+				continue
+			}
+			log.Printf("🔀 Underlay changed, %s is now reached %s", pin.Prefix, underlay)
+			pins[i] = repin
+		}
+		pinsMu.Unlock()
+	}
+}
 
-		// Restore original default route
-		executeCommand("route", "add", "default", "192.168.1.1")
+// darwinRouteTo asks route(8) how the host reaches dst: the gateway, if
+// any, and the interface
+func darwinRouteTo(dst string) (string, string, error) {
+	args := []string{"-n", "get", dst}
+	if addr, err := netip.ParseAddr(dst); err == nil && addr.Is6() {
+		args = []string{"-n", "get", "-inet6", dst}
+	}
+	output, err := exec.Command("route", args...).Output()
+	if err != nil {
+		return "", "", fmt.Errorf("route get %s failed: %w", dst, err)
+	}
+
+	var gateway, ifaceName string
+	for _, line := range strings.Split(string(output), "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "gateway":
+			gateway = strings.TrimSpace(value)
+		case "interface":
+			ifaceName = strings.TrimSpace(value)
+		}
+	}
+	if ifaceName == "" {
+		return "", "", fmt.Errorf("no route to %s", dst)
+	}
+	return gateway, ifaceName, nil
+}
+
+// autoMTU derives the TUN MTU from the MTU of the interface the server is
+// reached through
+func autoMTU(server netip.Addr) (int, error) {
+	var link string
+	if runtime.GOOS == "darwin" {
+		_, ifaceName, err := darwinRouteTo(server.String())
+		if err != nil {
+			return 0, err
+		}
+		link = ifaceName
 	} else {
-		// Linux cleanup
-		executeCommand("ip", "route", "del", "0.0.0.0/1")
-		executeCommand("ip", "route", "del", "128.0.0.0/1")
+		route, err := lookupUnderlay(netip.PrefixFrom(server, server.BitLen()), "", false)
+		if err != nil {
+			return 0, err
+		}
+		link = route.Link
+	}
+	underlay, err := linkMTU(link)
+	if err != nil {
+		return 0, err
+	}
+	mtu := tunnelMTU(underlay, server.Is6(), legacyMode)
+	log.Printf("📏 TUN MTU %d: %s has MTU %d and the tunnel adds %d bytes", mtu, link, underlay, tunnelOverhead(server.Is6(), legacyMode))
+	return mtu, nil
+}
+
+// darwinRouteArgs builds a route(8) command line for a network prefix
+func darwinRouteArgs(action string, route netip.Prefix, args ...string) []string {
+	family := "-inet"
+	if route.Addr().Is6() {
+		family = "-inet6"
+	}
+	return append([]string{"route", action, family, "-net", route.String()}, args...)
+}
+
+// recoverNetwork opens the state file and reverts the changes a previous run
+// left in it. A kill switch left behind stays on if keepKillSwitch is set,
+// so traffic stays blocked until this run replaces it. Changes that cannot
+// be reverted stay in the file.
+func recoverNetwork(stateFile string, keepKillSwitch bool) error {
+	stale, err := netChanges.open(stateFile)
+	if err != nil {
+		return err
+	}
+	if stale == 0 {
+		return nil
+	}
+
+	log.Printf("⚠️  Found %d network changes from a client that did not exit cleanly, reverting...", stale)
+	var keep func(netChange) bool
+	if keepKillSwitch {
+		keep = isKillSwitch
+	}
+	if err := netChanges.rollbackExcept(keep); err != nil {
+		return fmt.Errorf("some network changes could not be reverted, they are kept in %s; fix them and run -cleanup: %w", stateFile, err)
+	}
+	return nil
+}
+
+// enableKillSwitch installs or updates the kill switch: nothing but the
+// tunnel interface, loopback, the UDP flow to the server and the allowed
+// prefixes gets through
+func enableKillSwitch(server netip.AddrPort, tun string, allow []netip.Prefix) error {
+	return netChanges.replaceNftTable("inet", NFT_KILL_SWITCH_TABLE, nftKillSwitchRules(server, tun, allow))
+}
 
-		host, _, _ := net.SplitHostPort(serverAddr)
-		executeCommand("ip", "route", "del", host+"/32")
+// isKillSwitch reports whether a change is the kill switch
+func isKillSwitch(change netChange) bool {
+	return change.Kind == NET_CHANGE_NFT_TABLE && change.NftName == NFT_KILL_SWITCH_TABLE
+}
+
+// cleanupOnPanic reverts the client's network changes before a panic takes
+// the process down. Deferred at the top of each long-running goroutine.
+func cleanupOnPanic() {
+	if r := recover(); r != nil {
+		log.Printf("❌ Panic: %v", r)
+		cleanupNetwork()
+		panic(r)
+	}
+}
+
+// cleanupNetwork reverts the routes and interface settings made by the
+// client, newest first, when it fails. The kill switch stays on: only an
+// explicit disconnect lifts it.
+func cleanupNetwork() {
+	log.Println("🧹 Cleaning up routes...")
+	if err := netChanges.rollbackExcept(isKillSwitch); err != nil {
+		log.Printf("⚠️  Failed to revert some network changes: %v", err)
+	}
+	if netChanges.contains(netChange{Kind: NET_CHANGE_NFT_TABLE, Family: "inet", NftName: NFT_KILL_SWITCH_TABLE}) {
+		log.Println("🔒 Kill switch stays on; reconnect, or run -cleanup to disconnect")
+	}
+}
+
+// disconnectNetwork reverts everything the client changed, including the
+// kill switch
+func disconnectNetwork() {
+	log.Println("🧹 Cleaning up routes...")
+	if err := netChanges.rollback(); err != nil {
+		log.Printf("⚠️  Failed to revert some network changes: %v", err)
 	}
 }
 
 // handleIncomingPackets reads from UDP and writes to TUN after decrypting/authenticating
 func handleIncomingPackets(conn *net.UDPConn) {
-	buffer := make([]byte, BUFFER_SIZE)
+	defer cleanupOnPanic()
+	buffer := make([]byte, MAX_DATAGRAM_SIZE)
 
 	log.Println("🎯 Incoming packet handler ready (UDP -> TUN)")
 
 	for {
 		n, err := conn.Read(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return // Replaced by a reconnect
+		}
 		if err != nil {
 			log.Printf("⚠️  Error reading from UDP: %v", err)
 			continue
 		}
 
-		if n < HMAC_LEN {
-			log.Printf("⚠️  Packet too short (%d bytes)", n)
-			continue
-		}
-
 		packet := buffer[:n]
 
-		// Packet structure: [HMAC_TAG (32 bytes)][IV (16 bytes)][ENCRYPTED_DATA]
-		receivedHMAC := packet[:HMAC_LEN]
-		dataWithIV := packet[HMAC_LEN:]
+		if !legacyMode && messageType(packet) == MSG_TYPE_FRAGMENT {
+			frame, err := fragments.add("", packet)
+			if err != nil {
+				log.Printf("❌ Dropping fragment: %v", err)
+				continue
+			}
+			if frame == nil {
+				continue
+			}
+			packet = frame
+		}
 
-		// Verify HMAC
-		if !verifyHMAC(dataWithIV, receivedHMAC) {
-			log.Printf("❌ HMAC verification failed")
+		if !legacyMode && messageType(packet) == MSG_TYPE_HANDSHAKE_RESPONSE {
+			if err := handleHandshakeResponse(conn, packet); err != nil {
+				log.Printf("⚠️  Ignoring handshake response: %v", err)
+			}
 			continue
 		}
 
-		// Decrypt the data
-		decryptedData, err := decrypt(dataWithIV)
+		// Authenticate and decrypt the packet
+		decryptedData, err := openPacket(packet)
 		if err != nil {
-			log.Printf("⚠️  Decryption failed: %v", err)
+			log.Printf("❌ Dropping packet: %v", err)
+			continue
+		}
+		lastReceived.Store(time.Now().UnixNano())
+
+		// Empty frames are keepalives
+		if len(decryptedData) == 0 {
+			continue
+		}
+		if isControl(decryptedData) {
+			handleControl(conn, decryptedData)
+			continue
+		}
+
+		lastDataReceived.Store(time.Now().UnixNano())
+
+		// Data can only arrive early if the server resends it; drop it
+		// until the TUN interface exists
+		select {
+		case <-tunReady:
+		default:
 			continue
 		}
 
@@ -330,113 +1189,60 @@ func handleIncomingPackets(conn *net.UDPConn) {
 			continue
 		}
 
-		log.Printf("📥 Received: %d bytes encrypted -> %d bytes decrypted", n, len(decryptedData))
+		debugf("📥 Received: %d bytes encrypted -> %d bytes decrypted", n, len(decryptedData))
 	}
 }
 
 // handleOutgoingPackets reads from TUN and sends to UDP after encrypting/authenticating
-func handleOutgoingPackets(conn *net.UDPConn) {
-	buffer := make([]byte, BUFFER_SIZE)
+func handleOutgoingPackets() {
+	defer cleanupOnPanic()
+	buffer := make([]byte, tunMTU)
+	readErrors := 0
 
 	log.Println("🎯 Outgoing packet handler ready (TUN -> UDP)")
 
 	for {
 		n, err := iface.Read(buffer)
 		if err != nil {
+			// A closed or deleted interface fails every read; the routes
+			// through it are useless, so take them down and exit
+			readErrors++
+			if readErrors >= TUN_READ_ERROR_LIMIT || errors.Is(err, os.ErrClosed) || errors.Is(err, io.EOF) {
+				cleanupNetwork()
+				log.Fatalf("❌ TUN interface failed: %v", err)
+			}
 			log.Printf("⚠️  Error reading from TUN: %v", err)
 			continue
 		}
+		readErrors = 0
 
 		packet := buffer[:n]
 
 		// Encrypt and authenticate the packet
-		encryptedPacket, err := encryptAndAuthenticate(packet)
+		encryptedPacket, err := sealPacket(packet)
 		if err != nil {
 			log.Printf("⚠️  Failed to encrypt packet: %v", err)
 			continue
 		}
 
-		// Send to server
-		_, err = conn.Write(encryptedPacket)
+		// Send to server, in fragments if the frame is too big
+		datagrams, err := fragmentFrame(encryptedPacket, fragmentSize)
+		if err != nil {
+			log.Printf("⚠️  Failed to fragment packet: %v", err)
+			continue
+		}
+		conn := serverConn.Load()
+		for _, datagram := range datagrams {
+			if _, err = conn.Write(datagram); err != nil {
+				break
+			}
+		}
 		if err != nil {
 			log.Printf("⚠️  Failed to send packet: %v", err)
 			continue
 		}
+		lastDataSent.Store(time.Now().UnixNano())
 
-		log.Printf("📤 Sent: %d bytes plaintext -> %d bytes encrypted", n, len(encryptedPacket))
-	}
-}
-
-// verifyHMAC checks if the received HMAC matches the computed HMAC
-func verifyHMAC(data, receivedHMAC []byte) bool {
-	mac := hmac.New(sha256.New, hmacKey)
-	mac.Write(data)
-	expectedHMAC := mac.Sum(nil)
-	return hmac.Equal(expectedHMAC, receivedHMAC)
-}
-
-// decrypt decrypts data using AES-256 CFB mode
-func decrypt(data []byte) ([]byte, error) {
-	if len(data) < IV_LEN {
-		return nil, fmt.Errorf("data too short: need at least %d bytes for IV", IV_LEN)
-	}
-
-	iv := data[:IV_LEN]
-	ciphertext := data[IV_LEN:]
-
-	block, err := aes.NewCipher(aesKey)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create cipher: %w", err)
-	}
-
-	stream := cipher.NewCFBDecrypter(block, iv)
-	plaintext := make([]byte, len(ciphertext))
-	stream.XORKeyStream(plaintext, ciphertext)
-
-	return plaintext, nil
-}
-
-// encrypt encrypts data using AES-256 CFB mode
-func encrypt(plaintext []byte) ([]byte, error) {
-	block, err := aes.NewCipher(aesKey)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create cipher: %w", err)
-	}
-
-	iv := make([]byte, IV_LEN)
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		return nil, fmt.Errorf("failed to generate IV: %w", err)
-	}
-
-	ciphertext := make([]byte, len(plaintext))
-	stream := cipher.NewCFBEncrypter(block, iv)
-	stream.XORKeyStream(ciphertext, plaintext)
-
-	result := make([]byte, IV_LEN+len(ciphertext))
-	copy(result[:IV_LEN], iv)
-	copy(result[IV_LEN:], ciphertext)
-
-	return result, nil
-}
-
-// addHMAC adds HMAC tag to data
-func addHMAC(data []byte) []byte {
-	mac := hmac.New(sha256.New, hmacKey)
-	mac.Write(data)
-	hmacTag := mac.Sum(nil)
-
-	result := make([]byte, HMAC_LEN+len(data))
-	copy(result[:HMAC_LEN], hmacTag)
-	copy(result[HMAC_LEN:], data)
-
-	return result
-}
-
-// encryptAndAuthenticate performs both encryption and authentication
-func encryptAndAuthenticate(plaintext []byte) ([]byte, error) {
-	encrypted, err := encrypt(plaintext)
-	if err != nil {
-		return nil, err
+		debugf("📤 Sent: %d bytes plaintext -> %d bytes encrypted", n, len(encryptedPacket))
 	}
-	return addHMAC(encrypted), nil
 }
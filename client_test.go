@@ -0,0 +1,40 @@
+//go:build client
+// +build client
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// The kill switch outlives a failed connection and a crash recovery; only
+// an explicit disconnect lifts it
+func TestKillSwitchKept(t *testing.T) {
+	killSwitch := netChange{Kind: NET_CHANGE_NFT_TABLE, Family: "inet", NftName: NFT_KILL_SWITCH_TABLE}
+	route := netChange{Kind: NET_CHANGE_COMMAND, Undo: []string{"true"}}
+	if !isKillSwitch(killSwitch) || isKillSwitch(route) || isKillSwitch(netChange{Kind: NET_CHANGE_NFT_TABLE, Family: "inet"}) {
+		t.Fatal("isKillSwitch matches the wrong changes")
+	}
+
+	netChanges = netJournal{changes: []netChange{killSwitch, route}}
+	t.Cleanup(func() { netChanges = netJournal{} })
+	cleanupNetwork()
+	if len(netChanges.changes) != 1 || !netChanges.contains(killSwitch) {
+		t.Fatalf("journal after a failure: %v, want only the kill switch", netChanges.changes)
+	}
+
+	state := filepath.Join(t.TempDir(), "state.json")
+	writeState(t, state, []netChange{killSwitch, route})
+	netChanges = netJournal{}
+	if err := recoverNetwork(state, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(netChanges.changes) != 1 || !netChanges.contains(killSwitch) {
+		t.Fatalf("journal after recovery: %v, want only the kill switch", netChanges.changes)
+	}
+	var saved netJournal
+	if stale, err := saved.open(state); err != nil || stale != 1 {
+		t.Fatalf("state file has %d changes, %v; want the kill switch", stale, err)
+	}
+}
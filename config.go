@@ -0,0 +1,470 @@
+//go:build !client
+// +build !client
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Server defaults, used for anything the config file, environment and flags
+// leave unset
+const (
+	DEFAULT_LISTEN = ":1194"
+	DEFAULT_MTU    = 1420 // When the underlay MTU cannot be detected
+
+	// Tunnel address pool. The server takes the first host of each pool;
+	// IPv6 is off unless pool6 is set, to a prefix or to POOL6_ULA.
+	DEFAULT_POOL = "10.8.0.0/24"
+	POOL6_ULA    = "ula" // A /64 from a ULA prefix derived from the server key
+
+	DEFAULT_KEY_FILE   = "server.key"  // Static key, created on first start
+	DEFAULT_LEASE_FILE = "leases.json" // Client address leases
+	DEFAULT_PEERS_FILE = "peers.json"  // Registered client keys
+
+	// Data channel suites accepted by default
+	DEFAULT_CIPHERS = "chacha20-poly1305,aes-256-gcm"
+
+	// PBKDF2 parameters, MUST match the clients
+	DEFAULT_PBKDF2_ITERATIONS = 100000
+	DEFAULT_PBKDF2_SALT       = "cipherwall-salt-2025" // In production, use a proper random salt
+
+	// Used when no PSK is configured at all
+	DEFAULT_PSK = "this-is-strong-32byte-secret-key"
+
+	MIN_MTU = 576
+	MAX_MTU = 9000
+)
+
+// serverConfig is the server's configuration file (YAML). Every setting can
+// be overridden by an environment variable and a command line flag, in that
+// order of precedence.
+type serverConfig struct {
+	Listen []string `yaml:"listen"` // UDP listen addresses
+	Pool   string   `yaml:"pool"`   // IPv4 tunnel address pool
+	Pool6  string   `yaml:"pool6"`  // Optional IPv6 tunnel address pool, or "ula"
+	MTU    int      `yaml:"mtu"`    // TUN MTU, 0 derives it from the underlay MTU
+
+	// Pushed to clients during the handshake: prefixes to route through the
+	// tunnel in addition to their own, and the DNS settings to use
+	PushRoutes []netip.Prefix `yaml:"push_routes"`
+	DNS        []netip.Addr   `yaml:"dns"`        // DNS servers
+	DNSSearch  []string       `yaml:"dns_search"` // Search domains
+
+	// Idle clients are sent keepalives and expired once they stop answering;
+	// 0 disables either
+	Keepalive       time.Duration `yaml:"keepalive"`
+	DeadPeerTimeout time.Duration `yaml:"dead_peer_timeout"`
+
+	PSK        string `yaml:"psk"`         // Shared PSK, exactly 32 bytes
+	PrivateKey string `yaml:"private_key"` // Inline static key (base64), instead of key_file
+	KeyFile    string `yaml:"key_file"`
+	LeaseFile  string `yaml:"lease_file"`
+
+	// Registered clients: listed here, in the peers file, or both. Both
+	// files are watched, so removing a peer from either takes effect at once.
+	Peers     []peerConfig `yaml:"peers"`
+	PeersFile string       `yaml:"peers_file"`
+
+	NAT    natConfig    `yaml:"nat"`
+	Crypto cryptoConfig `yaml:"crypto"`
+	Log    logConfig    `yaml:"log"`
+
+	path string // File the config was loaded from, empty if none
+}
+
+type cryptoConfig struct {
+	Ciphers          []cipherSuite `yaml:"ciphers"`    // Accepted data channel suites
+	LegacyCFB        bool          `yaml:"legacy_cfb"` // Accept old AES-CFB + HMAC clients
+	PBKDF2Iterations int           `yaml:"pbkdf2_iterations"`
+	PBKDF2Salt       string        `yaml:"pbkdf2_salt"`
+}
+
+type logConfig struct {
+	Level string `yaml:"level"` // info or debug
+	File  string `yaml:"file"`  // Also write the log to this file
+}
+
+// configOption is a setting that can be overridden from the environment and
+// the command line. Options without a flag are secrets, which should not
+// show up in the process list.
+type configOption struct {
+	flag    string
+	env     string
+	usage   string
+	boolean bool
+	set     func(cfg *serverConfig, value string) error
+}
+
+var serverConfigOptions = []configOption{
+	{"listen", "VPN_LISTEN", "UDP listen addresses, comma-separated", false, func(cfg *serverConfig, v string) error {
+		cfg.Listen = splitList(v)
+		return nil
+	}},
+	{"pool", "VPN_POOL", "IPv4 tunnel address pool", false, func(cfg *serverConfig, v string) error {
+		cfg.Pool = v
+		return nil
+	}},
+	{"pool6", "VPN_POOL6", "IPv6 tunnel address pool, or ula for one derived from the server key (empty to disable IPv6)", false, func(cfg *serverConfig, v string) error {
+		cfg.Pool6 = v
+		return nil
+	}},
+	{"mtu", "VPN_MTU", "TUN interface MTU (0: the underlay MTU minus the tunnel overhead)", false, func(cfg *serverConfig, v string) (err error) {
+		cfg.MTU, err = strconv.Atoi(v)
+		return err
+	}},
+	{"push-routes", "VPN_PUSH_ROUTES", "Prefixes pushed to clients to route through the tunnel, comma-separated", false, func(cfg *serverConfig, v string) error {
+		cfg.PushRoutes = nil
+		for _, item := range splitList(v) {
+			prefix, err := netip.ParsePrefix(item)
+			if err != nil {
+				return err
+			}
+			cfg.PushRoutes = append(cfg.PushRoutes, prefix)
+		}
+		return nil
+	}},
+	{"dns", "VPN_DNS", "DNS servers pushed to clients, comma-separated", false, func(cfg *serverConfig, v string) error {
+		cfg.DNS = nil
+		for _, item := range splitList(v) {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return err
+			}
+			cfg.DNS = append(cfg.DNS, addr)
+		}
+		return nil
+	}},
+	{"dns-search", "VPN_DNS_SEARCH", "DNS search domains pushed to clients, comma-separated", false, func(cfg *serverConfig, v string) error {
+		cfg.DNSSearch = splitList(v)
+		return nil
+	}},
+	{"", "VPN_PSK", "", false, func(cfg *serverConfig, v string) error {
+		cfg.PSK = v
+		return nil
+	}},
+	{"", "VPN_PRIVATE_KEY", "", false, func(cfg *serverConfig, v string) error {
+		cfg.PrivateKey = v
+		return nil
+	}},
+	{"key-file", "VPN_KEY_FILE", "Static private key file (created if missing)", false, func(cfg *serverConfig, v string) error {
+		cfg.KeyFile = v
+		return nil
+	}},
+	{"lease-file", "VPN_LEASE_FILE", "Client address lease file", false, func(cfg *serverConfig, v string) error {
+		cfg.LeaseFile = v
+		return nil
+	}},
+	{"peers-file", "VPN_PEERS_FILE", "Registered client keys (JSON)", false, func(cfg *serverConfig, v string) error {
+		cfg.PeersFile = v
+		return nil
+	}},
+	{"nat", "VPN_NAT", "Enable forwarding and NAT for the pool", true, func(cfg *serverConfig, v string) (err error) {
+		cfg.NAT.Enabled, err = parseBool(v)
+		return err
+	}},
+	{"nat-egress", "VPN_NAT_EGRESS", "Interface client traffic leaves through (default: the default route's)", false, func(cfg *serverConfig, v string) error {
+		cfg.NAT.Egress = v
+		return nil
+	}},
+	{"nat-snat", "VPN_NAT_SNAT", "Source address for client traffic instead of masquerading", false, func(cfg *serverConfig, v string) error {
+		cfg.NAT.SNAT = v
+		return nil
+	}},
+	{"nat6", "VPN_NAT6", "IPv6 pool mode: nat66, or routed for a prefix routed to the server", false, func(cfg *serverConfig, v string) error {
+		cfg.NAT.IPv6 = v
+		return nil
+	}},
+	{"nat-mss-clamp", "VPN_NAT_MSS_CLAMP", "Clamp the TCP MSS of forwarded connections to the TUN MTU", true, func(cfg *serverConfig, v string) error {
+		clamp, err := parseBool(v)
+		cfg.NAT.MSSClamp = &clamp
+		return err
+	}},
+	{"nat-backend", "VPN_NAT_BACKEND", "NAT backend: auto, nftables or iptables", false, func(cfg *serverConfig, v string) error {
+		cfg.NAT.Backend = v
+		return nil
+	}},
+	{"ciphers", "VPN_CIPHERS", "Accepted data channel suites, comma-separated", false, func(cfg *serverConfig, v string) (err error) {
+		cfg.Crypto.Ciphers, err = parseCipherSuites(v)
+		return err
+	}},
+	{"legacy-cfb", "VPN_LEGACY_CFB", "Accept legacy AES-CFB + HMAC clients", true, func(cfg *serverConfig, v string) (err error) {
+		cfg.Crypto.LegacyCFB, err = parseBool(v)
+		return err
+	}},
+	{"pbkdf2-iterations", "VPN_PBKDF2_ITERATIONS", "PBKDF2 iterations (must match the clients)", false, func(cfg *serverConfig, v string) (err error) {
+		cfg.Crypto.PBKDF2Iterations, err = strconv.Atoi(v)
+		return err
+	}},
+	{"pbkdf2-salt", "VPN_PBKDF2_SALT", "PBKDF2 salt (must match the clients)", false, func(cfg *serverConfig, v string) error {
+		cfg.Crypto.PBKDF2Salt = v
+		return nil
+	}},
+	{"keepalive", "VPN_KEEPALIVE", "Send idle clients a keepalive after this long (0 to disable)", false, func(cfg *serverConfig, v string) (err error) {
+		cfg.Keepalive, err = time.ParseDuration(v)
+		return err
+	}},
+	{"dead-peer-timeout", "VPN_DEAD_PEER_TIMEOUT", "Expire clients silent for this long (0 to disable)", false, func(cfg *serverConfig, v string) (err error) {
+		cfg.DeadPeerTimeout, err = time.ParseDuration(v)
+		return err
+	}},
+	{"log-level", "VPN_LOG_LEVEL", "Log level: info or debug (per-packet logs)", false, func(cfg *serverConfig, v string) error {
+		cfg.Log.Level = v
+		return nil
+	}},
+	{"log-file", "VPN_LOG_FILE", "Also write the log to this file", false, func(cfg *serverConfig, v string) error {
+		cfg.Log.File = v
+		return nil
+	}},
+}
+
+func defaultServerConfig() *serverConfig {
+	suites, _ := parseCipherSuites(DEFAULT_CIPHERS)
+	return &serverConfig{
+		Listen:          []string{DEFAULT_LISTEN},
+		Pool:            DEFAULT_POOL,
+		KeyFile:         DEFAULT_KEY_FILE,
+		LeaseFile:       DEFAULT_LEASE_FILE,
+		PeersFile:       DEFAULT_PEERS_FILE,
+		Keepalive:       DEFAULT_KEEPALIVE,
+		DeadPeerTimeout: DEFAULT_DEAD_PEER_TIMEOUT,
+		NAT:             natConfig{Enabled: true, Backend: NAT_BACKEND_AUTO, IPv6: NAT6_MODE_NAT66},
+		Crypto: cryptoConfig{
+			Ciphers:          suites,
+			PBKDF2Iterations: DEFAULT_PBKDF2_ITERATIONS,
+			PBKDF2Salt:       DEFAULT_PBKDF2_SALT,
+		},
+		Log: logConfig{Level: LOG_LEVEL_INFO},
+	}
+}
+
+// parseServerFlags registers the server's flags, parses the command line and
+// builds the configuration: defaults, then the config file, then the
+// environment, then flags. It also reports whether -check-config was given.
+func parseServerFlags(args []string) (*serverConfig, bool, error) {
+	fs := flag.NewFlagSet("cipherwall-server", flag.ExitOnError)
+	configPath := fs.String("config", os.Getenv("VPN_CONFIG"), "Configuration file (YAML)")
+	checkOnly := fs.Bool("check-config", false, "Validate the configuration and exit")
+	for _, opt := range serverConfigOptions {
+		if opt.flag == "" {
+			continue
+		}
+		usage := fmt.Sprintf("%s (env %s)", opt.usage, opt.env)
+		if opt.boolean {
+			fs.Bool(opt.flag, false, usage)
+		} else {
+			fs.String(opt.flag, "", usage)
+		}
+	}
+	fs.Parse(args)
+
+	cfg := defaultServerConfig()
+	if *configPath != "" {
+		if err := cfg.loadFile(*configPath); err != nil {
+			return nil, *checkOnly, err
+		}
+	}
+
+	for _, opt := range serverConfigOptions {
+		if value := os.Getenv(opt.env); value != "" {
+			if err := opt.set(cfg, value); err != nil {
+				return nil, *checkOnly, fmt.Errorf("invalid %s: %w", opt.env, err)
+			}
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, opt := range serverConfigOptions {
+			if opt.flag == f.Name && flagErr == nil {
+				if err := opt.set(cfg, f.Value.String()); err != nil {
+					flagErr = fmt.Errorf("invalid -%s: %w", f.Name, err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, *checkOnly, flagErr
+	}
+
+	return cfg, *checkOnly, cfg.validate()
+}
+
+// loadFile merges a YAML config file into cfg. Unknown keys are rejected so
+// typos do not silently fall back to defaults.
+func (cfg *serverConfig) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	cfg.path = path
+	return nil
+}
+
+// validate checks the configuration without touching the system
+func (cfg *serverConfig) validate() error {
+	if len(cfg.Listen) == 0 {
+		return errors.New("no listen address configured")
+	}
+	for _, addr := range cfg.Listen {
+		if _, err := net.ResolveUDPAddr("udp", addr); err != nil {
+			return fmt.Errorf("invalid listen address %q: %w", addr, err)
+		}
+	}
+
+	if _, err := parsePoolPrefix(cfg.Pool, false); err != nil {
+		return err
+	}
+	if cfg.Pool6 != "" && cfg.Pool6 != POOL6_ULA {
+		if _, err := parsePoolPrefix(cfg.Pool6, true); err != nil {
+			return err
+		}
+	}
+
+	if cfg.MTU != 0 && (cfg.MTU < MIN_MTU || cfg.MTU > MAX_MTU) {
+		return fmt.Errorf("mtu %d out of range (%d-%d)", cfg.MTU, MIN_MTU, MAX_MTU)
+	}
+	if cfg.Pool6 != "" && cfg.MTU != 0 && cfg.MTU < IPV6_MIN_MTU {
+		return fmt.Errorf("mtu %d is below the IPv6 minimum of %d", cfg.MTU, IPV6_MIN_MTU)
+	}
+
+	for _, route := range cfg.PushRoutes {
+		if route != route.Masked() {
+			return fmt.Errorf("push route %s has host bits set (use %s)", route, route.Masked())
+		}
+	}
+
+	for _, domain := range cfg.DNSSearch {
+		if err := validateSearchDomain(domain); err != nil {
+			return err
+		}
+	}
+
+	if cfg.PSK != "" && len(cfg.PSK) != 32 {
+		return fmt.Errorf("PSK must be exactly 32 bytes, got %d bytes", len(cfg.PSK))
+	}
+	if cfg.PrivateKey != "" {
+		if _, err := parsePrivateKey(cfg.PrivateKey); err != nil {
+			return fmt.Errorf("invalid private key: %w", err)
+		}
+	} else if cfg.KeyFile == "" {
+		return errors.New("either private_key or key_file is required")
+	}
+
+	if err := validateKeepalive(cfg.Keepalive, cfg.DeadPeerTimeout); err != nil {
+		return err
+	}
+
+	if err := cfg.NAT.validate(); err != nil {
+		return err
+	}
+
+	if len(cfg.Crypto.Ciphers) == 0 {
+		return errors.New("no cipher suites configured")
+	}
+	if cfg.Crypto.PBKDF2Iterations < 1 {
+		return fmt.Errorf("pbkdf2_iterations must be positive, got %d", cfg.Crypto.PBKDF2Iterations)
+	}
+	if cfg.Crypto.PBKDF2Salt == "" {
+		return errors.New("pbkdf2_salt must not be empty")
+	}
+
+	if err := validateLogLevel(cfg.Log.Level); err != nil {
+		return err
+	}
+
+	// Parse the peers with a placeholder PSK; only their structure matters
+	peers, err := readPeerConfigs(cfg.path, cfg.PeersFile)
+	if err != nil {
+		return err
+	}
+	if _, err := buildPeerList(peers, [NOISE_KEY_LEN]byte{}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// warnings lists settings that are valid but have no effect
+func (cfg *serverConfig) warnings() []string {
+	var warnings []string
+	if cfg.NAT.MSSClamp != nil && *cfg.NAT.MSSClamp && !cfg.NAT.Enabled {
+		// The clamp rules live in the NAT rule set
+		warnings = append(warnings, "nat.mss_clamp has no effect while nat.enabled is off; clamp the MSS where the pool is forwarded")
+	}
+	return warnings
+}
+
+// checkConfig runs the -check-config checks that read files: the static
+// key must parse if it already exists. Nothing is created.
+func checkConfig(cfg *serverConfig) error {
+	var key noisePrivateKey
+	haveKey := false
+	if cfg.PrivateKey != "" {
+		key, _ = parsePrivateKey(cfg.PrivateKey)
+		haveKey = true
+	} else {
+		data, err := os.ReadFile(cfg.KeyFile)
+		if err == nil {
+			if key, err = parsePrivateKey(string(data)); err != nil {
+				return fmt.Errorf("invalid key file %s: %w", cfg.KeyFile, err)
+			}
+			haveKey = true
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("failed to read key file %s: %w", cfg.KeyFile, err)
+		}
+	}
+
+	// A ULA pool depends on the key, which may not exist yet
+	pool6 := cfg.Pool6
+	if pool6 == POOL6_ULA {
+		pool6 = ""
+		if haveKey {
+			pool6 = ulaPrefix(key.publicKey()).String()
+		}
+	}
+	if _, err := newIPPool(cfg.Pool, pool6, cfg.LeaseFile); err != nil {
+		return err
+	}
+	return nil
+}
+
+// splitList splits a comma-separated value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseBool accepts the usual boolean spellings, including yes and no
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "1", "true", "yes", "on":
+		return true, nil
+	case "0", "false", "no", "off":
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid boolean %q", value)
+	}
+}
@@ -0,0 +1,130 @@
+//go:build !client
+// +build !client
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a server config file whose peers file lives next to it
+func writeConfig(t *testing.T, yaml string) string {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cipherwall.yaml")
+	yaml = "peers_file: " + filepath.Join(dir, "peers.json") + "\n" + yaml
+	if err := os.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Defaults, then the config file, then the environment, then flags
+func TestServerConfigPrecedence(t *testing.T) {
+	path := writeConfig(t, "pool: 10.1.0.0/24\nmtu: 1300\nkeepalive: 10s\nnat:\n  enabled: true\n")
+	t.Setenv("VPN_MTU", "1350")
+	t.Setenv("VPN_KEEPALIVE", "20s")
+	t.Setenv("VPN_PSK", strings.Repeat("s", 32))
+
+	cfg, checkOnly, err := parseServerFlags([]string{"-config", path, "-keepalive", "30s", "-nat=false", "-check-config"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checkOnly {
+		t.Error("-check-config not reported")
+	}
+
+	tests := []struct {
+		setting   string
+		got, want any
+	}{
+		{"listen (default)", cfg.Listen[0], DEFAULT_LISTEN},
+		{"lease_file (default)", cfg.LeaseFile, DEFAULT_LEASE_FILE},
+		{"pool (file)", cfg.Pool, "10.1.0.0/24"},
+		{"mtu (env over file)", cfg.MTU, 1350},
+		{"psk (env only)", cfg.PSK, strings.Repeat("s", 32)},
+		{"keepalive (flag over env)", cfg.Keepalive, 30 * time.Second},
+		{"nat.enabled (flag over file)", cfg.NAT.Enabled, false},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.setting, tt.got, tt.want)
+		}
+	}
+}
+
+func TestServerConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		env  string // VPN_ variable set to "bogus"
+		err  string
+	}{
+		{"unknown key", "pol: 10.1.0.0/24\n", "", "field pol not found"},
+		{"unknown nested key", "nat:\n  enable: true\n", "", "field enable not found"},
+		{"bad env value", "", "VPN_MTU", "invalid VPN_MTU"},
+		{"bad env boolean", "", "VPN_NAT", "invalid VPN_NAT"},
+		{"bad pool", "pool: 10.1.0.0/31\n", "", "10.1.0.0/31"},
+		{"mtu out of range", "mtu: 100\n", "", "mtu 100 out of range"},
+		{"mtu below IPv6 minimum", "pool6: fd00::/64\nmtu: 1200\n", "", "IPv6 minimum"},
+		{"push route with host bits", "push_routes: [10.2.0.1/16]\n", "", "host bits"},
+		{"short psk", "psk: short\n", "", "PSK must be exactly 32 bytes"},
+		{"no key", "key_file: \"\"\n", "", "either private_key or key_file"},
+		{"bad nat backend", "nat:\n  backend: pf\n", "", "pf"},
+		{"no salt", "crypto:\n  pbkdf2_salt: \"\"\n", "", "pbkdf2_salt"},
+		{"bad log level", "log:\n  level: trace\n", "", "trace"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv(tt.env, "bogus")
+			}
+			_, _, err := parseServerFlags([]string{"-config", writeConfig(t, tt.yaml)})
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error %v, want one containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// The mss_clamp warning only fires when the clamp is asked for explicitly
+func TestServerConfigWarnings(t *testing.T) {
+	tests := []struct {
+		yaml     string
+		warnings int
+	}{
+		{"nat:\n  enabled: false\n", 0},
+		{"nat:\n  enabled: false\n  mss_clamp: false\n", 0},
+		{"nat:\n  enabled: false\n  mss_clamp: true\n", 1},
+		{"nat:\n  enabled: true\n  mss_clamp: true\n", 0},
+	}
+	for _, tt := range tests {
+		cfg, _, err := parseServerFlags([]string{"-config", writeConfig(t, tt.yaml)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cfg.warnings(); len(got) != tt.warnings {
+			t.Errorf("%q: warnings %q, want %d", tt.yaml, got, tt.warnings)
+		}
+	}
+}
+
+func TestParseBool(t *testing.T) {
+	for _, v := range []string{"1", "true", "YES", " on "} {
+		if b, err := parseBool(v); err != nil || !b {
+			t.Errorf("%q: %v, %v", v, b, err)
+		}
+	}
+	for _, v := range []string{"0", "False", "no", "off"} {
+		if b, err := parseBool(v); err != nil || b {
+			t.Errorf("%q: %v, %v", v, b, err)
+		}
+	}
+	if _, err := parseBool("maybe"); err == nil {
+		t.Error("maybe accepted")
+	}
+}
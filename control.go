@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Control messages travel inside data frames, encrypted, authenticated and
+// replay-checked like tunnel traffic. Their first byte has 0 in the IP
+// version nibble, so they are never mistaken for IP packets.
+//
+// Path MTU probes and their acks: [type:1][id:4][padding]. A probe is
+// answered by an ack of the same size, so the ack only arrives if frames of
+// that size make it through in both directions: both sides set the don't
+// fragment bit. The client reports the path MTU it found as
+// [type:1][mtu:2], and the server splits frames that would not fit it into
+// fragments.
+//
+// Keepalives: [type:1]. Either side sends one when it has heard nothing from
+// its peer for the keepalive interval, and the peer answers with an ack. A
+// peer that stays silent for the dead peer timeout is gone: the server
+// expires its session, the client reconnects.
+const (
+	CONTROL_PMTU_PROBE    = 0x01
+	CONTROL_PMTU_ACK      = 0x02
+	CONTROL_KEEPALIVE     = 0x03
+	CONTROL_KEEPALIVE_ACK = 0x04
+	CONTROL_PMTU_REPORT   = 0x05
+
+	PMTU_MESSAGE_LEN = 5 // Without padding
+	PMTU_REPORT_LEN  = 3
+
+	DEFAULT_KEEPALIVE         = 25 * time.Second
+	DEFAULT_DEAD_PEER_TIMEOUT = 120 * time.Second
+	KEEPALIVE_CHECK_INTERVAL  = time.Second // How often idle peers are looked for
+)
+
+// isControl reports whether a decrypted frame carries a control message
+// rather than an IP packet
+func isControl(plaintext []byte) bool {
+	return len(plaintext) > 0 && plaintext[0]>>4 == 0
+}
+
+// pmtuMessage builds a probe or ack padded to size bytes
+func pmtuMessage(kind byte, id uint32, size int) []byte {
+	msg := make([]byte, max(size, PMTU_MESSAGE_LEN))
+	msg[0] = kind
+	binary.BigEndian.PutUint32(msg[1:5], id)
+	return msg
+}
+
+// parsePMTUMessage returns the id of a probe or ack
+func parsePMTUMessage(msg []byte) (uint32, error) {
+	if len(msg) < PMTU_MESSAGE_LEN {
+		return 0, fmt.Errorf("path MTU message too short: %d bytes", len(msg))
+	}
+	return binary.BigEndian.Uint32(msg[1:5]), nil
+}
+
+// pmtuAck answers a probe with an ack of the same size
+func pmtuAck(probe []byte) ([]byte, error) {
+	id, err := parsePMTUMessage(probe)
+	if err != nil {
+		return nil, err
+	}
+	return pmtuMessage(CONTROL_PMTU_ACK, id, len(probe)), nil
+}
+
+// pmtuReport builds the report of a path MTU
+func pmtuReport(mtu int) []byte {
+	msg := make([]byte, PMTU_REPORT_LEN)
+	msg[0] = CONTROL_PMTU_REPORT
+	binary.BigEndian.PutUint16(msg[1:3], uint16(mtu))
+	return msg
+}
+
+// parsePMTUReport returns the path MTU of a report
+func parsePMTUReport(msg []byte) (int, error) {
+	if len(msg) < PMTU_REPORT_LEN {
+		return 0, fmt.Errorf("path MTU report too short: %d bytes", len(msg))
+	}
+	mtu := int(binary.BigEndian.Uint16(msg[1:3]))
+	if mtu < MIN_MTU || mtu > MAX_MTU {
+		return 0, fmt.Errorf("path MTU %d out of range (%d-%d)", mtu, MIN_MTU, MAX_MTU)
+	}
+	return mtu, nil
+}
+
+// validateKeepalive checks a keepalive interval and dead peer timeout; zero
+// disables either
+func validateKeepalive(keepalive, deadPeerTimeout time.Duration) error {
+	if keepalive != 0 && keepalive < time.Second {
+		return fmt.Errorf("keepalive %s is too short (use a unit, e.g. 25s)", keepalive)
+	}
+	if deadPeerTimeout != 0 && deadPeerTimeout < time.Second {
+		return fmt.Errorf("dead_peer_timeout %s is too short (use a unit, e.g. 120s)", deadPeerTimeout)
+	}
+	if keepalive != 0 && deadPeerTimeout != 0 && deadPeerTimeout <= keepalive {
+		return fmt.Errorf("dead_peer_timeout %s must be longer than keepalive %s", deadPeerTimeout, keepalive)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPMTUMessages(t *testing.T) {
+	probe := pmtuMessage(CONTROL_PMTU_PROBE, 0xdeadbeef, 1400)
+	if len(probe) != 1400 || !isControl(probe) {
+		t.Fatalf("probe of %d bytes, control %v", len(probe), isControl(probe))
+	}
+	ack, err := pmtuAck(probe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ack) != len(probe) || ack[0] != CONTROL_PMTU_ACK {
+		t.Fatalf("ack of %d bytes, type %d", len(ack), ack[0])
+	}
+	if id, err := parsePMTUMessage(ack); err != nil || id != 0xdeadbeef {
+		t.Fatalf("ack for %#x, %v", id, err)
+	}
+	if small := pmtuMessage(CONTROL_PMTU_PROBE, 1, 0); len(small) != PMTU_MESSAGE_LEN {
+		t.Errorf("unpadded probe of %d bytes", len(small))
+	}
+	if _, err := pmtuAck(probe[:PMTU_MESSAGE_LEN-1]); err == nil {
+		t.Error("truncated probe acked")
+	}
+
+	for _, mtu := range []int{MIN_MTU, 1412, MAX_MTU} {
+		if got, err := parsePMTUReport(pmtuReport(mtu)); err != nil || got != mtu {
+			t.Errorf("report of %d parsed as %d, %v", mtu, got, err)
+		}
+	}
+	for _, report := range [][]byte{pmtuReport(MIN_MTU - 1), pmtuReport(MAX_MTU + 1), {CONTROL_PMTU_REPORT, 5}} {
+		if mtu, err := parsePMTUReport(report); err == nil {
+			t.Errorf("report %x accepted as %d", report, mtu)
+		}
+	}
+}
+
+func TestIsControl(t *testing.T) {
+	for _, msg := range [][]byte{{CONTROL_PMTU_PROBE}, {CONTROL_KEEPALIVE}, {CONTROL_KEEPALIVE_ACK}, pmtuReport(1400)} {
+		if !isControl(msg) {
+			t.Errorf("%x not a control message", msg)
+		}
+	}
+	for _, packet := range [][]byte{nil, {0x45}, {0x60}} {
+		if isControl(packet) {
+			t.Errorf("%x taken for a control message", packet)
+		}
+	}
+}
+
+func TestValidateKeepalive(t *testing.T) {
+	tests := []struct {
+		keepalive, timeout time.Duration
+		ok                 bool
+	}{
+		{DEFAULT_KEEPALIVE, DEFAULT_DEAD_PEER_TIMEOUT, true},
+		{0, 0, true},
+		{0, time.Minute, true},
+		{25 * time.Second, 0, true},
+		{25, 0, false}, // Nanoseconds, a missing unit
+		{0, 120, false},
+		{time.Minute, time.Minute, false},
+		{time.Minute, 30 * time.Second, false},
+	}
+	for _, tt := range tests {
+		if err := validateKeepalive(tt.keepalive, tt.timeout); (err == nil) != tt.ok {
+			t.Errorf("validateKeepalive(%s, %s) = %v, want ok %v", tt.keepalive, tt.timeout, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Files the client rewrites when systemd-resolved is not in use
+const (
+	RESOLV_CONF        = "/etc/resolv.conf"
+	RESOLV_CONF_BACKUP = "/etc/resolv.conf.cipherwall" // The original while connected
+)
+
+// validateSearchDomain checks a DNS search domain pushed by the server or
+// set in a profile. It ends up in resolv.conf, so anything but a plain
+// domain name is rejected.
+func validateSearchDomain(domain string) error {
+	name := strings.TrimSuffix(domain, ".")
+	if name == "" || len(name) > 253 {
+		return fmt.Errorf("invalid dns search domain %q", domain)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return fmt.Errorf("invalid dns search domain %q", domain)
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return fmt.Errorf("invalid dns search domain %q", domain)
+			}
+		}
+	}
+	return nil
+}
+
+// resolvConf renders a resolv.conf that uses only the tunnel's DNS servers
+func resolvConf(servers []netip.Addr, search []string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Written by cipherwall while connected; the original is in %s\n", RESOLV_CONF_BACKUP)
+	for _, server := range servers {
+		fmt.Fprintf(&b, "nameserver %s\n", server)
+	}
+	if len(search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(search, " "))
+	}
+	return []byte(b.String())
+}
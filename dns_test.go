@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestValidateSearchDomain(t *testing.T) {
+	tests := []struct {
+		domain string
+		ok     bool
+	}{
+		{"corp.example", true},
+		{"corp.example.", true},
+		{"Lab-1.corp_internal.example", true},
+		{"localdomain", true},
+		{"", false},
+		{".", false},
+		{"corp..example", false},
+		{"-corp.example", false},
+		{"corp-.example", false},
+		{"corp.example\nnameserver 1.2.3.4", false}, // Would inject a resolv.conf line
+		{"corp example", false},
+		{"~.", false},
+		{string(make([]byte, 64)) + ".example", false},
+	}
+	for _, tt := range tests {
+		if err := validateSearchDomain(tt.domain); (err == nil) != tt.ok {
+			t.Errorf("validateSearchDomain(%q) = %v, want ok %v", tt.domain, err, tt.ok)
+		}
+	}
+}
+
+func TestResolvConf(t *testing.T) {
+	got := string(resolvConf([]netip.Addr{netip.MustParseAddr("10.8.0.1"), netip.MustParseAddr("fd00:8::1")}, []string{"corp.example", "lab.example"}))
+	want := "# Written by cipherwall while connected; the original is in " + RESOLV_CONF_BACKUP + "\n" +
+		"nameserver 10.8.0.1\n" +
+		"nameserver fd00:8::1\n" +
+		"search corp.example lab.example\n"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	got = string(resolvConf([]netip.Addr{netip.MustParseAddr("10.8.0.1")}, nil))
+	want = "# Written by cipherwall while connected; the original is in " + RESOLV_CONF_BACKUP + "\n" +
+		"nameserver 10.8.0.1\n"
+	if got != want {
+		t.Errorf("without search domains got:\n%s", got)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Fragments of a data frame too big for the path, for networks that drop IP
+// fragments. A peer asks for them in its handshake; frames bigger than the
+// size it asked for are split:
+//
+//	[TYPE=5][RESERVED (1)][INDEX (1)][COUNT (1)][FRAME_ID (4)][PAYLOAD]
+//
+// Fragments carry pieces of a complete encrypted frame, which is only
+// authenticated once it has been reassembled. A forged fragment costs
+// nothing but buffer space, and that is bounded.
+const (
+	MSG_TYPE_FRAGMENT = 5
+
+	FRAGMENT_HEADER_LEN = 8
+	MIN_FRAGMENT_SIZE   = 512 // Smallest datagram a peer may ask for
+	MAX_FRAGMENTS       = 32  // Per frame
+
+	// Incomplete frames are dropped after FRAGMENT_TIMEOUT, or earlier when
+	// the buffer is full, oldest first
+	FRAGMENT_TIMEOUT       = 2 * time.Second
+	FRAGMENT_BUFFER_BYTES  = 4 << 20
+	FRAGMENT_BUFFER_FRAMES = 1024
+)
+
+// Ids that tell the frames of one sender apart
+var nextFragmentID atomic.Uint32
+
+// fragmentFrame splits a frame into datagrams of at most size bytes. A frame
+// that fits, or any frame if size is 0, is returned whole.
+func fragmentFrame(frame []byte, size int) ([][]byte, error) {
+	if size == 0 || len(frame) <= size {
+		return [][]byte{frame}, nil
+	}
+	payload := size - FRAGMENT_HEADER_LEN
+	count := (len(frame) + payload - 1) / payload
+	if count > MAX_FRAGMENTS {
+		return nil, fmt.Errorf("frame of %d bytes needs %d fragments (max %d)", len(frame), count, MAX_FRAGMENTS)
+	}
+
+	id := nextFragmentID.Add(1)
+	fragments := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		piece := frame[i*payload : min((i+1)*payload, len(frame))]
+		fragment := make([]byte, FRAGMENT_HEADER_LEN+len(piece))
+		fragment[0] = MSG_TYPE_FRAGMENT
+		fragment[2] = uint8(i)
+		fragment[3] = uint8(count)
+		binary.BigEndian.PutUint32(fragment[4:8], id)
+		copy(fragment[FRAGMENT_HEADER_LEN:], piece)
+		fragments = append(fragments, fragment)
+	}
+	return fragments, nil
+}
+
+// fragmentKey identifies a frame being reassembled: its sender and id
+type fragmentKey struct {
+	source string
+	id     uint32
+}
+
+// partialFrame collects the fragments of one frame
+type partialFrame struct {
+	pieces   [][]byte
+	received int
+	size     int
+	started  time.Time
+}
+
+// reassembler buffers fragments until their frame is complete. It is shared
+// by the packet handlers and safe for concurrent use.
+type reassembler struct {
+	mu        sync.Mutex
+	pending   map[fragmentKey]*partialFrame
+	size      int // Bytes buffered in pending
+	lastSweep time.Time
+}
+
+func newReassembler() *reassembler {
+	return &reassembler{pending: make(map[fragmentKey]*partialFrame)}
+}
+
+// add buffers one fragment from source and returns the reassembled frame
+// once all of its fragments arrived, or nil until then
+func (r *reassembler) add(source string, fragment []byte) ([]byte, error) {
+	if len(fragment) <= FRAGMENT_HEADER_LEN {
+		return nil, fmt.Errorf("fragment too short: %d bytes", len(fragment))
+	}
+	index, count := int(fragment[2]), int(fragment[3])
+	if fragment[0] != MSG_TYPE_FRAGMENT || fragment[1] != 0 || count < 2 || count > MAX_FRAGMENTS || index >= count {
+		return nil, fmt.Errorf("invalid fragment header")
+	}
+	key := fragmentKey{source: source, id: binary.BigEndian.Uint32(fragment[4:8])}
+	piece := fragment[FRAGMENT_HEADER_LEN:]
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.lastSweep) >= FRAGMENT_TIMEOUT/2 {
+		r.sweep(now)
+	}
+
+	frame := r.pending[key]
+	if frame == nil {
+		frame = &partialFrame{pieces: make([][]byte, count), started: now}
+		r.pending[key] = frame
+	}
+	if len(frame.pieces) != count {
+		r.drop(key)
+		return nil, fmt.Errorf("fragment count of frame %d changed", key.id)
+	}
+	if frame.pieces[index] != nil {
+		return nil, nil // Duplicate
+	}
+
+	for r.size+len(piece) > FRAGMENT_BUFFER_BYTES || len(r.pending) > FRAGMENT_BUFFER_FRAMES {
+		if !r.dropOldest(key) {
+			break
+		}
+	}
+	frame.pieces[index] = append([]byte(nil), piece...)
+	frame.received++
+	frame.size += len(piece)
+	r.size += len(piece)
+	if frame.received < count {
+		return nil, nil
+	}
+
+	r.drop(key)
+	whole := make([]byte, 0, frame.size)
+	for _, p := range frame.pieces {
+		whole = append(whole, p...)
+	}
+	return whole, nil
+}
+
+// sweep drops the frames that did not complete in time. The caller must hold
+// r.mu.
+func (r *reassembler) sweep(now time.Time) {
+	r.lastSweep = now
+	for key, frame := range r.pending {
+		if now.Sub(frame.started) >= FRAGMENT_TIMEOUT {
+			debugf("🧩 Dropping incomplete frame %d from %s (%d of %d fragments)", key.id, key.source, frame.received, len(frame.pieces))
+			r.drop(key)
+		}
+	}
+}
+
+// dropOldest makes room by dropping the oldest frame other than keep. It
+// reports whether there was one. The caller must hold r.mu.
+func (r *reassembler) dropOldest(keep fragmentKey) bool {
+	var oldest fragmentKey
+	var started time.Time
+	for key, frame := range r.pending {
+		if key != keep && (started.IsZero() || frame.started.Before(started)) {
+			oldest, started = key, frame.started
+		}
+	}
+	if started.IsZero() {
+		return false
+	}
+	r.drop(oldest)
+	return true
+}
+
+// drop forgets a frame. The caller must hold r.mu.
+func (r *reassembler) drop(key fragmentKey) {
+	if frame := r.pending[key]; frame != nil {
+		r.size -= frame.size
+		delete(r.pending, key)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// testFrame returns a frame of n bytes with recognizable content
+func testFrame(n int) []byte {
+	frame := make([]byte, n)
+	for i := range frame {
+		frame[i] = byte(i * 7)
+	}
+	return frame
+}
+
+// testFragment builds one fragment by hand
+func testFragment(id uint32, index, count int, piece []byte) []byte {
+	fragment := make([]byte, FRAGMENT_HEADER_LEN, FRAGMENT_HEADER_LEN+len(piece))
+	fragment[0] = MSG_TYPE_FRAGMENT
+	fragment[2] = uint8(index)
+	fragment[3] = uint8(count)
+	binary.BigEndian.PutUint32(fragment[4:8], id)
+	return append(fragment, piece...)
+}
+
+func TestFragmentFrame(t *testing.T) {
+	frame := testFrame(3000)
+	if pieces, err := fragmentFrame(frame, 0); err != nil || len(pieces) != 1 {
+		t.Fatalf("size 0: %d pieces, %v", len(pieces), err)
+	}
+	if pieces, err := fragmentFrame(frame, len(frame)); err != nil || len(pieces) != 1 {
+		t.Fatalf("frame that fits: %d pieces, %v", len(pieces), err)
+	}
+	pieces, err := fragmentFrame(frame, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pieces) != 4 {
+		t.Fatalf("got %d pieces, want 4", len(pieces))
+	}
+	for i, piece := range pieces {
+		if len(piece) > 1000 {
+			t.Fatalf("piece %d is %d bytes", i, len(piece))
+		}
+	}
+	if _, err := fragmentFrame(testFrame(MAX_FRAGMENTS*600), MIN_FRAGMENT_SIZE); err == nil {
+		t.Fatal("frame needing too many fragments was split")
+	}
+}
+
+func TestReassemble(t *testing.T) {
+	frame := testFrame(3000)
+	pieces, err := fragmentFrame(frame, 700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := len(pieces)
+
+	tests := []struct {
+		name  string
+		order []int // Indexes of the pieces to add; the last one completes the frame
+	}{
+		{"in order", []int{0, 1, 2, 3, 4}},
+		{"reversed", []int{4, 3, 2, 1, 0}},
+		{"shuffled", []int{2, 0, 4, 1, 3}},
+		{"duplicates", []int{1, 1, 0, 3, 0, 2, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if n != 5 {
+				t.Fatalf("test expects 5 pieces, got %d", n)
+			}
+			r := newReassembler()
+			seen := map[int]bool{}
+			for i, index := range tt.order {
+				whole, err := r.add("peer", pieces[index])
+				if err != nil {
+					t.Fatalf("add piece %d: %v", index, err)
+				}
+				seen[index] = true
+				if i < len(tt.order)-1 {
+					if whole != nil {
+						t.Fatalf("frame complete after %d of %d pieces", len(seen), n)
+					}
+					continue
+				}
+				if !bytes.Equal(whole, frame) {
+					t.Fatalf("reassembled %d bytes, want the original %d", len(whole), len(frame))
+				}
+			}
+			if len(r.pending) != 0 || r.size != 0 {
+				t.Fatalf("%d frames and %d bytes left buffered", len(r.pending), r.size)
+			}
+		})
+	}
+}
+
+func TestReassembleRejects(t *testing.T) {
+	piece := []byte("piece")
+	tests := []struct {
+		name     string
+		fragment []byte
+	}{
+		{"too short", testFragment(1, 0, 2, nil)},
+		{"wrong type", func() []byte { f := testFragment(1, 0, 2, piece); f[0] = 4; return f }()},
+		{"reserved byte set", func() []byte { f := testFragment(1, 0, 2, piece); f[1] = 1; return f }()},
+		{"single fragment", testFragment(1, 0, 1, piece)},
+		{"too many fragments", testFragment(1, 0, MAX_FRAGMENTS+1, piece)},
+		{"index past count", testFragment(1, 2, 2, piece)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newReassembler()
+			if _, err := r.add("peer", tt.fragment); err == nil {
+				t.Fatal("invalid fragment accepted")
+			}
+			if len(r.pending) != 0 {
+				t.Fatal("invalid fragment buffered")
+			}
+		})
+	}
+}
+
+func TestReassembleChangedCount(t *testing.T) {
+	r := newReassembler()
+	if _, err := r.add("peer", testFragment(7, 0, 3, []byte("a"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.add("peer", testFragment(7, 1, 2, []byte("b"))); err == nil {
+		t.Fatal("fragment with a different count accepted")
+	}
+	if len(r.pending) != 0 || r.size != 0 {
+		t.Fatal("frame with a changed count kept")
+	}
+}
+
+func TestReassembleSources(t *testing.T) {
+	r := newReassembler()
+	// The same id from two senders are two frames
+	if whole, _ := r.add("a", testFragment(7, 0, 2, []byte("a0"))); whole != nil {
+		t.Fatal("complete too early")
+	}
+	if whole, _ := r.add("b", testFragment(7, 1, 2, []byte("b1"))); whole != nil {
+		t.Fatal("pieces of different senders combined")
+	}
+	whole, err := r.add("a", testFragment(7, 1, 2, []byte("a1")))
+	if err != nil || string(whole) != "a0a1" {
+		t.Fatalf("got %q, %v", whole, err)
+	}
+}
+
+func TestReassembleTimeout(t *testing.T) {
+	r := newReassembler()
+	if _, err := r.add("peer", testFragment(1, 0, 2, []byte("old"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.add("peer", testFragment(2, 0, 2, []byte("new"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// Age the first frame past the timeout and let the next add sweep
+	r.pending[fragmentKey{source: "peer", id: 1}].started = time.Now().Add(-FRAGMENT_TIMEOUT)
+	r.lastSweep = time.Time{}
+	whole, err := r.add("peer", testFragment(1, 1, 2, []byte("late")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if whole != nil {
+		t.Fatal("frame completed from a piece that timed out")
+	}
+	if _, ok := r.pending[fragmentKey{source: "peer", id: 2}]; !ok {
+		t.Fatal("sweep dropped a frame that had not timed out")
+	}
+	if r.size != len("new")+len("late") {
+		t.Fatalf("buffer size %d after the sweep", r.size)
+	}
+}
+
+func TestReassembleBufferBytes(t *testing.T) {
+	r := newReassembler()
+	piece := make([]byte, MAX_DATAGRAM_SIZE-FRAGMENT_HEADER_LEN)
+	frames := FRAGMENT_BUFFER_BYTES/len(piece) + 10
+	for id := 0; id < frames; id++ {
+		if _, err := r.add("peer", testFragment(uint32(id), 0, 2, piece)); err != nil {
+			t.Fatal(err)
+		}
+		if r.size > FRAGMENT_BUFFER_BYTES {
+			t.Fatalf("frame %d: %d bytes buffered, limit %d", id, r.size, FRAGMENT_BUFFER_BYTES)
+		}
+		// Keep the order of arrival apart even on coarse clocks
+		r.pending[fragmentKey{source: "peer", id: uint32(id)}].started = time.Now().Add(time.Duration(id) * time.Microsecond)
+	}
+
+	// The oldest frames made room for the newest
+	if _, ok := r.pending[fragmentKey{source: "peer", id: 0}]; ok {
+		t.Fatal("oldest frame kept")
+	}
+	if _, ok := r.pending[fragmentKey{source: "peer", id: uint32(frames - 1)}]; !ok {
+		t.Fatal("newest frame dropped")
+	}
+}
+
+func TestReassembleBufferFrames(t *testing.T) {
+	r := newReassembler()
+	for id := 0; id < FRAGMENT_BUFFER_FRAMES+100; id++ {
+		if _, err := r.add("peer", testFragment(uint32(id), 0, 2, []byte("x"))); err != nil {
+			t.Fatal(err)
+		}
+		if len(r.pending) > FRAGMENT_BUFFER_FRAMES {
+			t.Fatalf("%d frames buffered, limit %d", len(r.pending), FRAGMENT_BUFFER_FRAMES)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+)
+
+// Handshake messages (Noise IKpsk2, laid out like WireGuard's):
+//
+//	Initiation: [TYPE=1][RESERVED (3)][SENDER_INDEX (4)][EPHEMERAL (32)][STATIC (32+16)][PAYLOAD (n+16)]
+//	Response:   [TYPE=2][RESERVED (3)][SENDER_INDEX (4)][RECEIVER_INDEX (4)][EPHEMERAL (32)][PAYLOAD (n+16)]
+//
+// The client (initiator) must know the server's static public key, and the
+// PSK is mixed in last, so completing a handshake proves knowledge of both.
+// Every handshake uses fresh ephemeral keys, which gives each session its own
+// transport keys and forward secrecy if the PSK or static keys leak later.
+const (
+	MSG_TYPE_HANDSHAKE_INIT     = 1
+	MSG_TYPE_HANDSHAKE_RESPONSE = 2
+
+	HANDSHAKE_INIT_MIN_LEN     = 8 + NOISE_KEY_LEN + NOISE_KEY_LEN + AEAD_TAG_LEN + AEAD_TAG_LEN
+	HANDSHAKE_RESPONSE_MIN_LEN = 12 + NOISE_KEY_LEN + AEAD_TAG_LEN
+
+	HANDSHAKE_TIMEOUT  = 5 * time.Second
+	HANDSHAKE_ATTEMPTS = 5
+)
+
+var errHandshakeAuth = errors.New("handshake authentication failed")
+
+// handshakeInit is the encrypted payload of an initiation message
+type handshakeInit struct {
+	Timestamp int64         `json:"timestamp"`          // Unix nanoseconds, rejects replayed initiations
+	Suites    []cipherSuite `json:"suites"`             // Data channel suites in order of preference
+	Fragment  int           `json:"fragment,omitempty"` // Largest datagram to send the initiator, bigger frames are fragmented
+}
+
+// handshakeResponse is the encrypted payload of a response message
+type handshakeResponse struct {
+	Suite     cipherSuite    `json:"suite"`               // Suite chosen by the server
+	Addresses []netip.Prefix `json:"addresses,omitempty"` // Tunnel addresses leased to the client
+	Routes    []netip.Prefix `json:"routes,omitempty"`    // Prefixes the client should route through the tunnel
+	DNS       []netip.Addr   `json:"dns,omitempty"`       // DNS servers to use while connected
+	Search    []string       `json:"search,omitempty"`    // DNS search domains
+}
+
+// handshakeState holds the Noise symmetric state and keys for one handshake
+type handshakeState struct {
+	chainKey [blake2s.Size]byte
+	hash     [blake2s.Size]byte
+
+	localStatic     noisePrivateKey
+	localEphemeral  noisePrivateKey
+	remoteStatic    noisePublicKey
+	remoteEphemeral noisePublicKey
+
+	localIndex  uint32
+	remoteIndex uint32
+}
+
+func newHandshakeState(responderStatic noisePublicKey) *handshakeState {
+	hs := &handshakeState{}
+	hs.chainKey = blake2s.Sum256([]byte(NOISE_CONSTRUCTION))
+	hs.hash = hs.chainKey
+	mixHash(&hs.hash, []byte(NOISE_IDENTIFIER))
+	mixHash(&hs.hash, responderStatic[:])
+	return hs
+}
+
+func (hs *handshakeState) mixKey(input []byte) {
+	hs.chainKey = noiseKDF(hs.chainKey, input, 1)[0]
+}
+
+// mixDH mixes a Diffie-Hellman result into the chain key and returns the
+// resulting message key
+func (hs *handshakeState) mixDH(private noisePrivateKey, public noisePublicKey) ([NOISE_KEY_LEN]byte, error) {
+	ss, err := private.sharedSecret(public)
+	if err != nil {
+		return ss, err
+	}
+	out := noiseKDF(hs.chainKey, ss[:], 2)
+	hs.chainKey = out[0]
+	return out[1], nil
+}
+
+// mixPSK mixes the pre-shared key and returns the message key (psk2 modifier)
+func (hs *handshakeState) mixPSK(psk [NOISE_KEY_LEN]byte) [NOISE_KEY_LEN]byte {
+	out := noiseKDF(hs.chainKey, psk[:], 3)
+	hs.chainKey = out[0]
+	mixHash(&hs.hash, out[1][:])
+	return out[2]
+}
+
+// createInitiation starts a handshake as the initiator (client)
+func createInitiation(localStatic noisePrivateKey, remoteStatic noisePublicKey, index uint32, payload []byte) (*handshakeState, []byte, error) {
+	hs := newHandshakeState(remoteStatic)
+	hs.localStatic = localStatic
+	hs.remoteStatic = remoteStatic
+	hs.localIndex = index
+
+	var err error
+	if hs.localEphemeral, err = newPrivateKey(); err != nil {
+		return nil, nil, err
+	}
+	ephemeral := hs.localEphemeral.publicKey()
+
+	msg := make([]byte, 8, HANDSHAKE_INIT_MIN_LEN+len(payload))
+	msg[0] = MSG_TYPE_HANDSHAKE_INIT
+	binary.BigEndian.PutUint32(msg[4:8], index)
+
+	// e
+	msg = append(msg, ephemeral[:]...)
+	hs.mixKey(ephemeral[:])
+	mixHash(&hs.hash, ephemeral[:])
+
+	// es
+	key, err := hs.mixDH(hs.localEphemeral, remoteStatic)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// s
+	static := localStatic.publicKey()
+	encryptedStatic := noiseSeal(key, static[:], hs.hash[:])
+	mixHash(&hs.hash, encryptedStatic)
+	msg = append(msg, encryptedStatic...)
+
+	// ss
+	if key, err = hs.mixDH(localStatic, remoteStatic); err != nil {
+		return nil, nil, err
+	}
+
+	encryptedPayload := noiseSeal(key, payload, hs.hash[:])
+	mixHash(&hs.hash, encryptedPayload)
+	msg = append(msg, encryptedPayload...)
+
+	return hs, msg, nil
+}
+
+// consumeInitiation processes an initiation as the responder (server). It
+// returns the handshake state, which identifies the initiator's static key,
+// and the decrypted payload.
+func consumeInitiation(localStatic noisePrivateKey, msg []byte) (*handshakeState, []byte, error) {
+	if len(msg) < HANDSHAKE_INIT_MIN_LEN || msg[0] != MSG_TYPE_HANDSHAKE_INIT {
+		return nil, nil, fmt.Errorf("malformed handshake initiation (%d bytes)", len(msg))
+	}
+
+	hs := newHandshakeState(localStatic.publicKey())
+	hs.localStatic = localStatic
+	hs.remoteIndex = binary.BigEndian.Uint32(msg[4:8])
+
+	// e
+	copy(hs.remoteEphemeral[:], msg[8:8+NOISE_KEY_LEN])
+	hs.mixKey(hs.remoteEphemeral[:])
+	mixHash(&hs.hash, hs.remoteEphemeral[:])
+
+	// es
+	key, err := hs.mixDH(localStatic, hs.remoteEphemeral)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// s
+	offset := 8 + NOISE_KEY_LEN
+	encryptedStatic := msg[offset : offset+NOISE_KEY_LEN+AEAD_TAG_LEN]
+	static, err := noiseOpen(key, encryptedStatic, hs.hash[:])
+	if err != nil {
+		return nil, nil, errHandshakeAuth
+	}
+	mixHash(&hs.hash, encryptedStatic)
+	copy(hs.remoteStatic[:], static)
+
+	// ss
+	if key, err = hs.mixDH(localStatic, hs.remoteStatic); err != nil {
+		return nil, nil, err
+	}
+
+	encryptedPayload := msg[offset+NOISE_KEY_LEN+AEAD_TAG_LEN:]
+	payload, err := noiseOpen(key, encryptedPayload, hs.hash[:])
+	if err != nil {
+		return nil, nil, errHandshakeAuth
+	}
+	mixHash(&hs.hash, encryptedPayload)
+
+	return hs, payload, nil
+}
+
+// createResponse answers a consumed initiation as the responder
+func (hs *handshakeState) createResponse(psk [NOISE_KEY_LEN]byte, index uint32, payload []byte) ([]byte, error) {
+	hs.localIndex = index
+
+	var err error
+	if hs.localEphemeral, err = newPrivateKey(); err != nil {
+		return nil, err
+	}
+	ephemeral := hs.localEphemeral.publicKey()
+
+	msg := make([]byte, 12, HANDSHAKE_RESPONSE_MIN_LEN+len(payload))
+	msg[0] = MSG_TYPE_HANDSHAKE_RESPONSE
+	binary.BigEndian.PutUint32(msg[4:8], index)
+	binary.BigEndian.PutUint32(msg[8:12], hs.remoteIndex)
+
+	// e
+	msg = append(msg, ephemeral[:]...)
+	hs.mixKey(ephemeral[:])
+	mixHash(&hs.hash, ephemeral[:])
+
+	// ee, se
+	if _, err := hs.mixDH(hs.localEphemeral, hs.remoteEphemeral); err != nil {
+		return nil, err
+	}
+	if _, err := hs.mixDH(hs.localEphemeral, hs.remoteStatic); err != nil {
+		return nil, err
+	}
+
+	// psk
+	key := hs.mixPSK(psk)
+
+	encryptedPayload := noiseSeal(key, payload, hs.hash[:])
+	mixHash(&hs.hash, encryptedPayload)
+	msg = append(msg, encryptedPayload...)
+
+	return msg, nil
+}
+
+// consumeResponse processes the responder's answer as the initiator. The
+// state is only updated if the response authenticates, so forged responses
+// cannot disturb a pending handshake.
+func (hs *handshakeState) consumeResponse(psk [NOISE_KEY_LEN]byte, msg []byte) ([]byte, error) {
+	if len(msg) < HANDSHAKE_RESPONSE_MIN_LEN || msg[0] != MSG_TYPE_HANDSHAKE_RESPONSE {
+		return nil, fmt.Errorf("malformed handshake response (%d bytes)", len(msg))
+	}
+	if binary.BigEndian.Uint32(msg[8:12]) != hs.localIndex {
+		return nil, fmt.Errorf("handshake response for unknown index")
+	}
+
+	next := *hs
+	next.remoteIndex = binary.BigEndian.Uint32(msg[4:8])
+
+	// e
+	copy(next.remoteEphemeral[:], msg[12:12+NOISE_KEY_LEN])
+	next.mixKey(next.remoteEphemeral[:])
+	mixHash(&next.hash, next.remoteEphemeral[:])
+
+	// ee, se
+	if _, err := next.mixDH(next.localEphemeral, next.remoteEphemeral); err != nil {
+		return nil, err
+	}
+	if _, err := next.mixDH(next.localStatic, next.remoteEphemeral); err != nil {
+		return nil, err
+	}
+
+	// psk
+	key := next.mixPSK(psk)
+
+	encryptedPayload := msg[12+NOISE_KEY_LEN:]
+	payload, err := noiseOpen(key, encryptedPayload, next.hash[:])
+	if err != nil {
+		return nil, errHandshakeAuth
+	}
+	mixHash(&next.hash, encryptedPayload)
+
+	*hs = next
+	return payload, nil
+}
+
+// deriveKeypair splits the final chain key into the transport keys
+func (hs *handshakeState) deriveKeypair(suite cipherSuite, initiator bool) (*keypair, error) {
+	out := noiseKDF(hs.chainKey, nil, 2)
+	sendKey, recvKey := out[0], out[1]
+	if !initiator {
+		sendKey, recvKey = recvKey, sendKey
+	}
+	return newKeypair(suite, sendKey[:], recvKey[:], hs.localIndex, hs.remoteIndex)
+}
+
+// messageType returns the type byte of a packet, or 0 for an empty packet
+func messageType(packet []byte) uint8 {
+	if len(packet) == 0 {
+		return 0
+	}
+	return packet[0]
+}
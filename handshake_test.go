@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// handshakePeers returns fresh static keys for a client and a server
+func handshakePeers(t *testing.T) (client, server noisePrivateKey) {
+	t.Helper()
+	var err error
+	if client, err = newPrivateKey(); err != nil {
+		t.Fatal(err)
+	}
+	if server, err = newPrivateKey(); err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+// openFrame opens a data frame sealed by the other side
+func openFrame(kp *keypair, frame []byte) ([]byte, error) {
+	hdr, err := parseFrameHeader(frame)
+	if err != nil {
+		return nil, err
+	}
+	return kp.open(hdr, frame)
+}
+
+func TestHandshakeRoundTrip(t *testing.T) {
+	clientStatic, serverStatic := handshakePeers(t)
+	psk := [NOISE_KEY_LEN]byte{1, 2, 3}
+
+	initiator, init, err := createInitiation(clientStatic, serverStatic.publicKey(), 11, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder, payload, err := consumeInitiation(serverStatic, init)
+	if err != nil {
+		t.Fatalf("consumeInitiation: %v", err)
+	}
+	if responder.remoteStatic != clientStatic.publicKey() {
+		t.Fatal("responder did not learn the client's static key")
+	}
+	if string(payload) != "hello" {
+		t.Fatalf("initiation payload = %q", payload)
+	}
+
+	resp, err := responder.createResponse(psk, 22, []byte("welcome"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err = initiator.consumeResponse(psk, resp)
+	if err != nil {
+		t.Fatalf("consumeResponse: %v", err)
+	}
+	if string(payload) != "welcome" {
+		t.Fatalf("response payload = %q", payload)
+	}
+
+	clientKP, err := initiator.deriveKeypair(suiteChaCha20Poly1305, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverKP, err := responder.deriveKeypair(suiteChaCha20Poly1305, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clientKP.localIndex != 11 || clientKP.remoteIndex != 22 || serverKP.localIndex != 22 || serverKP.remoteIndex != 11 {
+		t.Fatalf("indexes: client %d/%d, server %d/%d", clientKP.localIndex, clientKP.remoteIndex, serverKP.localIndex, serverKP.remoteIndex)
+	}
+
+	for _, dir := range []struct {
+		name     string
+		from, to *keypair
+	}{
+		{"client to server", clientKP, serverKP},
+		{"server to client", serverKP, clientKP},
+	} {
+		frame, err := dir.from.seal([]byte("packet"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext, err := openFrame(dir.to, frame)
+		if err != nil {
+			t.Fatalf("%s: %v", dir.name, err)
+		}
+		if !bytes.Equal(plaintext, []byte("packet")) {
+			t.Fatalf("%s: got %q", dir.name, plaintext)
+		}
+	}
+}
+
+func TestHandshakeRejects(t *testing.T) {
+	psk := [NOISE_KEY_LEN]byte{1, 2, 3}
+	tests := []struct {
+		name string
+		// Changes to the server's PSK, the initiation or the response
+		serverPSK  [NOISE_KEY_LEN]byte
+		initiation func(msg []byte)
+		response   func(msg []byte)
+		// Which side must fail
+		initFails bool
+	}{
+		{name: "wrong PSK", serverPSK: [NOISE_KEY_LEN]byte{9}},
+		{name: "tampered response payload", serverPSK: psk, response: func(msg []byte) { msg[len(msg)-1] ^= 1 }},
+		{name: "tampered response ephemeral", serverPSK: psk, response: func(msg []byte) { msg[12] ^= 1 }},
+		{name: "tampered initiation static", serverPSK: psk, initiation: func(msg []byte) { msg[8+NOISE_KEY_LEN] ^= 1 }, initFails: true},
+		{name: "tampered initiation payload", serverPSK: psk, initiation: func(msg []byte) { msg[len(msg)-1] ^= 1 }, initFails: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientStatic, serverStatic := handshakePeers(t)
+			initiator, init, err := createInitiation(clientStatic, serverStatic.publicKey(), 1, []byte("{}"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.initiation != nil {
+				tt.initiation(init)
+			}
+			responder, _, err := consumeInitiation(serverStatic, init)
+			if tt.initFails {
+				if !errors.Is(err, errHandshakeAuth) {
+					t.Fatalf("consumeInitiation error = %v, want %v", err, errHandshakeAuth)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := responder.createResponse(tt.serverPSK, 2, []byte("{}"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			genuine := append([]byte(nil), resp...)
+			if tt.response != nil {
+				tt.response(resp)
+			}
+			if _, err := initiator.consumeResponse(psk, resp); !errors.Is(err, errHandshakeAuth) {
+				t.Fatalf("consumeResponse error = %v, want %v", err, errHandshakeAuth)
+			}
+
+			// A rejected response leaves the pending handshake intact
+			if tt.serverPSK == psk {
+				if _, err := initiator.consumeResponse(psk, genuine); err != nil {
+					t.Fatalf("genuine response after a forged one: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestHandshakeWrongServerKey(t *testing.T) {
+	clientStatic, serverStatic := handshakePeers(t)
+	_, otherServer := handshakePeers(t)
+
+	_, init, err := createInitiation(clientStatic, otherServer.publicKey(), 1, []byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := consumeInitiation(serverStatic, init); !errors.Is(err, errHandshakeAuth) {
+		t.Fatalf("consumeInitiation error = %v, want %v", err, errHandshakeAuth)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import "net/netip"
+
+// packetAddrs extracts the source and destination addresses of a raw IPv4 or
+// IPv6 packet as read from or written to the TUN device
+func packetAddrs(packet []byte) (src, dst netip.Addr, ok bool) {
+	if len(packet) == 0 {
+		return src, dst, false
+	}
+
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return src, dst, false
+		}
+		src = netip.AddrFrom4([4]byte(packet[12:16]))
+		dst = netip.AddrFrom4([4]byte(packet[16:20]))
+		return src, dst, true
+	case 6:
+		if len(packet) < 40 {
+			return src, dst, false
+		}
+		src = netip.AddrFrom16([16]byte(packet[8:24]))
+		dst = netip.AddrFrom16([16]byte(packet[24:40]))
+		return src, dst, true
+	default:
+		return src, dst, false
+	}
+}
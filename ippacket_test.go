@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestPacketAddrs(t *testing.T) {
+	v4 := make([]byte, 20)
+	v4[0] = 0x45
+	copy(v4[12:], []byte{10, 8, 0, 2, 1, 1, 1, 1})
+	v6 := make([]byte, 40)
+	v6[0] = 0x60
+	src6, dst6 := netip.MustParseAddr("fd00:8::2"), netip.MustParseAddr("2001:db8::1")
+	copy(v6[8:], src6.AsSlice())
+	copy(v6[24:], dst6.AsSlice())
+
+	tests := []struct {
+		name     string
+		packet   []byte
+		src, dst netip.Addr
+		ok       bool
+	}{
+		{"ipv4", v4, netip.MustParseAddr("10.8.0.2"), netip.MustParseAddr("1.1.1.1"), true},
+		{"ipv6", v6, src6, dst6, true},
+		{"short ipv4", v4[:19], netip.Addr{}, netip.Addr{}, false},
+		{"short ipv6", v6[:39], netip.Addr{}, netip.Addr{}, false},
+		{"control message", []byte{CONTROL_KEEPALIVE}, netip.Addr{}, netip.Addr{}, false},
+		{"empty", nil, netip.Addr{}, netip.Addr{}, false},
+	}
+	for _, tt := range tests {
+		src, dst, ok := packetAddrs(tt.packet)
+		if ok != tt.ok || src != tt.src || dst != tt.dst {
+			t.Errorf("%s: got %s -> %s, %v; want %s -> %s, %v", tt.name, src, dst, ok, tt.src, tt.dst, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+//go:build !client
+// +build !client
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ipLease is the tunnel addresses leased to one client
+type ipLease struct {
+	IPv4 netip.Addr `json:"ipv4"`
+	IPv6 netip.Addr `json:"ipv6"`
+}
+
+// ipPool hands out tunnel addresses from an IPv4 and an optional IPv6
+// prefix. The first host of each prefix is the server's own address. Leases
+// are sticky per client static key and are saved to a JSON file, so a client
+// keeps its addresses across reconnects and server restarts, until it is
+// removed from the peers.
+type ipPool struct {
+	prefix4 netip.Prefix
+	prefix6 netip.Prefix // Invalid when IPv6 is disabled
+	path    string       // Lease file, empty to keep leases in memory only
+
+	mu     sync.Mutex
+	leases map[noisePublicKey]ipLease
+	used   map[netip.Addr]bool
+}
+
+var errPoolExhausted = errors.New("address pool exhausted")
+
+// newIPPool parses the pool prefixes and loads existing leases from path.
+// Leases that no longer fit the configured prefixes are dropped.
+func newIPPool(pool4, pool6, path string) (*ipPool, error) {
+	p := &ipPool{
+		path:   path,
+		leases: make(map[noisePublicKey]ipLease),
+		used:   make(map[netip.Addr]bool),
+	}
+
+	var err error
+	if p.prefix4, err = parsePoolPrefix(pool4, false); err != nil {
+		return nil, err
+	}
+	if pool6 != "" {
+		if p.prefix6, err = parsePoolPrefix(pool6, true); err != nil {
+			return nil, err
+		}
+	}
+
+	if path == "" {
+		return p, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lease file %s: %w", path, err)
+	}
+
+	var saved map[string]ipLease
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("failed to parse lease file %s: %w", path, err)
+	}
+	for keyB64, lease := range saved {
+		key, err := parsePublicKey(keyB64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key in lease file %s: %w", path, err)
+		}
+		if !p.assignable(p.prefix4, lease.IPv4) || p.used[lease.IPv4] {
+			lease.IPv4 = netip.Addr{}
+		}
+		if !p.assignable(p.prefix6, lease.IPv6) || p.used[lease.IPv6] {
+			lease.IPv6 = netip.Addr{}
+		}
+		p.leases[key] = lease
+		p.used[lease.IPv4] = true
+		p.used[lease.IPv6] = true
+	}
+	delete(p.used, netip.Addr{})
+
+	return p, nil
+}
+
+// ulaPrefix derives a stable IPv6 pool from the server's public key: the
+// first /64 of a unique local /48 (RFC 4193) whose global ID comes from a
+// hash of the key, so the pool survives restarts without being stored
+func ulaPrefix(key noisePublicKey) netip.Prefix {
+	sum := sha256.Sum256(key[:])
+	var addr [16]byte
+	addr[0] = 0xfd
+	copy(addr[1:6], sum[:5])
+	return netip.PrefixFrom(netip.AddrFrom16(addr), 64)
+}
+
+// parsePoolPrefix parses a pool such as 10.8.0.0/24 and checks that it has
+// room for the server and at least one client
+func parsePoolPrefix(s string, ipv6 bool) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid address pool %q: %w", s, err)
+	}
+	prefix = prefix.Masked()
+	if prefix.Addr().Is6() != ipv6 {
+		family := "IPv4"
+		if ipv6 {
+			family = "IPv6"
+		}
+		return netip.Prefix{}, fmt.Errorf("address pool %s is not %s", prefix, family)
+	}
+	if prefix.Addr().BitLen()-prefix.Bits() < 2 {
+		return netip.Prefix{}, fmt.Errorf("address pool %s is too small", prefix)
+	}
+	return prefix, nil
+}
+
+// serverAddrs returns the server's own tunnel addresses, with the pool's
+// prefix length
+func (p *ipPool) serverAddrs() []netip.Prefix {
+	addrs := []netip.Prefix{netip.PrefixFrom(p.prefix4.Addr().Next(), p.prefix4.Bits())}
+	if p.prefix6.IsValid() {
+		addrs = append(addrs, netip.PrefixFrom(p.prefix6.Addr().Next(), p.prefix6.Bits()))
+	}
+	return addrs
+}
+
+// assignable reports whether addr may be leased from prefix: inside it, and
+// neither the network, the server nor the IPv4 broadcast address
+func (p *ipPool) assignable(prefix netip.Prefix, addr netip.Addr) bool {
+	if !prefix.IsValid() || !addr.IsValid() || !prefix.Contains(addr) {
+		return false
+	}
+	if addr == prefix.Addr() || addr == prefix.Addr().Next() {
+		return false
+	}
+	return !addr.Is4() || prefix.Contains(addr.Next())
+}
+
+// allocate returns the lowest free address of prefix
+func (p *ipPool) allocate(prefix netip.Prefix) (netip.Addr, error) {
+	for addr := prefix.Addr().Next().Next(); p.assignable(prefix, addr); addr = addr.Next() {
+		if !p.used[addr] {
+			return addr, nil
+		}
+	}
+	return netip.Addr{}, fmt.Errorf("%w (%s)", errPoolExhausted, prefix)
+}
+
+// lease returns the client's tunnel addresses, allocating and saving them on
+// first contact. A failed save is logged; the lease then only lasts until
+// the server restarts.
+func (p *ipPool) lease(static noisePublicKey) ([]netip.Prefix, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	lease := p.leases[static]
+	changed := false
+	if !lease.IPv4.IsValid() {
+		addr, err := p.allocate(p.prefix4)
+		if err != nil {
+			return nil, err
+		}
+		lease.IPv4 = addr
+		changed = true
+	}
+	if p.prefix6.IsValid() && !lease.IPv6.IsValid() {
+		addr, err := p.allocate(p.prefix6)
+		if err != nil {
+			return nil, err
+		}
+		lease.IPv6 = addr
+		changed = true
+	}
+
+	if changed {
+		p.leases[static] = lease
+		p.used[lease.IPv4] = true
+		if lease.IPv6.IsValid() {
+			p.used[lease.IPv6] = true
+		}
+		if err := p.save(); err != nil {
+			log.Printf("⚠️  Lease for %s is not persisted: %v", static, err)
+		}
+	}
+
+	addrs := []netip.Prefix{netip.PrefixFrom(lease.IPv4, p.prefix4.Bits())}
+	if p.prefix6.IsValid() {
+		addrs = append(addrs, netip.PrefixFrom(lease.IPv6, p.prefix6.Bits()))
+	}
+	return addrs, nil
+}
+
+// retain releases the leases of clients that are no longer peers, so their
+// addresses go to new clients, and saves the change. It returns how many
+// leases were released.
+func (p *ipPool) retain(peers peerList) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	released := 0
+	for static, lease := range p.leases {
+		if _, ok := peers[static]; ok {
+			continue
+		}
+		delete(p.leases, static)
+		delete(p.used, lease.IPv4)
+		delete(p.used, lease.IPv6)
+		released++
+	}
+	if released > 0 {
+		if err := p.save(); err != nil {
+			log.Printf("⚠️  Released leases are not persisted: %v", err)
+		}
+	}
+	return released
+}
+
+// save writes all leases to the lease file. The file is replaced atomically
+// so a crash never leaves it half written. The caller must hold p.mu.
+func (p *ipPool) save() error {
+	if p.path == "" {
+		return nil
+	}
+
+	saved := make(map[string]ipLease, len(p.leases))
+	for key, lease := range p.leases {
+		saved[key.String()] = lease
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(p.path), ".leases-*")
+	if err != nil {
+		return fmt.Errorf("failed to save leases: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save leases: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save leases: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), p.path); err != nil {
+		return fmt.Errorf("failed to save leases: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+//go:build !client
+// +build !client
+
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testStatic returns a distinct public key for client number i
+func testStatic(i int) noisePublicKey {
+	var static noisePublicKey
+	static[0], static[1] = byte(i), byte(i>>8)
+	return static
+}
+
+// Removed peers give their addresses back, also after a restart
+func TestIPPoolRetain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.json")
+	pool, err := newIPPool("10.8.0.0/24", "fd00:8::/64", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, removed := testStatic(1), testStatic(2)
+	keptAddrs, err := pool.lease(kept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.lease(removed); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := pool.retain(peerList{kept: &peer{}}); n != 1 {
+		t.Fatalf("released %d leases, want 1", n)
+	}
+	if n := pool.retain(peerList{kept: &peer{}}); n != 0 {
+		t.Fatalf("released %d leases again", n)
+	}
+
+	pool, err = newIPPool("10.8.0.0/24", "fd00:8::/64", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pool.leases[removed]; ok {
+		t.Fatal("released lease came back after a restart")
+	}
+	addrs, err := pool.lease(kept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addrs[0] != keptAddrs[0] || addrs[1] != keptAddrs[1] {
+		t.Fatalf("kept peer moved from %v to %v", keptAddrs, addrs)
+	}
+
+	// The next client gets the released addresses
+	addrs, err = pool.lease(testStatic(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []netip.Prefix{netip.MustParsePrefix("10.8.0.3/24"), netip.MustParsePrefix("fd00:8::3/64")}
+	if addrs[0] != want[0] || addrs[1] != want[1] {
+		t.Fatalf("new client got %v, want %v", addrs, want)
+	}
+}
+
+// Leases survive a restart; leases that no longer fit the pool are dropped
+func TestIPPoolPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.json")
+	pool, err := newIPPool("10.8.0.0/24", "", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := make([][]netip.Prefix, 3)
+	for i := range first {
+		if first[i], err = pool.lease(testStatic(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if again, err := pool.lease(testStatic(1)); err != nil || again[0] != first[1][0] {
+		t.Fatalf("lease changed on reconnect: %v, %v", again, err)
+	}
+
+	pool, err = newIPPool("10.8.0.0/24", "", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := len(first) - 1; i >= 0; i-- {
+		addrs, err := pool.lease(testStatic(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addrs[0] != first[i][0] {
+			t.Errorf("client %d got %v after a restart, had %v", i, addrs, first[i])
+		}
+	}
+
+	// A new pool moves everyone, without handing out an address twice
+	pool, err = newIPPool("10.9.0.0/24", "", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[netip.Prefix]bool)
+	for i := range first {
+		addrs, err := pool.lease(testStatic(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !netip.MustParsePrefix("10.9.0.0/24").Contains(addrs[0].Addr()) || seen[addrs[0]] {
+			t.Errorf("client %d got %v from the new pool", i, addrs)
+		}
+		seen[addrs[0]] = true
+	}
+
+	if err := os.WriteFile(path, []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newIPPool("10.8.0.0/24", "", path); err == nil {
+		t.Error("corrupt lease file accepted")
+	}
+}
+
+// The network, server and broadcast addresses are never leased
+func TestIPPoolExhaustion(t *testing.T) {
+	pool, err := newIPPool("10.8.0.0/30", "fd00:8::/126", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := pool.lease(testStatic(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addrs[0].Addr() != netip.MustParseAddr("10.8.0.2") || addrs[1].Addr() != netip.MustParseAddr("fd00:8::2") {
+		t.Fatalf("first client got %v", addrs)
+	}
+	if _, err := pool.lease(testStatic(2)); !errors.Is(err, errPoolExhausted) {
+		t.Fatalf("second client in a /30: %v", err)
+	}
+
+	// Once a peer is removed its addresses are free again
+	pool.retain(peerList{})
+	if _, err := pool.lease(testStatic(2)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParsePoolPrefix(t *testing.T) {
+	tests := []struct {
+		pool string
+		ipv6 bool
+		want string // Empty if invalid
+	}{
+		{"10.8.0.0/24", false, "10.8.0.0/24"},
+		{"10.8.0.77/24", false, "10.8.0.0/24"},
+		{"10.8.0.0/30", false, "10.8.0.0/30"},
+		{"10.8.0.0/31", false, ""},
+		{"fd00:8::/64", true, "fd00:8::/64"},
+		{"fd00:8::/127", true, ""},
+		{"fd00:8::/64", false, ""},
+		{"10.8.0.0/24", true, ""},
+		{"10.8.0.0", false, ""},
+	}
+	for _, tt := range tests {
+		got, err := parsePoolPrefix(tt.pool, tt.ipv6)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s accepted as %s", tt.pool, got)
+			}
+			continue
+		}
+		if err != nil || got.String() != tt.want {
+			t.Errorf("%s: got %s, %v; want %s", tt.pool, got, err, tt.want)
+		}
+	}
+}
+
+// The ULA pool is stable for a server key and differs between servers
+func TestULAPrefix(t *testing.T) {
+	key1, _ := testPublicKey(t)
+	key2, _ := testPublicKey(t)
+	ula := ulaPrefix(key1)
+	if ula != ulaPrefix(key1) {
+		t.Fatal("ULA prefix changes for the same key")
+	}
+	if ula == ulaPrefix(key2) {
+		t.Fatal("two server keys share a ULA prefix")
+	}
+	if !netip.MustParsePrefix("fd00::/8").Contains(ula.Addr()) || ula.Bits() != 64 || ula != ula.Masked() {
+		t.Fatalf("%s is not a ULA /64", ula)
+	}
+
+	pool, err := newIPPool("10.8.0.0/24", ula.String(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := pool.lease(testStatic(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 2 || !ula.Contains(addrs[1].Addr()) || addrs[1].Bits() != 64 {
+		t.Fatalf("dual-stack lease %v", addrs)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Session key lifetimes (the WireGuard values). The initiator starts a new
+// handshake once keys reach a rekey limit; both sides refuse keys past the
+// reject limits. The previous keypair keeps being accepted until it expires,
+// so packets still in flight during a rekey are not lost.
+const (
+	REKEY_AFTER_TIME      = 120 * time.Second
+	REJECT_AFTER_TIME     = 180 * time.Second
+	REKEY_AFTER_MESSAGES  = 1 << 60
+	REJECT_AFTER_MESSAGES = 1<<64 - 1<<13 - 1
+)
+
+var errKeypairExpired = errors.New("session keys expired")
+
+// keypair holds the transport keys of one handshake
+type keypair struct {
+	suite       cipherSuite
+	localIndex  uint32 // Index the peer puts in frames it sends to us
+	remoteIndex uint32 // Index we put in frames we send to the peer
+	send        cipher.AEAD
+	recv        cipher.AEAD
+	sendCounter atomic.Uint64
+	sentBytes   atomic.Uint64
+	recvBytes   atomic.Uint64
+	replay      replayWindow
+	created     time.Time
+}
+
+func newKeypair(suite cipherSuite, sendKey, recvKey []byte, localIndex, remoteIndex uint32) (*keypair, error) {
+	send, err := suite.newAEAD(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := suite.newAEAD(recvKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &keypair{
+		suite:       suite,
+		localIndex:  localIndex,
+		remoteIndex: remoteIndex,
+		send:        send,
+		recv:        recv,
+		created:     time.Now(),
+	}, nil
+}
+
+// seal encrypts plaintext into a complete data frame
+// Returns: [HEADER][CIPHERTEXT][TAG]
+func (kp *keypair) seal(plaintext []byte) ([]byte, error) {
+	if kp.expired() {
+		return nil, errKeypairExpired
+	}
+	counter := kp.sendCounter.Add(1) - 1
+	if counter >= REJECT_AFTER_MESSAGES {
+		return nil, errKeypairExpired
+	}
+	kp.sentBytes.Add(uint64(len(plaintext)))
+
+	frame := make([]byte, HEADER_LEN, HEADER_LEN+len(plaintext)+AEAD_TAG_LEN)
+	frameHeader{
+		Type:          MSG_TYPE_DATA,
+		Suite:         kp.suite,
+		ReceiverIndex: kp.remoteIndex,
+		Counter:       counter,
+	}.marshal(frame)
+
+	return kp.send.Seal(frame, counterNonce(counter), plaintext, frame[:HEADER_LEN]), nil
+}
+
+// open authenticates and decrypts a data frame whose header was parsed
+// with parseFrameHeader, then rejects counters the replay window has seen
+func (kp *keypair) open(hdr frameHeader, frame []byte) ([]byte, error) {
+	if kp.expired() || hdr.Counter >= REJECT_AFTER_MESSAGES {
+		return nil, errKeypairExpired
+	}
+	if hdr.Suite != kp.suite {
+		return nil, fmt.Errorf("frame uses %s, session negotiated %s", hdr.Suite, kp.suite)
+	}
+
+	plaintext, err := kp.recv.Open(nil, counterNonce(hdr.Counter), frame[HEADER_LEN:], frame[:HEADER_LEN])
+	if err != nil {
+		return nil, errFrameAuth
+	}
+
+	if !kp.replay.check(hdr.Counter) {
+		metrics.replayDrops.Add(1)
+		return nil, errReplay
+	}
+	kp.recvBytes.Add(uint64(len(plaintext)))
+	return plaintext, nil
+}
+
+// expired reports whether the keys are too old to be used in either direction
+func (kp *keypair) expired() bool {
+	return time.Since(kp.created) >= REJECT_AFTER_TIME ||
+		kp.sendCounter.Load() >= REJECT_AFTER_MESSAGES
+}
+
+// revoke expires the keys immediately, e.g. when their peer is removed
+func (kp *keypair) revoke() {
+	kp.sendCounter.Store(REJECT_AFTER_MESSAGES)
+}
+
+// needsRekey reports whether the initiator should start a new handshake.
+// byteLimit caps the traffic in both directions; zero disables it.
+func (kp *keypair) needsRekey(byteLimit uint64) bool {
+	if time.Since(kp.created) >= REKEY_AFTER_TIME || kp.sendCounter.Load() >= REKEY_AFTER_MESSAGES {
+		return true
+	}
+	return byteLimit > 0 && kp.sentBytes.Load()+kp.recvBytes.Load() >= byteLimit
+}
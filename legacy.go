@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+)
+
+// Legacy AES-256-CFB + HMAC-SHA256 framing, kept so older clients such as
+// client_example.py keep working while deployments migrate to the AEAD suites.
+//
+// Packet structure: [HMAC_TAG (32 bytes)][IV (16 bytes)][ENCRYPTED_DATA]
+const (
+	HMAC_LEN = 32            // SHA256 output size
+	IV_LEN   = aes.BlockSize // 16 bytes for AES
+
+	LEGACY_OVERHEAD = HMAC_LEN + IV_LEN
+)
+
+// legacyOpen verifies the HMAC and decrypts a legacy packet
+func legacyOpen(aesKey, hmacKey, packet []byte) ([]byte, error) {
+	if len(packet) < HMAC_LEN+IV_LEN {
+		return nil, fmt.Errorf("packet too short (%d bytes), expected at least %d bytes", len(packet), HMAC_LEN+IV_LEN)
+	}
+
+	receivedHMAC := packet[:HMAC_LEN]
+	dataWithIV := packet[HMAC_LEN:]
+
+	if !verifyHMAC(hmacKey, dataWithIV, receivedHMAC) {
+		return nil, fmt.Errorf("HMAC verification failed")
+	}
+
+	return decrypt(aesKey, dataWithIV)
+}
+
+// legacySeal encrypts and authenticates a packet in the legacy format
+// Returns: [HMAC_TAG][IV][ENCRYPTED_DATA]
+func legacySeal(aesKey, hmacKey, plaintext []byte) ([]byte, error) {
+	encrypted, err := encrypt(aesKey, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return addHMAC(hmacKey, encrypted), nil
+}
+
+// verifyHMAC checks if the received HMAC matches the computed HMAC
+func verifyHMAC(hmacKey, data, receivedHMAC []byte) bool {
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write(data)
+	expectedHMAC := mac.Sum(nil)
+	return hmac.Equal(expectedHMAC, receivedHMAC)
+}
+
+// decrypt decrypts data using AES-256 CFB mode
+// Data format: [IV (16 bytes)][ENCRYPTED_DATA]
+func decrypt(aesKey, data []byte) ([]byte, error) {
+	if len(data) < IV_LEN {
+		return nil, fmt.Errorf("data too short: need at least %d bytes for IV, got %d", IV_LEN, len(data))
+	}
+
+	iv := data[:IV_LEN]
+	ciphertext := data[IV_LEN:]
+
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	stream := cipher.NewCFBDecrypter(block, iv)
+	plaintext := make([]byte, len(ciphertext))
+	stream.XORKeyStream(plaintext, ciphertext)
+
+	return plaintext, nil
+}
+
+// encrypt encrypts data using AES-256 CFB mode
+// Returns: [IV][ENCRYPTED_DATA]
+func encrypt(aesKey, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	iv := make([]byte, IV_LEN)
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, fmt.Errorf("failed to generate IV: %w", err)
+	}
+
+	ciphertext := make([]byte, len(plaintext))
+	stream := cipher.NewCFBEncrypter(block, iv)
+	stream.XORKeyStream(ciphertext, plaintext)
+
+	result := make([]byte, IV_LEN+len(ciphertext))
+	copy(result[:IV_LEN], iv)
+	copy(result[IV_LEN:], ciphertext)
+
+	return result, nil
+}
+
+// addHMAC adds HMAC tag to data
+// Returns: [HMAC_TAG][DATA]
+func addHMAC(hmacKey, data []byte) []byte {
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write(data)
+	hmacTag := mac.Sum(nil)
+
+	result := make([]byte, HMAC_LEN+len(data))
+	copy(result[:HMAC_LEN], hmacTag)
+	copy(result[HMAC_LEN:], data)
+
+	return result
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// Log levels. Per-packet messages are only written at debug level.
+const (
+	LOG_LEVEL_INFO  = "info"
+	LOG_LEVEL_DEBUG = "debug"
+)
+
+// debugLogging is set once at startup, before any packet handler runs
+var debugLogging bool
+
+// debugf logs a message only when debug logging is enabled
+func debugf(format string, args ...any) {
+	if debugLogging {
+		log.Printf(format, args...)
+	}
+}
+
+// validateLogLevel checks a log level name
+func validateLogLevel(level string) error {
+	switch strings.ToLower(level) {
+	case LOG_LEVEL_INFO, LOG_LEVEL_DEBUG:
+		return nil
+	default:
+		return fmt.Errorf("unknown log level %q (use %s or %s)", level, LOG_LEVEL_INFO, LOG_LEVEL_DEBUG)
+	}
+}
+
+// setupLogging applies the log level and, if file is set, copies the log
+// to that file as well as stderr
+func setupLogging(level, file string) error {
+	if err := validateLogLevel(level); err != nil {
+		return err
+	}
+	debugLogging = strings.ToLower(level) == LOG_LEVEL_DEBUG
+
+	if file != "" {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+		if err != nil {
+			return fmt.Errorf("failed to open log file: %w", err)
+		}
+		log.SetOutput(io.MultiWriter(os.Stderr, f))
+	}
+	return nil
+}
@@ -4,130 +4,380 @@
 package main
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/hmac"
-	"crypto/rand"
+	"context"
 	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/netip"
 	"os"
-	"os/exec"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/songgao/water"
 	"golang.org/x/crypto/pbkdf2"
 )
 
 const (
-	SERVER_IP   = "10.8.0.1/24"
-	UDP_PORT    = 1194
-	BUFFER_SIZE = 1500
-	KEY_LEN     = 32            // For AES-256
-	HMAC_LEN    = 32            // SHA256 output size
-	IV_LEN      = aes.BlockSize // 16 bytes for AES
-
-	// PBKDF2 parameters
-	PBKDF2_ITERATIONS = 100000
-	PBKDF2_SALT       = "cipherwall-salt-2025" // In production, use a proper random salt
+	KEY_LEN = 32 // For AES-256
 )
 
-// Global variables for derived keys and the TUN interface pointer
-var (
-	aesKey      []byte
-	hmacKey     []byte
-	iface       *water.Interface
-	clientAddrs map[string]*net.UDPAddr // Track client addresses
-)
+// tunDevice is the TUN interface the packet handlers read and write
+type tunDevice interface {
+	io.ReadWriter
+	Name() string
+}
+
+// Server holds everything the packet handlers share. The keys and settings
+// are written once during startup and only read afterwards; per-client state
+// lives in the session table, which is safe for concurrent use.
+type Server struct {
+	cfg *serverConfig
+
+	// Legacy AES-CFB + HMAC keys derived from the PSK
+	aesKey  []byte
+	hmacKey []byte
+
+	// Handshake and data channel settings
+	staticKey     noisePrivateKey
+	handshakePSK  [NOISE_KEY_LEN]byte
+	allowedSuites []cipherSuite
+	legacyEnabled bool
+
+	iface      tunDevice
+	netChanges netJournal               // Network configuration to revert on shutdown
+	conns      []*net.UDPConn           // One socket per listen address
+	peers      atomic.Pointer[peerList] // Clients allowed to connect, reloaded on change
+	pool       *ipPool                  // Tunnel addresses leased to clients
+	sessions   *sessionTable            // Connected clients
+	fragments  *reassembler             // Fragmented frames from clients
+}
 
 func main() {
+	// 1. Load configuration: defaults, config file, environment, flags
+	cfg, checkOnly, err := parseServerFlags(os.Args[1:])
+	if err == nil {
+		for _, warning := range cfg.warnings() {
+			log.Printf("⚠️  %s", warning)
+		}
+	}
+	if checkOnly {
+		if err == nil {
+			err = checkConfig(cfg)
+		}
+		if err != nil {
+			log.Fatalf("❌ Invalid configuration: %v", err)
+		}
+		log.Println("✅ Configuration is valid")
+		return
+	}
+	if err != nil {
+		log.Fatalf("❌ Invalid configuration: %v", err)
+	}
+	if err := setupLogging(cfg.Log.Level, cfg.Log.File); err != nil {
+		log.Fatalf("❌ Failed to setup logging: %v", err)
+	}
+
 	log.Println("🛡️  CipherWall VPN Server Starting...")
+	if cfg.path != "" {
+		log.Printf("📄 Configuration loaded from %s", cfg.path)
+	}
 
-	// 1. Get PSK from environment or use default
-	psk := os.Getenv("VPN_PSK")
+	psk := cfg.PSK
 	if psk == "" {
-		psk = "this-is-strong-32byte-secret-key"
-		log.Println("⚠️  Using default PSK. Set VPN_PSK environment variable for production!")
+		psk = DEFAULT_PSK
+		log.Println("⚠️  Using default PSK. Set psk in the config file or VPN_PSK for production!")
 	}
 
 	// 2. Derive Keys
 	log.Println("📦 Deriving encryption and authentication keys from PSK...")
-	deriveKeys([]byte(psk))
-	log.Printf("✅ Keys derived successfully (AES: %d bytes, HMAC: %d bytes)", len(aesKey), len(hmacKey))
+	srv := &Server{cfg: cfg, sessions: newSessionTable(), fragments: newReassembler()}
+	masterKey := srv.deriveKeys([]byte(psk))
+	log.Printf("✅ Keys derived successfully (AES: %d bytes, HMAC: %d bytes)", len(srv.aesKey), len(srv.hmacKey))
 
-	// 3. Setup TUN Interface
-	log.Println("🌐 Setting up TUN interface...")
-	var err error
-	iface, err = setupTUN()
-	if err != nil {
-		log.Fatalf("❌ Failed to setup TUN interface: %v", err)
+	// 3. Load static key and data channel cipher suites
+	if err := srv.setupDataChannel(masterKey); err != nil {
+		log.Fatalf("❌ Failed to setup data channel: %v", err)
 	}
-	log.Printf("✅ TUN interface '%s' created and configured with IP %s", iface.Name(), SERVER_IP)
+	log.Printf("🔑 Server public key: %s", srv.staticKey.publicKey())
 
-	// 4. Setup UDP Listener
-	log.Printf("🔌 Starting UDP listener on port %d...", UDP_PORT)
-	udpAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", UDP_PORT))
+	// 4. Load the address pool, existing leases and registered peers
+	pool6 := cfg.Pool6
+	if pool6 == POOL6_ULA {
+		pool6 = ulaPrefix(srv.staticKey.publicKey()).String()
+	}
+	srv.pool, err = newIPPool(cfg.Pool, pool6, cfg.LeaseFile)
 	if err != nil {
-		log.Fatalf("❌ Failed to resolve UDP address: %v", err)
+		log.Fatalf("❌ Failed to setup address pool: %v", err)
 	}
+	serverAddrs := srv.pool.serverAddrs()
 
-	conn, err := net.ListenUDP("udp", udpAddr)
+	if err := srv.setupPeers(); err != nil {
+		log.Fatalf("❌ Failed to load peers: %v", err)
+	}
+
+	// 5. Setup TUN Interface
+	log.Println("🌐 Setting up TUN interface...")
+	if cfg.MTU == 0 {
+		if cfg.MTU, err = srv.autoMTU(); err != nil {
+			cfg.MTU = DEFAULT_MTU
+			log.Printf("⚠️  Failed to detect the underlay MTU, using %d: %v", cfg.MTU, err)
+		}
+		if srv.pool.prefix6.IsValid() && cfg.MTU < IPV6_MIN_MTU {
+			log.Printf("⚠️  MTU %d is below the IPv6 minimum, using %d", cfg.MTU, IPV6_MIN_MTU)
+			cfg.MTU = IPV6_MIN_MTU
+		}
+	}
+	srv.iface, err = setupTUN(serverAddrs, cfg.MTU, &srv.netChanges)
 	if err != nil {
-		log.Fatalf("❌ Failed to start UDP listener: %v", err)
+		log.Fatalf("❌ Failed to setup TUN interface: %v", err)
+	}
+	metrics.tunMTU.Store(int64(cfg.MTU))
+	log.Printf("✅ TUN interface '%s' created and configured with IP %v (MTU %d)", srv.iface.Name(), serverAddrs, cfg.MTU)
+	if len(cfg.PushRoutes) > 0 {
+		log.Printf("🔀 Pushing routes %v to clients", cfg.PushRoutes)
+	}
+	if len(cfg.DNS) > 0 || len(cfg.DNSSearch) > 0 {
+		log.Printf("🌐 Pushing DNS servers %v and search domains %v to clients", cfg.DNS, cfg.DNSSearch)
 	}
-	defer conn.Close()
-	log.Printf("✅ UDP listener started successfully on 0.0.0.0:%d", UDP_PORT)
 
-	// 5. Initialize client tracking
-	clientAddrs = make(map[string]*net.UDPAddr)
+	// 6. Setup UDP Listeners
+	for _, listen := range cfg.Listen {
+		log.Printf("🔌 Starting UDP listener on %s...", listen)
+		udpAddr, err := net.ResolveUDPAddr("udp", listen)
+		if err != nil {
+			log.Fatalf("❌ Failed to resolve UDP address: %v", err)
+		}
+
+		// Path MTU probe acks must be dropped on the way when too big, like
+		// the probes
+		listenConfig := net.ListenConfig{Control: dontFragment}
+		packetConn, err := listenConfig.ListenPacket(context.Background(), "udp", udpAddr.String())
+		if err != nil {
+			log.Fatalf("❌ Failed to start UDP listener: %v", err)
+		}
+		conn := packetConn.(*net.UDPConn)
+		defer conn.Close()
+		srv.conns = append(srv.conns, conn)
+		log.Printf("✅ UDP listener started successfully on %s", conn.LocalAddr())
+	}
 
-	// 6. Start Packet Handlers (bidirectional)
+	// 7. Setup forwarding and NAT for the pool
+	if cfg.NAT.Enabled {
+		log.Println("🔥 Configuring forwarding and NAT...")
+		if err := srv.setupNAT(); err != nil {
+			srv.cleanupNetwork()
+			log.Fatalf("❌ Failed to setup NAT: %v", err)
+		}
+	}
+
+	// 8. Start Packet Handlers (bidirectional)
 	log.Println("🚀 Starting packet handlers...")
-	go handleIncomingPackets(conn) // UDP -> TUN
-	go handleOutgoingPackets(conn) // TUN -> UDP
+	for _, conn := range srv.conns {
+		go srv.handleIncomingPackets(conn) // UDP -> TUN
+	}
+	go srv.handleOutgoingPackets() // TUN -> UDP
+	go srv.maintainSessions()
+	go watchStatusSignal()
 	log.Println("✅ CipherWall VPN Server is running!")
 	log.Println("📡 Waiting for incoming VPN connections...")
 
-	// Keep main function alive
-	select {}
+	// Handle graceful shutdown
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	<-sigChan
+
+	log.Println("👋 Shutting down gracefully...")
+	srv.cleanupNetwork()
+	log.Println("✅ Cleanup complete. Goodbye!")
 }
 
-// executeCommand runs a system command and logs its output/errors
-func executeCommand(name string, args ...string) error {
-	cmd := exec.Command(name, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+// cleanupNetwork reverts the server's forwarding, NAT and interface
+// changes, newest first
+func (s *Server) cleanupNetwork() {
+	log.Println("🧹 Removing NAT rules and network changes...")
+	if err := s.netChanges.rollback(); err != nil {
+		log.Printf("⚠️  Failed to revert some network changes: %v", err)
+	}
+}
+
+// deriveKeys uses PBKDF2 to generate keys from PSK and returns the master key
+func (s *Server) deriveKeys(psk []byte) []byte {
+	// Derive a master key of 64 bytes (32 for AES + 32 for HMAC)
+	masterKey := pbkdf2.Key(psk, []byte(s.cfg.Crypto.PBKDF2Salt), s.cfg.Crypto.PBKDF2Iterations, KEY_LEN*2, sha256.New)
+
+	// Split the derived key (the halves are only used by the legacy format)
+	s.aesKey = masterKey[:KEY_LEN]
+	s.hmacKey = masterKey[KEY_LEN:]
 
-	log.Printf("⚙️  Executing: %s %v", name, args)
+	log.Printf("🔑 Derived AES key: %d bytes", len(s.aesKey))
+	log.Printf("🔑 Derived HMAC key: %d bytes", len(s.hmacKey))
+	return masterKey
+}
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("command '%s %v' failed: %w", name, args, err)
+// setupDataChannel loads the server's static key, derives the handshake PSK
+// and reads the accepted cipher suites. Clients propose suites during the
+// handshake and the server picks the first one it allows.
+func (s *Server) setupDataChannel(masterKey []byte) error {
+	var err error
+	if s.cfg.PrivateKey != "" {
+		if s.staticKey, err = parsePrivateKey(s.cfg.PrivateKey); err != nil {
+			return fmt.Errorf("invalid private key: %w", err)
+		}
+	} else {
+		var created bool
+		if s.staticKey, created, err = loadOrCreatePrivateKey(s.cfg.KeyFile); err != nil {
+			return err
+		}
+		if created {
+			log.Printf("🔑 Generated new server key in %s", s.cfg.KeyFile)
+		}
+	}
+
+	if s.handshakePSK, err = deriveHandshakePSK(masterKey); err != nil {
+		return err
+	}
+
+	s.legacyEnabled = s.cfg.Crypto.LegacyCFB
+	for _, suite := range s.cfg.Crypto.Ciphers {
+		if suite == suiteLegacyCFB {
+			s.legacyEnabled = true
+			continue
+		}
+		s.allowedSuites = append(s.allowedSuites, suite)
+		log.Printf("🔐 Data channel suite enabled: %s", suite)
+	}
+	if s.legacyEnabled {
+		log.Println("⚠️  Legacy AES-CFB + HMAC clients are accepted (legacy_cfb)")
 	}
 
 	return nil
 }
 
-// deriveKeys uses PBKDF2 to generate keys from PSK
-func deriveKeys(psk []byte) {
-	// Validate PSK length
-	if len(psk) != 32 {
-		log.Fatalf("❌ PSK must be exactly 32 bytes, got %d bytes", len(psk))
+// handleHandshake answers a client's handshake initiation and installs the
+// new session keys
+func (s *Server) handleHandshake(packet []byte, ep *endpoint) error {
+	hs, payload, err := consumeInitiation(s.staticKey, packet)
+	if err != nil {
+		return err
+	}
+
+	// Only registered peers get an answer
+	p, ok := s.lookupPeer(hs.remoteStatic)
+	if !ok {
+		return fmt.Errorf("unknown peer key %s", hs.remoteStatic)
 	}
 
-	// Derive a master key of 64 bytes (32 for AES + 32 for HMAC)
-	masterKey := pbkdf2.Key(psk, []byte(PBKDF2_SALT), PBKDF2_ITERATIONS, KEY_LEN*2, sha256.New)
+	var init handshakeInit
+	if err := json.Unmarshal(payload, &init); err != nil {
+		return fmt.Errorf("invalid handshake payload: %w", err)
+	}
+	suite, ok := selectCipherSuite(init.Suites, s.allowedSuites)
+	if !ok {
+		return fmt.Errorf("no common cipher suite in %v", init.Suites)
+	}
+	if init.Fragment != 0 && (init.Fragment < MIN_FRAGMENT_SIZE || init.Fragment > MAX_DATAGRAM_SIZE) {
+		return fmt.Errorf("fragment size %d out of range (%d-%d)", init.Fragment, MIN_FRAGMENT_SIZE, MAX_DATAGRAM_SIZE)
+	}
+
+	addrs, err := s.pool.lease(hs.remoteStatic)
+	if err != nil {
+		return err
+	}
+	tunnelIPs := make([]netip.Addr, len(addrs))
+	for i, prefix := range addrs {
+		tunnelIPs[i] = prefix.Addr()
+	}
+
+	index, err := s.sessions.allocateIndex()
+	if err != nil {
+		return err
+	}
+
+	response, err := json.Marshal(handshakeResponse{
+		Suite:     suite,
+		Addresses: addrs,
+		Routes:    s.cfg.PushRoutes,
+		DNS:       s.cfg.DNS,
+		Search:    s.cfg.DNSSearch,
+	})
+	if err != nil {
+		s.sessions.releaseIndex(index)
+		return err
+	}
+	msg, err := hs.createResponse(p.psk, index, response)
+	if err != nil {
+		s.sessions.releaseIndex(index)
+		return err
+	}
+	kp, err := hs.deriveKeypair(suite, false)
+	if err != nil {
+		s.sessions.releaseIndex(index)
+		return err
+	}
+
+	rekey, err := s.sessions.installKeypair(p, init.Timestamp, kp, tunnelIPs, init.Fragment)
+	if err != nil {
+		s.sessions.releaseIndex(index)
+		return err
+	}
+
+	// The peer may have been removed while the handshake was running
+	if current, ok := s.lookupPeer(p.static); !ok || current.psk != p.psk {
+		s.sessions.remove(p.static)
+		if !ok {
+			s.releaseLeases(*s.peers.Load())
+		}
+		return fmt.Errorf("peer %s was removed", p.name)
+	}
+
+	if _, err := ep.conn.WriteToUDP(msg, ep.addr); err != nil {
+		return fmt.Errorf("failed to send handshake response: %w", err)
+	}
+
+	if rekey {
+		debugf("🔄 Peer %s rekeyed from %s", p.name, ep)
+	} else {
+		log.Printf("🤝 Handshake completed with peer %s at %s (suite %s, IP %v)", p.name, ep, suite, tunnelIPs)
+	}
+	return nil
+}
+
+// openPacket authenticates and decrypts a client data packet, falling back to
+// the legacy format when it is enabled
+func (s *Server) openPacket(packet []byte, ep *endpoint) ([]byte, *clientSession, error) {
+	plaintext, sess, err := s.sessions.open(packet, ep)
+	if err == nil {
+		return plaintext, sess, nil
+	}
+	if !s.legacyEnabled {
+		return nil, nil, err
+	}
 
-	// Split the derived key
-	aesKey = masterKey[:KEY_LEN]
-	hmacKey = masterKey[KEY_LEN:]
+	plaintext, legacyErr := legacyOpen(s.aesKey, s.hmacKey, packet)
+	if legacyErr != nil {
+		return nil, nil, fmt.Errorf("%v (legacy: %v)", err, legacyErr)
+	}
+	return plaintext, s.sessions.legacySession(ep), nil
+}
 
-	log.Printf("🔑 Derived AES key: %d bytes", len(aesKey))
-	log.Printf("🔑 Derived HMAC key: %d bytes", len(hmacKey))
+// sealPacket encrypts a packet for a client with its session keys, or in the
+// legacy format when kp is nil
+func (s *Server) sealPacket(plaintext []byte, kp *keypair) ([]byte, error) {
+	if kp == nil {
+		return legacySeal(s.aesKey, s.hmacKey, plaintext)
+	}
+	return kp.seal(plaintext)
 }
 
-// setupTUN configures the virtual network interface
-func setupTUN() (*water.Interface, error) {
+// setupTUN configures the virtual network interface with the server's
+// tunnel addresses and MTU. A partial configuration is rolled back.
+func setupTUN(addrs []netip.Prefix, mtu int, journal *netJournal) (*water.Interface, error) {
 	// Create TUN interface
 	config := water.Config{
 		DeviceType: water.TUN,
@@ -141,177 +391,216 @@ func setupTUN() (*water.Interface, error) {
 	ifaceName := iface.Name()
 	log.Printf("📝 TUN interface created: %s", ifaceName)
 
-	// Configure IP address (Linux-specific commands)
-	if err := executeCommand("ip", "addr", "add", SERVER_IP, "dev", ifaceName); err != nil {
-		return nil, fmt.Errorf("failed to assign IP to TUN interface: %w", err)
-	}
-
-	// Bring interface up
-	if err := executeCommand("ip", "link", "set", "dev", ifaceName, "up"); err != nil {
-		return nil, fmt.Errorf("failed to bring up TUN interface: %w", err)
+	// Configure IP addresses and MTU, and bring interface up
+	if err := configureLink(journal, ifaceName, addrs, mtu); err != nil {
+		if rollbackErr := journal.rollback(); rollbackErr != nil {
+			log.Printf("⚠️  Failed to roll back TUN configuration: %v", rollbackErr)
+		}
+		iface.Close()
+		return nil, fmt.Errorf("failed to configure TUN interface: %w", err)
 	}
 
 	return iface, nil
 }
 
+// autoMTU derives the TUN MTU from the MTU of the interface clients arrive
+// on, which is assumed to be the egress interface. Clients may connect over
+// IPv6, so its larger header is always accounted for.
+func (s *Server) autoMTU() (int, error) {
+	link := s.cfg.NAT.Egress
+	if link == "" {
+		_, defaultLink, err := defaultRoute(false)
+		if err != nil {
+			if _, defaultLink, err = defaultRoute(true); err != nil {
+				return 0, err
+			}
+		}
+		link = defaultLink
+	}
+	underlay, err := linkMTU(link)
+	if err != nil {
+		return 0, err
+	}
+	mtu := tunnelMTU(underlay, true, s.legacyEnabled)
+	log.Printf("📏 TUN MTU %d: %s has MTU %d and the tunnel adds %d bytes", mtu, link, underlay, tunnelOverhead(true, s.legacyEnabled))
+	return mtu, nil
+}
+
 // handleIncomingPackets reads from UDP and writes to TUN after decrypting/authenticating
-func handleIncomingPackets(conn *net.UDPConn) {
-	buffer := make([]byte, BUFFER_SIZE)
+func (s *Server) handleIncomingPackets(conn *net.UDPConn) {
+	buffer := make([]byte, MAX_DATAGRAM_SIZE)
 
-	log.Println("🎯 Incoming packet handler ready (UDP -> TUN)")
+	log.Printf("🎯 Incoming packet handler ready on %s (UDP -> TUN)", conn.LocalAddr())
 
 	for {
 		// Read from UDP
 		n, addr, err := conn.ReadFromUDP(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			log.Printf("⚠️  Error reading from UDP: %v", err)
 			continue
 		}
 
-		// Track client address (use destination IP from decrypted packet as key)
-		// For now, use the first client as default
-		if _, exists := clientAddrs["default"]; !exists {
-			log.Printf("👤 New client connected from: %s", addr.String())
-			clientAddrs["default"] = addr
-		} else if clientAddrs["default"].String() != addr.String() {
-			log.Printf("👤 Client address updated: %s", addr.String())
-			clientAddrs["default"] = addr
+		packet := buffer[:n]
+		ep := &endpoint{conn: conn, addr: addr}
+
+		// Fragments are buffered until their frame is complete. A legacy
+		// packet may look like one by chance.
+		if messageType(packet) == MSG_TYPE_FRAGMENT {
+			frame, err := s.fragments.add(ep.String(), packet)
+			switch {
+			case err == nil && frame == nil:
+				continue
+			case err == nil:
+				packet = frame
+			case !s.legacyEnabled:
+				log.Printf("❌ Dropping fragment from %s: %v", addr.String(), err)
+				continue
+			}
 		}
 
-		// Process the packet
-		if n < HMAC_LEN {
-			log.Printf("⚠️  Packet too short (%d bytes), expected at least %d bytes for HMAC", n, HMAC_LEN)
-			continue
+		// Handshake initiations set up session keys
+		if messageType(packet) == MSG_TYPE_HANDSHAKE_INIT {
+			err := s.handleHandshake(packet, ep)
+			if err == nil {
+				continue
+			}
+			if !s.legacyEnabled {
+				log.Printf("❌ Handshake from %s failed: %v", addr.String(), err)
+				continue
+			}
 		}
 
-		packet := buffer[:n]
-
-		// Packet structure: [HMAC_TAG (32 bytes)][IV (16 bytes)][ENCRYPTED_DATA]
-		receivedHMAC := packet[:HMAC_LEN]
-		dataWithIV := packet[HMAC_LEN:]
+		// Authenticate and decrypt the packet
+		decryptedData, sess, err := s.openPacket(packet, ep)
+		if err != nil {
+			log.Printf("❌ Dropping packet from %s: %v", addr.String(), err)
+			continue
+		}
 
-		// Verify HMAC
-		if !verifyHMAC(dataWithIV, receivedHMAC) {
-			log.Printf("❌ HMAC verification failed for packet from %s", addr.String())
+		// Empty frames are keepalives that confirm new session keys
+		if len(decryptedData) == 0 {
+			continue
+		}
+		if isControl(decryptedData) {
+			s.handleControl(sess, decryptedData)
 			continue
 		}
 
-		// Decrypt the data
-		decryptedData, err := decrypt(dataWithIV)
-		if err != nil {
-			log.Printf("⚠️  Decryption failed: %v", err)
+		// Clients may only send from their own tunnel IP
+		src, _, ok := packetAddrs(decryptedData)
+		if !ok {
+			log.Printf("⚠️  Dropping non-IP packet from client %s", sess)
+			continue
+		}
+		if err := s.sessions.claimSource(sess, src); err != nil {
+			log.Printf("⚠️  Dropping packet from client %s: %v", sess, err)
 			continue
 		}
 
 		// Write decrypted packet to TUN interface
-		_, err = iface.Write(decryptedData)
+		_, err = s.iface.Write(decryptedData)
 		if err != nil {
 			log.Printf("⚠️  Failed to write to TUN interface: %v", err)
 			continue
 		}
 
-		log.Printf("✅ Processed packet: %d bytes encrypted -> %d bytes decrypted from %s",
+		debugf("✅ Processed packet: %d bytes encrypted -> %d bytes decrypted from %s",
 			n, len(decryptedData), addr.String())
 	}
 }
 
-// verifyHMAC checks if the received HMAC matches the computed HMAC
-func verifyHMAC(data, receivedHMAC []byte) bool {
-	mac := hmac.New(sha256.New, hmacKey)
-	mac.Write(data)
-	expectedHMAC := mac.Sum(nil)
-	return hmac.Equal(expectedHMAC, receivedHMAC)
-}
-
-// decrypt decrypts data using AES-256 CFB mode
-// Data format: [IV (16 bytes)][ENCRYPTED_DATA]
-func decrypt(data []byte) ([]byte, error) {
-	if len(data) < IV_LEN {
-		return nil, fmt.Errorf("data too short: need at least %d bytes for IV, got %d", IV_LEN, len(data))
+// handleControl answers a client's control message: path MTU probes get an
+// ack of the same size, keepalives an ack. Path MTU reports cap what is sent
+// to the client.
+func (s *Server) handleControl(sess *clientSession, msg []byte) {
+	var reply []byte
+	switch msg[0] {
+	case CONTROL_PMTU_REPORT:
+		mtu, err := parsePMTUReport(msg)
+		if err != nil {
+			log.Printf("⚠️  Ignoring path MTU report from client %s: %v", sess, err)
+			return
+		}
+		if sess.pathMTU.Swap(int64(mtu)) != int64(mtu) {
+			log.Printf("📏 Client %s reports path MTU %d", sess, mtu)
+		}
+		return
+	case CONTROL_PMTU_PROBE:
+		ack, err := pmtuAck(msg)
+		if err != nil {
+			log.Printf("⚠️  Ignoring path MTU probe from client %s: %v", sess, err)
+			return
+		}
+		reply = ack
+	case CONTROL_KEEPALIVE:
+		reply = []byte{CONTROL_KEEPALIVE_ACK}
+	case CONTROL_KEEPALIVE_ACK:
+		return // Receiving it was the point
+	default:
+		debugf("⚠️  Ignoring control message type %d from client %s", msg[0], sess)
+		return
 	}
-
-	// Extract IV and ciphertext
-	iv := data[:IV_LEN]
-	ciphertext := data[IV_LEN:]
-
-	// Create AES cipher block
-	block, err := aes.NewCipher(aesKey)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	if err := s.sendControl(sess, reply); err != nil {
+		log.Printf("⚠️  Failed to answer client %s: %v", sess, err)
 	}
-
-	// Decrypt using CFB mode
-	stream := cipher.NewCFBDecrypter(block, iv)
-	plaintext := make([]byte, len(ciphertext))
-	stream.XORKeyStream(plaintext, ciphertext)
-
-	return plaintext, nil
 }
 
-// encrypt encrypts data using AES-256 CFB mode (for potential client-to-server responses)
-// Returns: [IV][ENCRYPTED_DATA]
-func encrypt(plaintext []byte) ([]byte, error) {
-	// Create AES cipher block
-	block, err := aes.NewCipher(aesKey)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create cipher: %w", err)
+// sendControl sends a control message to a client under its session keys
+func (s *Server) sendControl(sess *clientSession, msg []byte) error {
+	kp, ep := sess.current.Load(), sess.endpoint.Load()
+	if sess.legacy || kp == nil || ep == nil {
+		return errors.New("no session keys")
 	}
-
-	// Generate random IV
-	iv := make([]byte, IV_LEN)
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		return nil, fmt.Errorf("failed to generate IV: %w", err)
+	frame, err := kp.seal(msg)
+	if err != nil {
+		return err
 	}
-
-	// Encrypt using CFB mode
-	ciphertext := make([]byte, len(plaintext))
-	stream := cipher.NewCFBEncrypter(block, iv)
-	stream.XORKeyStream(ciphertext, plaintext)
-
-	// Prepend IV to ciphertext
-	result := make([]byte, IV_LEN+len(ciphertext))
-	copy(result[:IV_LEN], iv)
-	copy(result[IV_LEN:], ciphertext)
-
-	return result, nil
-}
-
-// addHMAC adds HMAC tag to data
-// Returns: [HMAC_TAG][DATA]
-func addHMAC(data []byte) []byte {
-	mac := hmac.New(sha256.New, hmacKey)
-	mac.Write(data)
-	hmacTag := mac.Sum(nil)
-
-	result := make([]byte, HMAC_LEN+len(data))
-	copy(result[:HMAC_LEN], hmacTag)
-	copy(result[HMAC_LEN:], data)
-
-	return result
+	_, err = ep.conn.WriteToUDP(frame, ep.addr)
+	return err
 }
 
-// encryptAndAuthenticate performs both encryption and authentication
-// This is a helper function that combines encrypt and addHMAC
-func encryptAndAuthenticate(plaintext []byte) ([]byte, error) {
-	// First encrypt
-	encrypted, err := encrypt(plaintext)
-	if err != nil {
-		return nil, err
+// maintainSessions sends keepalives to clients that have been idle for the
+// keepalive interval, and expires the ones silent for the dead peer timeout
+func (s *Server) maintainSessions() {
+	ticker := time.NewTicker(KEEPALIVE_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if s.cfg.DeadPeerTimeout > 0 {
+			for _, sess := range s.sessions.expireIdle(s.cfg.DeadPeerTimeout) {
+				log.Printf("💀 Client %s expired after %s without traffic", sess, s.cfg.DeadPeerTimeout)
+			}
+		}
+		if s.cfg.Keepalive == 0 {
+			continue
+		}
+		for _, sess := range s.sessions.active() {
+			if sess.idle() < s.cfg.Keepalive || time.Since(time.Unix(0, sess.lastPing.Load())) < s.cfg.Keepalive {
+				continue
+			}
+			sess.lastPing.Store(time.Now().UnixNano())
+			if err := s.sendControl(sess, []byte{CONTROL_KEEPALIVE}); err != nil {
+				debugf("⚠️  Failed to send keepalive to client %s: %v", sess, err)
+			}
+		}
 	}
-
-	// Then add HMAC
-	return addHMAC(encrypted), nil
 }
 
 // handleOutgoingPackets reads from TUN and sends to UDP after encrypting/authenticating
-func handleOutgoingPackets(conn *net.UDPConn) {
-	buffer := make([]byte, BUFFER_SIZE)
+func (s *Server) handleOutgoingPackets() {
+	buffer := make([]byte, s.cfg.MTU)
 
 	log.Println("🎯 Outgoing packet handler ready (TUN -> UDP)")
 
 	for {
 		// Read from TUN interface
-		n, err := iface.Read(buffer)
+		n, err := s.iface.Read(buffer)
+		if errors.Is(err, os.ErrClosed) {
+			return
+		}
 		if err != nil {
 			log.Printf("⚠️  Error reading from TUN: %v", err)
 			continue
@@ -319,28 +608,42 @@ func handleOutgoingPackets(conn *net.UDPConn) {
 
 		packet := buffer[:n]
 
-		// Get client address (for now, send to the default client)
-		clientAddr, exists := clientAddrs["default"]
+		// Find the client that owns the destination address
+		_, dst, ok := packetAddrs(packet)
+		if !ok {
+			continue
+		}
+		sess, client, kp, exists := s.sessions.route(dst)
 		if !exists {
-			// No client connected yet, drop packet
+			// No client owns this address, drop packet
 			continue
 		}
 
 		// Encrypt and authenticate the packet
-		encryptedPacket, err := encryptAndAuthenticate(packet)
+		encryptedPacket, err := s.sealPacket(packet, kp)
 		if err != nil {
 			log.Printf("⚠️  Failed to encrypt packet: %v", err)
 			continue
 		}
 
-		// Send to client
-		_, err = conn.WriteToUDP(encryptedPacket, clientAddr)
+		// Send to client, in fragments if it asked for them or the frame
+		// does not fit its path MTU
+		datagrams, err := fragmentFrame(encryptedPacket, sess.maxDatagram())
+		if err != nil {
+			log.Printf("⚠️  Failed to fragment packet for client %s: %v", sess, err)
+			continue
+		}
+		for _, datagram := range datagrams {
+			if _, err = client.conn.WriteToUDP(datagram, client.addr); err != nil {
+				break
+			}
+		}
 		if err != nil {
 			log.Printf("⚠️  Failed to send packet to client: %v", err)
 			continue
 		}
 
-		log.Printf("📤 Sent packet: %d bytes plaintext -> %d bytes encrypted to %s",
-			n, len(encryptedPacket), clientAddr.String())
+		debugf("📤 Sent packet: %d bytes plaintext -> %d bytes encrypted to %s",
+			n, len(encryptedPacket), client)
 	}
 }
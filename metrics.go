@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// Process-wide counters, logged on SIGUSR1 (kill -USR1 <pid>)
+var metrics struct {
+	replayDrops atomic.Uint64 // Authenticated frames rejected as duplicates or too old
+	tunMTU      atomic.Int64  // Current TUN MTU
+	pathMTU     atomic.Int64  // Largest probe the peer acked in the last search, 0 if none
+}
+
+// logMetrics writes the current counters to the log
+func logMetrics() {
+	status := fmt.Sprintf("replay drops=%d, TUN MTU=%d", metrics.replayDrops.Load(), metrics.tunMTU.Load())
+	if pathMTU := metrics.pathMTU.Load(); pathMTU != 0 {
+		status += fmt.Sprintf(", path MTU=%d", pathMTU)
+	}
+	log.Printf("📊 Status: %s", status)
+}
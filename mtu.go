@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// Header sizes: the underlay's IP and UDP headers in front of every tunnel
+// frame, and the TCP header the MSS clamp leaves room for
+const (
+	IPV4_HEADER_LEN = 20
+	IPV6_HEADER_LEN = 40
+	UDP_HEADER_LEN  = 8
+	TCP_HEADER_LEN  = 20
+
+	// Smallest MTU of a link carrying IPv6
+	IPV6_MIN_MTU = 1280
+
+	// Largest UDP payload; receive buffers are this big so no datagram is
+	// ever truncated
+	MAX_DATAGRAM_SIZE = 65535
+)
+
+// tunnelOverhead is what carrying one packet adds on the wire: the IP and
+// UDP headers of the underlay plus the data frame, or the legacy format's
+// when legacy is set
+func tunnelOverhead(ipv6, legacy bool) int {
+	overhead := IPV4_HEADER_LEN + UDP_HEADER_LEN
+	if ipv6 {
+		overhead = IPV6_HEADER_LEN + UDP_HEADER_LEN
+	}
+	if legacy {
+		return overhead + max(FRAME_OVERHEAD, LEGACY_OVERHEAD)
+	}
+	return overhead + FRAME_OVERHEAD
+}
+
+// tunnelMTU is the largest packet the tunnel carries over an underlay link
+// with the given MTU without the frames being fragmented
+func tunnelMTU(underlayMTU int, ipv6, legacy bool) int {
+	return max(underlayMTU-tunnelOverhead(ipv6, legacy), MIN_MTU)
+}
+
+// linkMTU returns the MTU of a network interface
+func linkMTU(name string) (int, error) {
+	link, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find interface %s: %w", name, err)
+	}
+	return link.MTU, nil
+}
+
+// tcpMSS is the largest TCP segment that fits a packet of the given MTU
+func tcpMSS(mtu int, ipv6 bool) uint16 {
+	if ipv6 {
+		return uint16(mtu - IPV6_HEADER_LEN - TCP_HEADER_LEN)
+	}
+	return uint16(mtu - IPV4_HEADER_LEN - TCP_HEADER_LEN)
+}
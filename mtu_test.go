@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestTunnelMTU(t *testing.T) {
+	tests := []struct {
+		name        string
+		underlayMTU int
+		ipv6        bool
+		legacy      bool
+		overhead    int
+		mtu         int
+	}{
+		{"ipv4 underlay", 1500, false, false, 60, 1440},
+		{"ipv6 underlay", 1500, true, false, 80, 1420},
+		{"legacy framing", 1500, false, true, 76, 1424},
+		{"legacy over ipv6", 1500, true, true, 96, 1404},
+		{"pppoe", 1492, false, false, 60, 1432},
+		{"jumbo frames", 9000, false, false, 60, 8940},
+		{"tiny underlay", 600, true, false, 80, MIN_MTU},
+	}
+	for _, tt := range tests {
+		if got := tunnelOverhead(tt.ipv6, tt.legacy); got != tt.overhead {
+			t.Errorf("%s: overhead %d, want %d", tt.name, got, tt.overhead)
+		}
+		if got := tunnelMTU(tt.underlayMTU, tt.ipv6, tt.legacy); got != tt.mtu {
+			t.Errorf("%s: tunnel MTU %d, want %d", tt.name, got, tt.mtu)
+		}
+	}
+}
+
+// A clamped SYN leaves room for the IP and TCP headers inside the tunnel
+func TestTCPMSS(t *testing.T) {
+	tests := []struct {
+		mtu  int
+		ipv6 bool
+		want uint16
+	}{
+		{1440, false, 1400},
+		{1440, true, 1380},
+		{1280, true, 1220},
+		{MIN_MTU, false, 536},
+	}
+	for _, tt := range tests {
+		if got := tcpMSS(tt.mtu, tt.ipv6); got != tt.want {
+			t.Errorf("tcpMSS(%d, ipv6 %v) = %d, want %d", tt.mtu, tt.ipv6, got, tt.want)
+		}
+	}
+}
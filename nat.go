@@ -0,0 +1,236 @@
+//go:build !client
+// +build !client
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"os/exec"
+	"strconv"
+)
+
+// NAT backends. auto uses nftables and falls back to iptables when the
+// kernel or container has no nftables support.
+const (
+	NAT_BACKEND_AUTO     = "auto"
+	NAT_BACKEND_NFTABLES = "nftables"
+	NAT_BACKEND_IPTABLES = "iptables"
+)
+
+// How the IPv6 pool reaches the internet. nat66 masquerades it like the
+// IPv4 pool; routed only forwards, for a globally routed prefix whose
+// route points at the server.
+const (
+	NAT6_MODE_NAT66  = "nat66"
+	NAT6_MODE_ROUTED = "routed"
+)
+
+// Kernel switches that let the server forward client traffic
+const (
+	SYSCTL_IPV4_FORWARD = "/proc/sys/net/ipv4/ip_forward"
+	SYSCTL_IPV6_FORWARD = "/proc/sys/net/ipv6/conf/all/forwarding"
+)
+
+type natConfig struct {
+	Enabled bool   `yaml:"enabled"` // Manage forwarding and NAT for the pool
+	Egress  string `yaml:"egress"`  // Interface client traffic leaves through, default: the default route's
+	SNAT    string `yaml:"snat"`    // Fixed source address instead of masquerading
+	Backend string `yaml:"backend"` // auto, nftables or iptables
+	IPv6    string `yaml:"ipv6"`    // nat66 or routed, for pool6
+
+	// Lower the MSS of TCP connections through the tunnel to what fits the
+	// TUN MTU, for paths where PMTU discovery is broken. Unset means on.
+	MSSClamp *bool `yaml:"mss_clamp"`
+}
+
+// mssClamp reports whether TCP MSS clamping is on
+func (cfg natConfig) mssClamp() bool {
+	return cfg.MSSClamp == nil || *cfg.MSSClamp
+}
+
+// validate checks the NAT settings
+func (cfg natConfig) validate() error {
+	switch cfg.Backend {
+	case NAT_BACKEND_AUTO, NAT_BACKEND_NFTABLES, NAT_BACKEND_IPTABLES:
+	default:
+		return fmt.Errorf("unknown nat backend %q (use %s, %s or %s)", cfg.Backend, NAT_BACKEND_AUTO, NAT_BACKEND_NFTABLES, NAT_BACKEND_IPTABLES)
+	}
+	if cfg.IPv6 != NAT6_MODE_NAT66 && cfg.IPv6 != NAT6_MODE_ROUTED {
+		return fmt.Errorf("unknown nat ipv6 mode %q (use %s or %s)", cfg.IPv6, NAT6_MODE_NAT66, NAT6_MODE_ROUTED)
+	}
+	if cfg.SNAT != "" {
+		addr, err := netip.ParseAddr(cfg.SNAT)
+		if err != nil {
+			return fmt.Errorf("invalid nat snat address: %w", err)
+		}
+		if !addr.Is4() {
+			return fmt.Errorf("nat snat address %s must be IPv4", addr)
+		}
+	}
+	return nil
+}
+
+// setupNAT enables forwarding and NATs the IPv4 pool out of the egress
+// interface, then sets up the IPv6 pool if there is one. Every change is
+// recorded in s.netChanges and reverted on shutdown.
+func (s *Server) setupNAT() error {
+	cfg := s.cfg.NAT
+	egress := cfg.Egress
+	if egress == "" {
+		_, link, err := defaultRoute(false)
+		if err != nil {
+			return fmt.Errorf("failed to detect egress interface (set nat.egress): %w", err)
+		}
+		egress = link
+	}
+	var snat netip.Addr
+	if cfg.SNAT != "" {
+		snat = netip.MustParseAddr(cfg.SNAT)
+	}
+	if cfg.mssClamp() {
+		log.Printf("📏 Clamping the TCP MSS of forwarded connections to the TUN MTU %d", s.cfg.MTU)
+	}
+
+	if err := s.netChanges.setSysctl(SYSCTL_IPV4_FORWARD, "1"); err != nil {
+		return err
+	}
+	if s.pool.prefix6.IsValid() {
+		if err := s.netChanges.setSysctl(SYSCTL_IPV6_FORWARD, "1"); err != nil {
+			return err
+		}
+	}
+
+	subnet := s.pool.prefix4
+	tun := s.iface.Name()
+	backend := cfg.Backend
+	if backend != NAT_BACKEND_IPTABLES {
+		err := s.netChanges.replaceNftTable("ip", NFT_TABLE, nftNATRules(subnet, tun, egress, snat, s.clampMSS(false)))
+		if err == nil {
+			backend = NAT_BACKEND_NFTABLES
+		} else if backend == NAT_BACKEND_NFTABLES {
+			return err
+		} else if _, lookErr := exec.LookPath("iptables"); lookErr != nil {
+			return fmt.Errorf("%w (and iptables is not installed)", err)
+		} else {
+			log.Printf("⚠️  nftables unavailable, falling back to iptables: %v", err)
+			backend = NAT_BACKEND_IPTABLES
+		}
+	}
+	if backend == NAT_BACKEND_IPTABLES {
+		if err := s.setupIptablesNAT(subnet, tun, egress, snat); err != nil {
+			return err
+		}
+	}
+
+	target := "masquerade"
+	if snat.IsValid() {
+		target = "snat to " + snat.String()
+	}
+	log.Printf("✅ NAT enabled with %s: %s -> %s (%s)", backend, subnet, egress, target)
+
+	if s.pool.prefix6.IsValid() {
+		return s.setupNAT6(backend)
+	}
+	return nil
+}
+
+// setupNAT6 forwards the IPv6 pool with the backend the IPv4 pool uses, and
+// masquerades it in nat66 mode
+func (s *Server) setupNAT6(backend string) error {
+	cfg := s.cfg.NAT
+	subnet := s.pool.prefix6
+	tun := s.iface.Name()
+
+	// An empty egress only accepts forwarding
+	egress := ""
+	if cfg.IPv6 == NAT6_MODE_NAT66 {
+		egress = cfg.Egress
+		if egress == "" {
+			_, link, err := defaultRoute(true)
+			if err != nil {
+				log.Printf("⚠️  No IPv6 default route, IPv6 clients can only reach the server: %v", err)
+				return nil
+			}
+			egress = link
+		}
+	}
+
+	var err error
+	if backend == NAT_BACKEND_NFTABLES {
+		err = s.netChanges.replaceNftTable("ip6", NFT_TABLE, nftNATRules(subnet, tun, egress, netip.Addr{}, s.clampMSS(true)))
+	} else {
+		err = s.setupIptablesNAT(subnet, tun, egress, netip.Addr{})
+	}
+	if err != nil {
+		return err
+	}
+
+	if egress == "" {
+		log.Printf("✅ IPv6 forwarding enabled with %s: %s is routed", backend, subnet)
+	} else {
+		log.Printf("✅ NAT66 enabled with %s: %s -> %s (masquerade)", backend, subnet, egress)
+	}
+	return nil
+}
+
+// clampMSS is the MSS forwarded TCP connections are clamped to, or 0 if
+// clamping is off
+func (s *Server) clampMSS(ipv6 bool) uint16 {
+	if !s.cfg.NAT.mssClamp() {
+		return 0
+	}
+	return tcpMSS(s.cfg.MTU, ipv6)
+}
+
+// setupIptablesNAT installs the NAT and forwarding rules with iptables, or
+// ip6tables for an IPv6 subnet. Without an egress interface only the
+// forwarding rules are installed. Rules that already exist, e.g. from
+// setup-server.sh, are left alone and not removed on shutdown.
+func (s *Server) setupIptablesNAT(subnet netip.Prefix, tun, egress string, snat netip.Addr) error {
+	iptables := "iptables"
+	if subnet.Addr().Is6() {
+		iptables = "ip6tables"
+	}
+	rules := [][]string{
+		{"FORWARD", "-i", tun, "-j", "ACCEPT"},
+		{"FORWARD", "-o", tun, "-j", "ACCEPT"},
+	}
+	if mss := s.clampMSS(subnet.Addr().Is6()); mss != 0 {
+		for _, dir := range []string{"-i", "-o"} {
+			rules = append(rules, []string{"-t", "mangle", "FORWARD", dir, tun, "-p", "tcp", "--tcp-flags", "SYN,RST", "SYN", "-j", "TCPMSS", "--set-mss", strconv.Itoa(int(mss))})
+		}
+	}
+	switch {
+	case egress == "":
+	case snat.IsValid():
+		rules = append(rules, []string{"-t", "nat", "POSTROUTING", "-s", subnet.String(), "-o", egress, "-j", "SNAT", "--to-source", snat.String()})
+	default:
+		rules = append(rules, []string{"-t", "nat", "POSTROUTING", "-s", subnet.String(), "-o", egress, "-j", "MASQUERADE"})
+	}
+
+	for _, rule := range rules {
+		if exec.Command(iptables, iptablesArgs("-C", rule)...).Run() == nil {
+			log.Printf("⚠️  %s rule %v already exists, leaving it in place", iptables, rule)
+			continue
+		}
+		// Forwarding rules go first so they win over a DROP further down
+		action := "-A"
+		if rule[0] == "FORWARD" {
+			action = "-I"
+		}
+		if err := s.netChanges.runCommand(append([]string{iptables}, iptablesArgs("-D", rule)...), iptables, iptablesArgs(action, rule)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// iptablesArgs puts the action before the chain, after an optional -t table
+func iptablesArgs(action string, rule []string) []string {
+	if rule[0] == "-t" {
+		return append([]string{rule[0], rule[1], action}, rule[2:]...)
+	}
+	return append([]string{action}, rule...)
+}
@@ -0,0 +1,73 @@
+//go:build !client
+// +build !client
+
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestNATConfigValidate(t *testing.T) {
+	valid := natConfig{Enabled: true, Backend: NAT_BACKEND_AUTO, IPv6: NAT6_MODE_NAT66}
+	tests := []struct {
+		name string
+		edit func(cfg *natConfig)
+		ok   bool
+	}{
+		{"defaults", func(cfg *natConfig) {}, true},
+		{"iptables", func(cfg *natConfig) { cfg.Backend = NAT_BACKEND_IPTABLES }, true},
+		{"routed ipv6", func(cfg *natConfig) { cfg.IPv6 = NAT6_MODE_ROUTED }, true},
+		{"snat", func(cfg *natConfig) { cfg.SNAT = "203.0.113.1" }, true},
+		{"unknown backend", func(cfg *natConfig) { cfg.Backend = "pf" }, false},
+		{"no backend", func(cfg *natConfig) { cfg.Backend = "" }, false},
+		{"unknown ipv6 mode", func(cfg *natConfig) { cfg.IPv6 = "nat64" }, false},
+		{"bad snat", func(cfg *natConfig) { cfg.SNAT = "eth0" }, false},
+		{"ipv6 snat", func(cfg *natConfig) { cfg.SNAT = "2001:db8::1" }, false},
+	}
+	for _, tt := range tests {
+		cfg := valid
+		tt.edit(&cfg)
+		if err := cfg.validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+// The MSS clamp is on unless turned off, and follows the IP version
+func TestClampMSS(t *testing.T) {
+	on, off := true, false
+	tests := []struct {
+		clamp *bool
+		ipv6  bool
+		want  uint16
+	}{
+		{nil, false, 1360},
+		{&on, false, 1360},
+		{&on, true, 1340},
+		{&off, false, 0},
+		{&off, true, 0},
+	}
+	for _, tt := range tests {
+		s := &Server{cfg: &serverConfig{MTU: 1400, NAT: natConfig{MSSClamp: tt.clamp}}}
+		if got := s.clampMSS(tt.ipv6); got != tt.want {
+			t.Errorf("mss_clamp %v, ipv6 %v: clamp to %d, want %d", tt.clamp != nil && *tt.clamp, tt.ipv6, got, tt.want)
+		}
+	}
+}
+
+func TestIptablesArgs(t *testing.T) {
+	tests := []struct {
+		action string
+		rule   []string
+		want   []string
+	}{
+		{"-I", []string{"FORWARD", "-i", "tun0", "-j", "ACCEPT"}, []string{"-I", "FORWARD", "-i", "tun0", "-j", "ACCEPT"}},
+		{"-D", []string{"-t", "nat", "POSTROUTING", "-j", "MASQUERADE"}, []string{"-t", "nat", "-D", "POSTROUTING", "-j", "MASQUERADE"}},
+	}
+	for _, tt := range tests {
+		if got := iptablesArgs(tt.action, tt.rule); !slices.Equal(got, tt.want) {
+			t.Errorf("iptablesArgs(%s, %v) = %v, want %v", tt.action, tt.rule, got, tt.want)
+		}
+	}
+}
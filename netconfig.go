@@ -0,0 +1,888 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// Kinds of network changes recorded in a netJournal
+const (
+	NET_CHANGE_ADDR      = "addr"
+	NET_CHANGE_MTU       = "mtu"
+	NET_CHANGE_LINK_UP   = "link-up"
+	NET_CHANGE_ROUTE     = "route"
+	NET_CHANGE_RULE      = "rule" // Policy routing rule
+	NET_CHANGE_SYSCTL    = "sysctl"
+	NET_CHANGE_NFT_TABLE = "nft-table" // Our nftables table in one family
+	NET_CHANGE_RESOLVED  = "resolved"  // systemd-resolved DNS settings of a link
+	NET_CHANGE_FILE      = "file"      // File replaced, original kept in a backup
+	NET_CHANGE_COMMAND   = "command"   // Platforms without netlink, and iptables
+)
+
+// errLinkNotFound is returned when a change names an interface that does
+// not exist (any more)
+var errLinkNotFound = errors.New("link not found")
+
+// netConfigError reports a failed network configuration change. Err is the
+// underlying netlink or command error, so errors.Is works with errnos, e.g.
+// os.ErrExist for a route that is already there.
+type netConfigError struct {
+	Op     string // "add route", "set mtu", ...
+	Target string // The address, route or interface being changed
+	Err    error
+}
+
+func (e *netConfigError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Target, e.Err)
+}
+
+func (e *netConfigError) Unwrap() error {
+	return e.Err
+}
+
+// netError wraps a netlink error in a netConfigError
+func netError(op, target string, err error) error {
+	var notFound netlink.LinkNotFoundError
+	if errors.As(err, &notFound) {
+		err = errLinkNotFound
+	}
+	return &netConfigError{Op: op, Target: target, Err: err}
+}
+
+// netChange is one network change that was applied, with what is needed to
+// undo it
+type netChange struct {
+	Kind    string       `json:"kind"`
+	Link    string       `json:"link,omitempty"`
+	Prefix  netip.Prefix `json:"prefix,omitempty"`
+	Gateway netip.Addr   `json:"gateway,omitempty"`
+	Source  netip.Addr   `json:"source,omitempty"`   // Preferred source address of a route
+	MTU     int          `json:"mtu,omitempty"`      // MTU before the change
+	Sysctl  string       `json:"sysctl,omitempty"`   // Path under /proc/sys
+	Value   string       `json:"value,omitempty"`    // Sysctl value before the change
+	Family  string       `json:"family,omitempty"`   // nftables or rule family: ip, ip6 or inet
+	NftName string       `json:"nft_name,omitempty"` // nftables table, empty for NFT_TABLE
+	Undo    []string     `json:"undo,omitempty"`     // Command that reverts a NET_CHANGE_COMMAND
+	File    string       `json:"file,omitempty"`     // Replaced file, e.g. /etc/resolv.conf
+	Backup  string       `json:"backup,omitempty"`   // Where the original file was moved
+
+	// Policy routing: the table of a route or rule, and what a rule matches
+	Table    int    `json:"table,omitempty"`    // Routing table, 0 for main
+	Priority int    `json:"priority,omitempty"` // Rule priority
+	Mark     uint32 `json:"mark,omitempty"`     // Rule matches packets without this fwmark
+	Suppress bool   `json:"suppress,omitempty"` // Rule ignores default routes (suppress_prefixlength 0)
+}
+
+// nftName is the nftables table of a NET_CHANGE_NFT_TABLE
+func (c netChange) nftName() string {
+	if c.NftName == "" {
+		return NFT_TABLE
+	}
+	return c.NftName
+}
+
+// validate checks that a change has what reverting it needs, e.g. one read
+// from a truncated or hand-edited state file
+func (c netChange) validate() error {
+	var missing string
+	switch c.Kind {
+	case NET_CHANGE_ADDR:
+		if c.Link == "" || !c.Prefix.IsValid() {
+			missing = "link or prefix"
+		}
+	case NET_CHANGE_MTU:
+		if c.Link == "" || c.MTU <= 0 {
+			missing = "link or mtu"
+		}
+	case NET_CHANGE_LINK_UP, NET_CHANGE_RESOLVED:
+		if c.Link == "" {
+			missing = "link"
+		}
+	case NET_CHANGE_ROUTE:
+		if !c.Prefix.IsValid() {
+			missing = "prefix"
+		}
+	case NET_CHANGE_RULE, NET_CHANGE_NFT_TABLE:
+		if c.Family == "" {
+			missing = "family"
+		}
+	case NET_CHANGE_SYSCTL:
+		if !strings.HasPrefix(c.Sysctl, "/proc/sys/") {
+			return fmt.Errorf("sysctl %q is not under /proc/sys", c.Sysctl)
+		}
+	case NET_CHANGE_FILE:
+		if c.File == "" || c.Backup == "" {
+			missing = "file or backup"
+		}
+	case NET_CHANGE_COMMAND:
+		if len(c.Undo) == 0 || c.Undo[0] == "" {
+			missing = "undo command"
+		}
+	default:
+		return fmt.Errorf("unknown change kind %q", c.Kind)
+	}
+	if missing != "" {
+		return fmt.Errorf("%s change without %s", c.Kind, missing)
+	}
+	return nil
+}
+
+func (c netChange) String() string {
+	switch c.Kind {
+	case NET_CHANGE_ADDR:
+		return fmt.Sprintf("address %s on %s", c.Prefix, c.Link)
+	case NET_CHANGE_MTU:
+		return fmt.Sprintf("mtu of %s (was %d)", c.Link, c.MTU)
+	case NET_CHANGE_LINK_UP:
+		return fmt.Sprintf("link %s up", c.Link)
+	case NET_CHANGE_ROUTE:
+		route := fmt.Sprintf("route %s", c.Prefix)
+		if c.Gateway.IsValid() {
+			route += " via " + c.Gateway.String()
+		}
+		route += " dev " + c.Link
+		if c.Source.IsValid() {
+			route += " src " + c.Source.String()
+		}
+		if c.Table != 0 {
+			route += fmt.Sprintf(" table %d", c.Table)
+		}
+		return route
+	case NET_CHANGE_RULE:
+		rule := fmt.Sprintf("%s rule %d:", c.Family, c.Priority)
+		if c.Mark != 0 {
+			rule += fmt.Sprintf(" not fwmark %#x", c.Mark)
+		}
+		table := "main"
+		if c.Table != 0 {
+			table = fmt.Sprint(c.Table)
+		}
+		rule += " lookup " + table
+		if c.Suppress {
+			rule += " suppress_prefixlength 0"
+		}
+		return rule
+	case NET_CHANGE_SYSCTL:
+		return fmt.Sprintf("sysctl %s (was %s)", c.Sysctl, c.Value)
+	case NET_CHANGE_NFT_TABLE:
+		return fmt.Sprintf("nftables table %s %s", c.Family, c.nftName())
+	case NET_CHANGE_RESOLVED:
+		return fmt.Sprintf("systemd-resolved DNS on %s", c.Link)
+	case NET_CHANGE_FILE:
+		return fmt.Sprintf("file %s (original in %s)", c.File, c.Backup)
+	default:
+		return fmt.Sprintf("command (undo: %s)", strings.Join(c.Undo, " "))
+	}
+}
+
+// netJournal applies network changes and records each one, so that
+// rollback can revert exactly those changes and nothing else. With a state
+// file, every change is written to it before it is applied, so a client
+// that crashes or is killed can revert its changes on the next start.
+type netJournal struct {
+	mu      sync.Mutex
+	changes []netChange
+	path    string // State file, empty to keep the journal in memory only
+}
+
+// netJournalState is the state file's content
+type netJournalState struct {
+	PID     int         `json:"pid"` // Process that made the changes
+	Changes []netChange `json:"changes"`
+}
+
+// open attaches a state file to the journal and loads the changes a previous
+// run left behind, which the caller should roll back. It fails if the
+// process that wrote the file is still running.
+func (j *netJournal) open(path string) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.path = path
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	var state netJournalState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return 0, fmt.Errorf("failed to parse state file %s: %w", path, err)
+	}
+	if state.PID != os.Getpid() && processAlive(state.PID) {
+		return 0, fmt.Errorf("state file %s belongs to a running client (pid %d)", path, state.PID)
+	}
+
+	// Malformed entries cannot be reverted; they are left out of the journal
+	// and so dropped from the file on its next save
+	var changes []netChange
+	for i, change := range state.Changes {
+		if err := change.validate(); err != nil {
+			log.Printf("⚠️  Skipping entry %d of state file %s: %v", i+1, path, err)
+			continue
+		}
+		changes = append(changes, change)
+	}
+	j.changes = append(changes, j.changes...)
+	return len(changes), nil
+}
+
+// save writes the journal to the state file, or removes the file once the
+// journal is empty. The caller holds j.mu.
+func (j *netJournal) save() error {
+	if j.path == "" {
+		return nil
+	}
+	if len(j.changes) == 0 {
+		if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove state file: %w", err)
+		}
+		return nil
+	}
+
+	data, err := json.MarshalIndent(netJournalState{PID: os.Getpid(), Changes: j.changes}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(j.path), 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	return nil
+}
+
+// apply journals change, then makes it with do. The change reaches the
+// state file before do runs; if do fails, it is dropped again.
+func (j *netJournal) apply(change netChange, do func() error) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.changes = append(j.changes, change)
+	if err := j.save(); err != nil {
+		j.changes = j.changes[:len(j.changes)-1]
+		return err
+	}
+	if err := do(); err != nil {
+		j.changes = j.changes[:len(j.changes)-1]
+		if saveErr := j.save(); saveErr != nil {
+			log.Printf("⚠️  %v", saveErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// addAddress assigns an address to an interface
+func (j *netJournal) addAddress(name string, prefix netip.Prefix) error {
+	log.Printf("⚙️  Adding address %s to %s", prefix, name)
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return netError("add address", name, err)
+	}
+	return j.apply(netChange{Kind: NET_CHANGE_ADDR, Link: name, Prefix: prefix}, func() error {
+		if err := netlink.AddrAdd(link, &netlink.Addr{IPNet: prefixIPNet(prefix)}); err != nil {
+			return netError("add address", prefix.String(), err)
+		}
+		return nil
+	})
+}
+
+// setMTU changes an interface's MTU
+func (j *netJournal) setMTU(name string, mtu int) error {
+	log.Printf("⚙️  Setting MTU of %s to %d", name, mtu)
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return netError("set mtu", name, err)
+	}
+	previous := link.Attrs().MTU
+	if previous == mtu {
+		return nil
+	}
+	return j.apply(netChange{Kind: NET_CHANGE_MTU, Link: name, MTU: previous}, func() error {
+		if err := netlink.LinkSetMTU(link, mtu); err != nil {
+			return netError("set mtu", name, err)
+		}
+		return nil
+	})
+}
+
+// setLinkMTU changes an interface's MTU without recording it, for
+// interfaces that go away with the process
+func setLinkMTU(name string, mtu int) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return netError("set mtu", name, err)
+	}
+	if err := netlink.LinkSetMTU(link, mtu); err != nil {
+		return netError("set mtu", name, err)
+	}
+	return nil
+}
+
+// setLinkUp brings an interface up
+func (j *netJournal) setLinkUp(name string) error {
+	log.Printf("⚙️  Bringing %s up", name)
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return netError("set link up", name, err)
+	}
+	if link.Attrs().Flags&net.FlagUp != 0 {
+		return nil
+	}
+	return j.apply(netChange{Kind: NET_CHANGE_LINK_UP, Link: name}, func() error {
+		if err := netlink.LinkSetUp(link); err != nil {
+			return netError("set link up", name, err)
+		}
+		return nil
+	})
+}
+
+// addRoute adds a route through an interface, via gateway if it is valid
+func (j *netJournal) addRoute(prefix netip.Prefix, name string, gateway netip.Addr, table int) error {
+	change := netChange{Kind: NET_CHANGE_ROUTE, Link: name, Prefix: prefix, Gateway: gateway, Table: table}
+	log.Printf("⚙️  Adding %s", change)
+	route, err := netlinkRoute(change)
+	if err != nil {
+		return err
+	}
+	return j.apply(change, func() error {
+		if err := netlink.RouteAdd(route); err != nil {
+			return netError("add route", prefix.String(), err)
+		}
+		return nil
+	})
+}
+
+// addUnderlayRoute adds a route that follows an underlay route, including
+// its preferred source address
+func (j *netJournal) addUnderlayRoute(prefix netip.Prefix, via underlayRoute) (netChange, error) {
+	change := netChange{Kind: NET_CHANGE_ROUTE, Link: via.Link, Prefix: prefix, Gateway: via.Gateway, Source: via.Source}
+	log.Printf("⚙️  Adding %s", change)
+	route, err := netlinkRoute(change)
+	if err != nil {
+		return change, err
+	}
+	return change, j.apply(change, func() error {
+		if err := netlink.RouteAdd(route); err != nil {
+			return netError("add route", prefix.String(), err)
+		}
+		return nil
+	})
+}
+
+// replaceRoute swaps a journaled route for another one to the same prefix,
+// e.g. to re-pin the server route when the underlay changes. The new route
+// is journaled before it replaces the old one in the kernel.
+func (j *netJournal) replaceRoute(old, change netChange) error {
+	log.Printf("⚙️  Replacing %s with %s", old, change)
+	route, err := netlinkRoute(change)
+	if err != nil {
+		return err
+	}
+	err = j.apply(change, func() error {
+		if err := netlink.RouteReplace(route); err != nil {
+			return netError("replace route", change.Prefix.String(), err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for i := len(j.changes) - 2; i >= 0; i-- {
+		if reflect.DeepEqual(j.changes[i], old) {
+			j.changes = append(j.changes[:i], j.changes[i+1:]...)
+			break
+		}
+	}
+	return j.save()
+}
+
+// addMarkRule adds a rule that looks up table for every packet of the
+// family (ip or ip6) that does not carry mark
+func (j *netJournal) addMarkRule(family string, priority, table int, mark uint32) error {
+	return j.addRule(netChange{Kind: NET_CHANGE_RULE, Family: family, Priority: priority, Table: table, Mark: mark})
+}
+
+// addSuppressRule adds a rule that looks up the main table but ignores its
+// default routes, so every more specific main route keeps working
+func (j *netJournal) addSuppressRule(family string, priority int) error {
+	return j.addRule(netChange{Kind: NET_CHANGE_RULE, Family: family, Priority: priority, Suppress: true})
+}
+
+func (j *netJournal) addRule(change netChange) error {
+	log.Printf("⚙️  Adding %s", change)
+	return j.apply(change, func() error {
+		if err := ruleAdd(change); err != nil {
+			return netError("add rule", change.String(), err)
+		}
+		return nil
+	})
+}
+
+// setSysctl writes a kernel setting under /proc/sys
+func (j *netJournal) setSysctl(path, value string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return &netConfigError{Op: "read sysctl", Target: path, Err: err}
+	}
+	previous := strings.TrimSpace(string(data))
+	if previous == value {
+		return nil
+	}
+	log.Printf("⚙️  Setting %s to %s", path, value)
+	return j.apply(netChange{Kind: NET_CHANGE_SYSCTL, Sysctl: path, Value: previous}, func() error {
+		if err := os.WriteFile(path, []byte(value+"\n"), 0644); err != nil {
+			return &netConfigError{Op: "write sysctl", Target: path, Err: err}
+		}
+		return nil
+	})
+}
+
+// setLinkDNS points systemd-resolved at servers for queries through link,
+// with domains as the link's search and routing domains. resolved forgets
+// the settings when the link goes away; reverting drops them earlier.
+func (j *netJournal) setLinkDNS(name string, servers []netip.Addr, domains []string) error {
+	change := netChange{Kind: NET_CHANGE_RESOLVED, Link: name}
+	log.Printf("⚙️  Setting %s to %v %v", change, servers, domains)
+	return j.apply(change, func() error {
+		args := []string{"dns", name}
+		for _, server := range servers {
+			args = append(args, server.String())
+		}
+		err := executeCommand("resolvectl", args...)
+		if err == nil && len(domains) > 0 {
+			err = executeCommand("resolvectl", append([]string{"domain", name}, domains...)...)
+		}
+		if err != nil {
+			executeCommand("resolvectl", "revert", name)
+			return &netConfigError{Op: "set dns", Target: name, Err: err}
+		}
+		return nil
+	})
+}
+
+// replaceFile moves path to backup and writes data in its place. Reverting
+// moves the original back, so a symlink stays a symlink. An existing backup
+// is never overwritten: it may be the only copy of the original.
+func (j *netJournal) replaceFile(path, backup string, data []byte) error {
+	if _, err := os.Lstat(backup); err == nil {
+		return &netConfigError{Op: "back up", Target: path, Err: fmt.Errorf("%s already exists, restore or remove it", backup)}
+	}
+	change := netChange{Kind: NET_CHANGE_FILE, File: path, Backup: backup}
+	log.Printf("⚙️  Replacing %s", change)
+	return j.apply(change, func() error {
+		if err := os.Rename(path, backup); err != nil {
+			return &netConfigError{Op: "back up", Target: path, Err: err}
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			os.Rename(backup, path)
+			return &netConfigError{Op: "write", Target: path, Err: err}
+		}
+		return nil
+	})
+}
+
+// replaceNftTable installs one of our nftables tables in a family,
+// replacing any leftover from an earlier run or an earlier call in the same
+// transaction. build adds the chains and rules.
+func (j *netJournal) replaceNftTable(family, name string, build nftBuilder) error {
+	change := netChange{Kind: NET_CHANGE_NFT_TABLE, Family: family, NftName: name}
+	log.Printf("⚙️  Installing %s", change)
+	replace := func() error {
+		if err := nftReplaceTable(family, change.nftName(), build); err != nil {
+			return &netConfigError{Op: "install", Target: change.String(), Err: err}
+		}
+		return nil
+	}
+	if j.contains(change) {
+		return replace()
+	}
+	return j.apply(change, replace)
+}
+
+// runCommand runs a configuration command and records undo as the command
+// that reverts it. It is used where netlink is not available.
+func (j *netJournal) runCommand(undo []string, name string, args ...string) error {
+	return j.apply(netChange{Kind: NET_CHANGE_COMMAND, Undo: undo}, func() error {
+		if err := executeCommand(name, args...); err != nil {
+			return &netConfigError{Op: "run", Target: name, Err: err}
+		}
+		return nil
+	})
+}
+
+// contains reports whether change is journaled
+func (j *netJournal) contains(change netChange) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, c := range j.changes {
+		if reflect.DeepEqual(c, change) {
+			return true
+		}
+	}
+	return false
+}
+
+// rollback reverts every recorded change, newest first. Changes that are
+// already gone, such as addresses on an interface that was deleted, count
+// as reverted. Changes that fail to revert stay in the journal, and in the
+// state file, so a later rollback can retry them.
+func (j *netJournal) rollback() error {
+	return j.rollbackExcept(nil)
+}
+
+// rollbackExcept is rollback, but the changes keep selects stay in place and
+// in the journal
+func (j *netJournal) rollbackExcept(keep func(netChange) bool) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var errs []error
+	var kept []netChange
+	for i := len(j.changes) - 1; i >= 0; i-- {
+		change := j.changes[i]
+		if keep != nil && keep(change) {
+			kept = append([]netChange{change}, kept...)
+			continue
+		}
+		debugf("⚙️  Reverting %s", change)
+		if err := revertChange(change); err != nil && !alreadyReverted(err) {
+			errs = append(errs, err)
+			kept = append([]netChange{change}, kept...)
+		}
+	}
+	j.changes = kept
+	if err := j.save(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// revertChange undoes a single change
+func revertChange(change netChange) error {
+	if err := change.validate(); err != nil {
+		return &netConfigError{Op: "revert", Target: change.String(), Err: err}
+	}
+	if change.Kind == NET_CHANGE_COMMAND {
+		if err := executeCommand(change.Undo[0], change.Undo[1:]...); err != nil {
+			return &netConfigError{Op: "revert", Target: change.Undo[0], Err: err}
+		}
+		return nil
+	}
+
+	switch change.Kind {
+	case NET_CHANGE_SYSCTL:
+		if err := os.WriteFile(change.Sysctl, []byte(change.Value+"\n"), 0644); err != nil {
+			return &netConfigError{Op: "revert", Target: change.String(), Err: err}
+		}
+		return nil
+	case NET_CHANGE_NFT_TABLE:
+		if err := nftDeleteTable(change.Family, change.nftName()); err != nil {
+			return &netConfigError{Op: "revert", Target: change.String(), Err: err}
+		}
+		return nil
+	case NET_CHANGE_FILE:
+		// A missing backup means the original was never moved, or is back
+		if err := os.Rename(change.Backup, change.File); err != nil {
+			return &netConfigError{Op: "restore", Target: change.File, Err: err}
+		}
+		return nil
+	case NET_CHANGE_RESOLVED:
+		if _, err := netlink.LinkByName(change.Link); err != nil {
+			return netError("revert", change.Link, err)
+		}
+		if err := executeCommand("resolvectl", "revert", change.Link); err != nil {
+			return &netConfigError{Op: "revert", Target: change.String(), Err: err}
+		}
+		return nil
+	}
+
+	if change.Kind == NET_CHANGE_RULE {
+		if err := ruleDel(change); err != nil {
+			return netError("delete rule", change.String(), err)
+		}
+		return nil
+	}
+
+	if change.Kind == NET_CHANGE_ROUTE {
+		route, err := netlinkRoute(change)
+		if err != nil {
+			return err
+		}
+		if err := netlink.RouteDel(route); err != nil {
+			return netError("delete route", change.Prefix.String(), err)
+		}
+		return nil
+	}
+
+	link, err := netlink.LinkByName(change.Link)
+	if err != nil {
+		return netError("revert", change.Link, err)
+	}
+	switch change.Kind {
+	case NET_CHANGE_ADDR:
+		err = netlink.AddrDel(link, &netlink.Addr{IPNet: prefixIPNet(change.Prefix)})
+	case NET_CHANGE_MTU:
+		err = netlink.LinkSetMTU(link, change.MTU)
+	case NET_CHANGE_LINK_UP:
+		err = netlink.LinkSetDown(link)
+	default:
+		err = fmt.Errorf("unknown change kind %q", change.Kind)
+	}
+	if err != nil {
+		return netError("revert", change.String(), err)
+	}
+	return nil
+}
+
+// alreadyReverted reports whether a revert failed only because the change
+// no longer exists
+func alreadyReverted(err error) bool {
+	return errors.Is(err, errLinkNotFound) ||
+		errors.Is(err, syscall.ESRCH) ||
+		errors.Is(err, syscall.ENOENT) ||
+		errors.Is(err, syscall.ENODEV) ||
+		errors.Is(err, syscall.EADDRNOTAVAIL)
+}
+
+// netlinkRoute builds the netlink route for a NET_CHANGE_ROUTE
+func netlinkRoute(change netChange) (*netlink.Route, error) {
+	link, err := netlink.LinkByName(change.Link)
+	if err != nil {
+		return nil, netError("route", change.Link, err)
+	}
+	route := &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       prefixIPNet(change.Prefix),
+		Table:     change.Table,
+	}
+	if change.Gateway.IsValid() {
+		route.Gw = change.Gateway.AsSlice()
+	}
+	if change.Source.IsValid() {
+		route.Src = change.Source.AsSlice()
+	}
+	return route, nil
+}
+
+// underlayRoute is how the host reaches an address outside the tunnel
+type underlayRoute struct {
+	Gateway netip.Addr // Invalid for destinations on the link itself
+	Link    string
+	Source  netip.Addr // Invalid to let the kernel choose
+}
+
+func (r underlayRoute) String() string {
+	via := "directly"
+	if r.Gateway.IsValid() {
+		via = "via " + r.Gateway.String()
+	}
+	if r.Source.IsValid() {
+		return fmt.Sprintf("%s dev %s src %s", via, r.Link, r.Source)
+	}
+	return fmt.Sprintf("%s dev %s", via, r.Link)
+}
+
+// lookupUnderlay finds the main table route covering all of dst by longest
+// prefix match, ignoring routes through skipLink (the tunnel) so the answer
+// does not change once the tunnel's routes are in place. With skipPin set,
+// a route to exactly dst (our own pin) is ignored as well. Among equally
+// specific routes the lowest metric wins.
+func lookupUnderlay(dst netip.Prefix, skipLink string, skipPin bool) (underlayRoute, error) {
+	family := syscall.AF_INET
+	if dst.Addr().Is6() {
+		family = syscall.AF_INET6
+	}
+	routes, err := netlink.RouteList(nil, family)
+	if err != nil {
+		return underlayRoute{}, netError("list routes", dst.String(), err)
+	}
+	skipIndex := -1
+	if skipLink != "" {
+		if link, err := netlink.LinkByName(skipLink); err == nil {
+			skipIndex = link.Attrs().Index
+		}
+	}
+
+	best := bestRoute(routes, dst, skipIndex, skipPin)
+	if best == nil {
+		return underlayRoute{}, &netConfigError{Op: "find route", Target: dst.String(), Err: syscall.ENETUNREACH}
+	}
+
+	linkIndex, gw := best.LinkIndex, best.Gw
+	if linkIndex == 0 && len(best.MultiPath) > 0 {
+		linkIndex, gw = best.MultiPath[0].LinkIndex, best.MultiPath[0].Gw
+	}
+	link, err := netlink.LinkByIndex(linkIndex)
+	if err != nil {
+		return underlayRoute{}, netError("find route", dst.String(), err)
+	}
+
+	route := underlayRoute{Link: link.Attrs().Name}
+	route.Gateway, _ = netip.AddrFromSlice(gw)
+	route.Gateway = route.Gateway.Unmap()
+	route.Source, _ = netip.AddrFromSlice(best.Src)
+	route.Source = route.Source.Unmap()
+	if !route.Source.IsValid() {
+		// Without a preferred source on the route, the kernel uses the
+		// link's first global address
+		addrs, err := netlink.AddrList(link, family)
+		if err == nil {
+			for _, addr := range addrs {
+				if ip, ok := netip.AddrFromSlice(addr.IP); ok && ip.Unmap().IsGlobalUnicast() {
+					route.Source = ip.Unmap()
+					break
+				}
+			}
+		}
+	}
+	return route, nil
+}
+
+// bestRoute picks the route lookupUnderlay follows: the most specific one
+// covering all of dst that is not through the link with skipIndex, and not
+// to exactly dst with skipPin set. Ties go to the lowest metric.
+func bestRoute(routes []netlink.Route, dst netip.Prefix, skipIndex int, skipPin bool) *netlink.Route {
+	var best *netlink.Route
+	bestBits := -1
+	for i, route := range routes {
+		linkIndex := route.LinkIndex
+		if linkIndex == 0 && len(route.MultiPath) > 0 {
+			linkIndex = route.MultiPath[0].LinkIndex
+		}
+		if linkIndex == skipIndex {
+			continue
+		}
+		bits := 0
+		if route.Dst != nil {
+			prefix, ok := ipNetPrefix(route.Dst)
+			if !ok || prefix.Bits() > dst.Bits() || !prefix.Contains(dst.Addr()) || (skipPin && prefix == dst) {
+				continue
+			}
+			bits = prefix.Bits()
+		}
+		if bits > bestBits || (bits == bestBits && route.Priority < best.Priority) {
+			best, bestBits = &routes[i], bits
+		}
+	}
+	return best
+}
+
+// defaultRoute returns the gateway and interface of the main table's IPv4
+// default route, or the IPv6 one if ipv6 is set. With several, the one with
+// the lowest metric wins.
+func defaultRoute(ipv6 bool) (netip.Addr, string, error) {
+	family := syscall.AF_INET
+	if ipv6 {
+		family = syscall.AF_INET6
+	}
+	routes, err := netlink.RouteList(nil, family)
+	if err != nil {
+		return netip.Addr{}, "", netError("list routes", "default", err)
+	}
+
+	var best *netlink.Route
+	for i, route := range routes {
+		if route.Dst != nil {
+			if ones, _ := route.Dst.Mask.Size(); ones != 0 {
+				continue
+			}
+		}
+		if best == nil || route.Priority < best.Priority {
+			best = &routes[i]
+		}
+	}
+	if best == nil {
+		return netip.Addr{}, "", &netConfigError{Op: "find route", Target: "default", Err: syscall.ENETUNREACH}
+	}
+
+	link, err := netlink.LinkByIndex(best.LinkIndex)
+	if err != nil {
+		return netip.Addr{}, "", netError("find route", "default", err)
+	}
+	gateway, _ := netip.AddrFromSlice(best.Gw)
+	return gateway.Unmap(), link.Attrs().Name, nil
+}
+
+// configureLink assigns addresses and the MTU to an interface and brings it
+// up
+func configureLink(j *netJournal, name string, addrs []netip.Prefix, mtu int) error {
+	for _, addr := range addrs {
+		if err := j.addAddress(name, addr); err != nil {
+			return err
+		}
+	}
+	if err := j.setMTU(name, mtu); err != nil {
+		return err
+	}
+	return j.setLinkUp(name)
+}
+
+// prefixIPNet converts a prefix to the net.IPNet netlink expects
+func prefixIPNet(prefix netip.Prefix) *net.IPNet {
+	return &net.IPNet{
+		IP:   prefix.Addr().AsSlice(),
+		Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+	}
+}
+
+// ipNetPrefix converts a netlink destination to a prefix
+func ipNetPrefix(ipNet *net.IPNet) (netip.Prefix, bool) {
+	addr, ok := netip.AddrFromSlice(ipNet.IP)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	ones, _ := ipNet.Mask.Size()
+	return netip.PrefixFrom(addr.Unmap(), ones), true
+}
+
+// executeCommand runs a system command and logs its output/errors
+func executeCommand(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	log.Printf("⚙️  Executing: %s %v", name, args)
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("command '%s %v' failed: %w", name, args, err)
+	}
+
+	return nil
+}
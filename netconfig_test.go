@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+// writeState writes a state file as if this process had left it behind
+func writeState(t *testing.T, path string, changes []netChange) {
+	t.Helper()
+	writeStateFor(t, path, os.Getpid(), changes)
+}
+
+// writeStateFor writes a state file left behind by process pid
+func writeStateFor(t *testing.T, path string, pid int, changes []netChange) {
+	t.Helper()
+	data, err := json.Marshal(netJournalState{PID: pid, Changes: changes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNetChangeValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change netChange
+		ok     bool
+	}{
+		{"command", netChange{Kind: NET_CHANGE_COMMAND, Undo: []string{"true"}}, true},
+		{"command without undo", netChange{Kind: NET_CHANGE_COMMAND}, false},
+		{"command with empty undo", netChange{Kind: NET_CHANGE_COMMAND, Undo: []string{""}}, false},
+		{"file", netChange{Kind: NET_CHANGE_FILE, File: "/etc/resolv.conf", Backup: "/etc/resolv.conf.cipherwall"}, true},
+		{"file without backup", netChange{Kind: NET_CHANGE_FILE, File: "/etc/resolv.conf"}, false},
+		{"sysctl", netChange{Kind: NET_CHANGE_SYSCTL, Sysctl: "/proc/sys/net/ipv4/ip_forward", Value: "0"}, true},
+		{"sysctl outside /proc/sys", netChange{Kind: NET_CHANGE_SYSCTL, Sysctl: "/etc/passwd"}, false},
+		{"mtu without link", netChange{Kind: NET_CHANGE_MTU, MTU: 1500}, false},
+		{"route without prefix", netChange{Kind: NET_CHANGE_ROUTE, Link: "eth0"}, false},
+		{"nft table without family", netChange{Kind: NET_CHANGE_NFT_TABLE}, false},
+		{"unknown kind", netChange{Kind: "bogus", Link: "eth0"}, false},
+		{"no kind", netChange{}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.change.validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+// A truncated or hand-edited state file must not crash the recovery; the
+// entries that can be reverted still are
+func TestNetJournalOpenSkipsMalformed(t *testing.T) {
+	dir := t.TempDir()
+	file, backup := filepath.Join(dir, "resolv.conf"), filepath.Join(dir, "resolv.conf.orig")
+	if err := os.WriteFile(backup, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	state := filepath.Join(dir, "state.json")
+	writeState(t, state, []netChange{
+		{Kind: NET_CHANGE_FILE, File: file, Backup: backup},
+		{Kind: NET_CHANGE_COMMAND},
+		{Kind: "bogus"},
+	})
+
+	var j netJournal
+	stale, err := j.open(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale != 1 {
+		t.Fatalf("open found %d changes, want 1", stale)
+	}
+	if err := j.rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(file); err != nil || string(data) != "original" {
+		t.Fatalf("file not restored: %q, %v", data, err)
+	}
+	if _, err := os.Stat(state); !os.IsNotExist(err) {
+		t.Fatalf("state file left behind: %v", err)
+	}
+}
+
+// A state file is only taken over once the client that wrote it is gone
+func TestNetJournalOpenOwner(t *testing.T) {
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	dead := cmd.Process.Pid
+	if processAlive(dead) {
+		t.Skip("pid of the exited process is in use again")
+	}
+	if !processAlive(os.Getppid()) {
+		t.Fatal("parent process reported dead")
+	}
+
+	dir := t.TempDir()
+	state := filepath.Join(dir, "state.json")
+	changes := []netChange{{Kind: NET_CHANGE_COMMAND, Undo: []string{"true"}}}
+
+	writeStateFor(t, state, os.Getppid(), changes)
+	var running netJournal
+	if _, err := running.open(state); err == nil {
+		t.Fatal("state file of a running client taken over")
+	}
+
+	writeStateFor(t, state, dead, changes)
+	var next netJournal
+	if stale, err := next.open(state); err != nil || stale != 1 {
+		t.Fatalf("open found %d changes, %v; want 1", stale, err)
+	}
+
+	if err := os.WriteFile(state, []byte(`{"pid": 1, "changes": [`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := new(netJournal).open(state); err == nil {
+		t.Fatal("truncated state file accepted")
+	}
+}
+
+// A change reaches the state file before it is made, so a crash in between
+// still leaves it to be reverted
+func TestNetJournalApplySavesFirst(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "state", "state.json")
+	var j netJournal
+	if _, err := j.open(state); err != nil {
+		t.Fatal(err)
+	}
+	change := netChange{Kind: NET_CHANGE_COMMAND, Undo: []string{"true"}}
+	err := j.apply(change, func() error {
+		var crashed netJournal
+		crashed.open(state)
+		if !crashed.contains(change) {
+			t.Error("change not in the state file while being made")
+		}
+		return errors.New("failed")
+	})
+	if err == nil {
+		t.Fatal("failed change reported as made")
+	}
+	if _, err := os.Stat(state); !os.IsNotExist(err) {
+		t.Fatalf("state file kept for a failed change: %v", err)
+	}
+}
+
+// Rollback reverts newest first and keeps what failed, in memory and in the
+// state file, for a later retry
+func TestNetJournalRollback(t *testing.T) {
+	dir := t.TempDir()
+	file, backup := filepath.Join(dir, "resolv.conf"), filepath.Join(dir, "resolv.conf.orig")
+	if err := os.WriteFile(file, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	state := filepath.Join(dir, "state.json")
+
+	var j netJournal
+	if _, err := j.open(state); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.replaceFile(file, backup, []byte("replaced")); err != nil {
+		t.Fatal(err)
+	}
+	failing := netChange{Kind: NET_CHANGE_COMMAND, Undo: []string{"false"}}
+	if err := j.runCommand(failing.Undo, "true"); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.runCommand([]string{"true"}, "false"); err == nil {
+		t.Fatal("failed command succeeded")
+	}
+	if j.contains(netChange{Kind: NET_CHANGE_COMMAND, Undo: []string{"true"}}) {
+		t.Fatal("failed change journaled")
+	}
+
+	if err := j.rollback(); err == nil {
+		t.Fatal("rollback hid the failed revert")
+	}
+	if data, err := os.ReadFile(file); err != nil || string(data) != "original" {
+		t.Fatalf("file not restored: %q, %v", data, err)
+	}
+	if len(j.changes) != 1 || !j.contains(failing) {
+		t.Fatalf("journal after rollback: %v, want only %s", j.changes, failing)
+	}
+
+	// A new run finds the failed change in the state file
+	var next netJournal
+	if stale, err := next.open(state); err != nil || stale != 1 {
+		t.Fatalf("open found %d changes, %v; want 1", stale, err)
+	}
+	if !next.contains(failing) {
+		t.Fatalf("state file has %v, want %s", next.changes, failing)
+	}
+}
+
+// netConfigError keeps the underlying error reachable with errors.Is, and
+// netlink's link-not-found error becomes errLinkNotFound
+func TestNetConfigError(t *testing.T) {
+	err := fmt.Errorf("setup: %w", netError("add route", "10.0.0.0/8", syscall.EEXIST))
+	var netErr *netConfigError
+	if !errors.As(err, &netErr) || netErr.Op != "add route" || netErr.Target != "10.0.0.0/8" {
+		t.Fatalf("errors.As: %v", err)
+	}
+	if !errors.Is(err, os.ErrExist) {
+		t.Error("EEXIST does not match os.ErrExist")
+	}
+	if got := netErr.Error(); got != "add route 10.0.0.0/8: file exists" {
+		t.Errorf("Error() = %q", got)
+	}
+	if err := netError("set mtu", "tun0", netlink.LinkNotFoundError{}); !errors.Is(err, errLinkNotFound) {
+		t.Errorf("link not found: %v", err)
+	}
+
+	tests := []struct {
+		err  error
+		gone bool
+	}{
+		{netError("revert", "tun0", netlink.LinkNotFoundError{}), true},
+		{netError("delete route", "10.0.0.0/8", syscall.ESRCH), true},
+		{netError("revert", "address", syscall.EADDRNOTAVAIL), true},
+		{&netConfigError{Op: "restore", Target: "/etc/resolv.conf", Err: &os.PathError{Op: "rename", Err: syscall.ENOENT}}, true},
+		{netError("revert", "tun0", syscall.EPERM), false},
+		{errors.New("exit status 1"), false},
+	}
+	for _, tt := range tests {
+		if got := alreadyReverted(tt.err); got != tt.gone {
+			t.Errorf("alreadyReverted(%v) = %v, want %v", tt.err, got, tt.gone)
+		}
+	}
+}
+
+func TestNetChangeString(t *testing.T) {
+	tests := []struct {
+		change netChange
+		want   string
+	}{
+		{netChange{Kind: NET_CHANGE_ADDR, Link: "tun0", Prefix: netip.MustParsePrefix("10.8.0.2/24")}, "address 10.8.0.2/24 on tun0"},
+		{netChange{Kind: NET_CHANGE_MTU, Link: "tun0", MTU: 1500}, "mtu of tun0 (was 1500)"},
+		{netChange{Kind: NET_CHANGE_ROUTE, Link: "tun0", Prefix: netip.MustParsePrefix("0.0.0.0/1")}, "route 0.0.0.0/1 dev tun0"},
+		{netChange{
+			Kind: NET_CHANGE_ROUTE, Link: "eth0", Prefix: netip.MustParsePrefix("203.0.113.1/32"),
+			Gateway: netip.MustParseAddr("192.168.1.1"), Source: netip.MustParseAddr("192.168.1.20"), Table: 51820,
+		}, "route 203.0.113.1/32 via 192.168.1.1 dev eth0 src 192.168.1.20 table 51820"},
+		{netChange{Kind: NET_CHANGE_RULE, Family: "ip", Priority: 32000, Mark: 0xca6c, Table: 51820}, "ip rule 32000: not fwmark 0xca6c lookup 51820"},
+		{netChange{Kind: NET_CHANGE_RULE, Family: "ip6", Priority: 31999, Suppress: true}, "ip6 rule 31999: lookup main suppress_prefixlength 0"},
+		{netChange{Kind: NET_CHANGE_NFT_TABLE, Family: "inet"}, "nftables table inet " + NFT_TABLE},
+		{netChange{Kind: NET_CHANGE_COMMAND, Undo: []string{"iptables", "-D", "FORWARD"}}, "command (undo: iptables -D FORWARD)"},
+	}
+	for _, tt := range tests {
+		if got := tt.change.String(); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestPrefixIPNet(t *testing.T) {
+	for _, s := range []string{"10.8.0.2/24", "0.0.0.0/0", "203.0.113.1/32", "fd00:8::2/64", "::/1"} {
+		prefix := netip.MustParsePrefix(s)
+		ipNet := prefixIPNet(prefix)
+		if ones, bits := ipNet.Mask.Size(); ones != prefix.Bits() || bits != prefix.Addr().BitLen() {
+			t.Errorf("%s: mask %s", s, ipNet.Mask)
+		}
+		if got, ok := ipNetPrefix(ipNet); !ok || got != prefix {
+			t.Errorf("%s: round trip gave %s", s, got)
+		}
+	}
+	// netlink hands out IPv4 addresses in their 16-byte form
+	mapped := prefixIPNet(netip.MustParsePrefix("10.0.0.0/8"))
+	mapped.IP = mapped.IP.To16()
+	if got, ok := ipNetPrefix(mapped); !ok || got != netip.MustParsePrefix("10.0.0.0/8") {
+		t.Errorf("IPv4-mapped destination gave %s", got)
+	}
+}
+
+// Changes to an interface that is gone, such as a TUN device that closed
+// with the client, count as reverted
+func TestNetJournalRollbackGoneLink(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("netlink is Linux only")
+	}
+	j := netJournal{changes: []netChange{
+		{Kind: NET_CHANGE_LINK_UP, Link: "cwtest-gone0"},
+		{Kind: NET_CHANGE_MTU, Link: "cwtest-gone0", MTU: 1500},
+		{Kind: NET_CHANGE_ADDR, Link: "cwtest-gone0", Prefix: netip.MustParsePrefix("10.8.0.2/24")},
+		{Kind: NET_CHANGE_ROUTE, Link: "cwtest-gone0", Prefix: netip.MustParsePrefix("0.0.0.0/1")},
+	}}
+	if err := j.rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if len(j.changes) != 0 {
+		t.Errorf("journal after rollback: %v", j.changes)
+	}
+}
+
+func TestBestRoute(t *testing.T) {
+	route := func(dst string, link, priority int) netlink.Route {
+		r := netlink.Route{LinkIndex: link, Priority: priority}
+		if dst != "" {
+			r.Dst = prefixIPNet(netip.MustParsePrefix(dst))
+		}
+		return r
+	}
+	const eth, wlan, tun = 2, 3, 9
+	routes := []netlink.Route{
+		route("", wlan, 600), // Default routes
+		route("", eth, 100),
+		route("0.0.0.0/1", tun, 0), // The tunnel's split default route
+		route("192.168.1.0/24", eth, 100),
+		route("192.168.0.0/16", wlan, 100),
+		route("203.0.113.7/32", eth, 0), // Our server pin
+		{MultiPath: []*netlink.NexthopInfo{{LinkIndex: wlan}}, Dst: prefixIPNet(netip.MustParsePrefix("198.51.100.0/24"))},
+	}
+
+	tests := []struct {
+		name      string
+		dst       string
+		skipIndex int
+		skipPin   bool
+		want      int // Index in routes, -1 for none
+	}{
+		{"lowest metric default", "8.8.8.8/32", tun, false, 1},
+		{"tunnel route", "8.8.8.8/32", -1, false, 2},
+		{"longest prefix", "192.168.1.10/32", tun, false, 3},
+		{"covering prefix", "192.168.1.0/24", tun, false, 3},
+		{"only routes covering all of dst", "192.168.0.0/20", tun, false, 4},
+		{"server pin", "203.0.113.7/32", tun, false, 5},
+		{"server pin skipped", "203.0.113.7/32", tun, true, 1},
+		{"multipath", "198.51.100.1/32", tun, false, 6},
+	}
+	for _, tt := range tests {
+		got := bestRoute(routes, netip.MustParsePrefix(tt.dst), tt.skipIndex, tt.skipPin)
+		if got != &routes[tt.want] {
+			t.Errorf("%s: got %+v, want route %d", tt.name, got, tt.want)
+		}
+	}
+
+	if got := bestRoute(routes[3:4], netip.MustParsePrefix("8.8.8.8/32"), tun, false); got != nil {
+		t.Errorf("no covering route: got %+v", got)
+	}
+}
+
+func TestUnderlayRouteString(t *testing.T) {
+	tests := []struct {
+		route underlayRoute
+		want  string
+	}{
+		{underlayRoute{Gateway: netip.MustParseAddr("192.168.1.1"), Link: "eth0", Source: netip.MustParseAddr("192.168.1.20")}, "via 192.168.1.1 dev eth0 src 192.168.1.20"},
+		{underlayRoute{Gateway: netip.MustParseAddr("fe80::1"), Link: "wlan0"}, "via fe80::1 dev wlan0"},
+		{underlayRoute{Link: "eth0"}, "directly dev eth0"},
+	}
+	for _, tt := range tests {
+		if got := tt.route.String(); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// Our nftables tables. Every rule we install lives in one of them, so
+// deleting a table removes its rules and never touches anyone else's. The
+// kill switch has its own table, as it outlives the client's other rules.
+const (
+	NFT_TABLE             = "cipherwall"
+	NFT_KILL_SWITCH_TABLE = "cipherwall-killswitch"
+)
+
+// TCP header bits the MSS clamp looks at
+const (
+	TCP_FLAG_SYN   = 0x02
+	TCP_FLAG_RST   = 0x04
+	TCP_OPTION_MSS = 2
+)
+
+// nftBuilder adds chains and rules to a freshly created table
+type nftBuilder func(c *nftables.Conn, table *nftables.Table)
+
+// nftTableFamily maps a family name to its nftables value
+func nftTableFamily(family string) (nftables.TableFamily, error) {
+	switch family {
+	case "ip":
+		return nftables.TableFamilyIPv4, nil
+	case "ip6":
+		return nftables.TableFamilyIPv6, nil
+	case "inet":
+		return nftables.TableFamilyINet, nil
+	default:
+		return 0, fmt.Errorf("unknown nftables family %q", family)
+	}
+}
+
+// nftReplaceTable atomically replaces one of our tables in a family with the
+// one build creates. Adding the table before deleting it makes the delete
+// succeed whether or not a leftover exists.
+func nftReplaceTable(family, name string, build nftBuilder) error {
+	fam, err := nftTableFamily(family)
+	if err != nil {
+		return err
+	}
+	c, err := nftables.New()
+	if err != nil {
+		return err
+	}
+
+	table := &nftables.Table{Family: fam, Name: name}
+	c.AddTable(table)
+	c.DelTable(table)
+	c.AddTable(table)
+	build(c, table)
+	return c.Flush()
+}
+
+// nftDeleteTable removes one of our tables from a family
+func nftDeleteTable(family, name string) error {
+	fam, err := nftTableFamily(family)
+	if err != nil {
+		return err
+	}
+	c, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	c.DelTable(&nftables.Table{Family: fam, Name: name})
+	return c.Flush()
+}
+
+// nftBaseChain adds a base chain attached to a netfilter hook
+func nftBaseChain(c *nftables.Conn, table *nftables.Table, name string, chainType nftables.ChainType, hook *nftables.ChainHook, priority *nftables.ChainPriority) *nftables.Chain {
+	policy := nftables.ChainPolicyAccept
+	return c.AddChain(&nftables.Chain{
+		Name:     name,
+		Table:    table,
+		Type:     chainType,
+		Hooknum:  hook,
+		Priority: priority,
+		Policy:   &policy,
+	})
+}
+
+// nftMatchIfname matches the input or output interface name
+func nftMatchIfname(key expr.MetaKey, name string) []expr.Any {
+	data := make([]byte, unix.IFNAMSIZ)
+	copy(data, name)
+	return []expr.Any{
+		&expr.Meta{Key: key, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: data},
+	}
+}
+
+// nftMatchAddress matches the source or destination address against a
+// prefix. Packets of the other IP version never match, so it also works in
+// inet tables.
+func nftMatchAddress(prefix netip.Prefix, source bool) []expr.Any {
+	proto := byte(unix.NFPROTO_IPV4)
+	offset, size := uint32(16), uint32(4) // IPv4 destination address
+	if prefix.Addr().Is6() {
+		proto, offset, size = unix.NFPROTO_IPV6, 24, 16
+	}
+	if source {
+		offset -= size
+	}
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: size},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            size,
+			Mask:           net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+			Xor:            make([]byte, size),
+		},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: prefix.Masked().Addr().AsSlice()},
+	}
+}
+
+// nftNATRules builds the server's forwarding and NAT table for one address
+// family: traffic from subnet leaving through egress is masqueraded, or
+// source-NATed to snat if it is valid, and forwarding to and from the tunnel
+// is accepted. Without an egress interface there is no NAT, only
+// forwarding. A non-zero mss clamps the MSS of TCP connections through the
+// tunnel.
+func nftNATRules(subnet netip.Prefix, tun, egress string, snat netip.Addr, mss uint16) nftBuilder {
+	return func(c *nftables.Conn, table *nftables.Table) {
+		if egress != "" {
+			nftMasqueradeChain(c, table, subnet, egress, snat)
+		}
+		forward := nftBaseChain(c, table, "forward", nftables.ChainTypeFilter, nftables.ChainHookForward, nftables.ChainPriorityFilter)
+		for _, key := range []expr.MetaKey{expr.MetaKeyIIFNAME, expr.MetaKeyOIFNAME} {
+			if mss != 0 {
+				c.AddRule(&nftables.Rule{
+					Table: table,
+					Chain: forward,
+					Exprs: append(append(nftMatchIfname(key, tun), nftMatchTCPSyn()...), nftClampMSS(mss)...),
+				})
+			}
+			c.AddRule(&nftables.Rule{
+				Table: table,
+				Chain: forward,
+				Exprs: append(nftMatchIfname(key, tun), &expr.Verdict{Kind: expr.VerdictAccept}),
+			})
+		}
+	}
+}
+
+// nftMatchTCPSyn matches TCP packets with SYN set and RST clear, the ones
+// that carry the MSS option
+func nftMatchTCPSyn() []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 13, Len: 1}, // Flags
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 1, Mask: []byte{TCP_FLAG_SYN | TCP_FLAG_RST}, Xor: []byte{0}},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{TCP_FLAG_SYN}},
+	}
+}
+
+// nftClampMSS lowers the MSS option of a packet to mss. The kernel never
+// raises it, so smaller values the endpoints chose are kept.
+func nftClampMSS(mss uint16) []expr.Any {
+	return []expr.Any{
+		&expr.Immediate{Register: 1, Data: binaryutil.BigEndian.PutUint16(mss)},
+		&expr.Exthdr{Op: expr.ExthdrOpTcpopt, Type: TCP_OPTION_MSS, Offset: 2, Len: 2, SourceRegister: 1},
+	}
+}
+
+// nftMasqueradeChain adds the postrouting chain that NATs subnet out of
+// egress
+func nftMasqueradeChain(c *nftables.Conn, table *nftables.Table, subnet netip.Prefix, egress string, snat netip.Addr) {
+	postrouting := nftBaseChain(c, table, "postrouting", nftables.ChainTypeNAT, nftables.ChainHookPostrouting, nftables.ChainPriorityNATSource)
+	exprs := append(nftMatchAddress(subnet, true), nftMatchIfname(expr.MetaKeyOIFNAME, egress)...)
+	if snat.IsValid() {
+		family := uint32(unix.NFPROTO_IPV4)
+		if snat.Is6() {
+			family = unix.NFPROTO_IPV6
+		}
+		exprs = append(exprs,
+			&expr.Immediate{Register: 1, Data: snat.AsSlice()},
+			&expr.NAT{Type: expr.NATTypeSourceNAT, Family: family, RegAddrMin: 1},
+		)
+	} else {
+		exprs = append(exprs, &expr.Masq{})
+	}
+	c.AddRule(&nftables.Rule{Table: table, Chain: postrouting, Exprs: exprs})
+}
+
+// nftPolicyMarkRules builds the client's policy routing table: the mark of
+// the outgoing tunnel packets is saved in their connection and restored on
+// the replies, so reverse path filtering checks the replies against the
+// same routes the requests used
+func nftPolicyMarkRules(mark uint32) nftBuilder {
+	return func(c *nftables.Conn, table *nftables.Table) {
+		value := binaryutil.NativeEndian.PutUint32(mark)
+
+		premangle := nftBaseChain(c, table, "premangle", nftables.ChainTypeFilter, nftables.ChainHookPrerouting, nftables.ChainPriorityMangle)
+		c.AddRule(&nftables.Rule{Table: table, Chain: premangle, Exprs: []expr.Any{
+			&expr.Ct{Key: expr.CtKeyMARK, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: value},
+			&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+		}})
+
+		postmangle := nftBaseChain(c, table, "postmangle", nftables.ChainTypeFilter, nftables.ChainHookPostrouting, nftables.ChainPriorityMangle)
+		c.AddRule(&nftables.Rule{Table: table, Chain: postmangle, Exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: value},
+			&expr.Ct{Key: expr.CtKeyMARK, SourceRegister: true, Register: 1},
+		}})
+	}
+}
+
+// nftMatchUDPPort matches UDP packets to or from a port
+func nftMatchUDPPort(port uint16, source bool) []expr.Any {
+	offset := uint32(2) // Destination port
+	if source {
+		offset = 0
+	}
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_UDP}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: offset, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(port)},
+	}
+}
+
+// nftMatchICMPv6Type matches one ICMPv6 message type
+func nftMatchICMPv6Type(icmpType byte) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_ICMPV6}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{icmpType}},
+	}
+}
+
+// nftKillSwitchRules builds the client's kill switch table (inet family):
+// input and output are dropped except on loopback and the tunnel, the UDP
+// flow to the server, traffic to and from the allowed prefixes (the
+// excluded routes), and what keeps the underlay up: DHCP and IPv6 neighbor
+// discovery. tun may be empty before the TUN interface exists.
+func nftKillSwitchRules(server netip.AddrPort, tun string, allow []netip.Prefix) nftBuilder {
+	return func(c *nftables.Conn, table *nftables.Table) {
+		accept := &expr.Verdict{Kind: expr.VerdictAccept}
+		rule := func(chain *nftables.Chain, exprs ...[]expr.Any) {
+			var all []expr.Any
+			for _, e := range exprs {
+				all = append(all, e...)
+			}
+			c.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: append(all, accept)})
+		}
+		established := []expr.Any{
+			&expr.Ct{Key: expr.CtKeySTATE, Register: 1},
+			&expr.Bitwise{
+				SourceRegister: 1,
+				DestRegister:   1,
+				Len:            4,
+				Mask:           binaryutil.NativeEndian.PutUint32(expr.CtStateBitESTABLISHED | expr.CtStateBitRELATED),
+				Xor:            make([]byte, 4),
+			},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: make([]byte, 4)},
+		}
+		serverPrefix := netip.PrefixFrom(server.Addr(), server.Addr().BitLen())
+
+		for _, hook := range []string{"input", "output"} {
+			chainHook, ifname, source := nftables.ChainHookInput, expr.MetaKeyIIFNAME, true
+			if hook == "output" {
+				chainHook, ifname, source = nftables.ChainHookOutput, expr.MetaKeyOIFNAME, false
+			}
+			drop := nftables.ChainPolicyDrop
+			chain := c.AddChain(&nftables.Chain{
+				Name:     hook,
+				Table:    table,
+				Type:     nftables.ChainTypeFilter,
+				Hooknum:  chainHook,
+				Priority: nftables.ChainPriorityFilter,
+				Policy:   &drop,
+			})
+
+			rule(chain, nftMatchIfname(ifname, "lo"))
+			if tun != "" {
+				rule(chain, nftMatchIfname(ifname, tun))
+			}
+			rule(chain, nftMatchAddress(serverPrefix, source), nftMatchUDPPort(server.Port(), source))
+			for _, prefix := range allow {
+				rule(chain, nftMatchAddress(prefix, source))
+			}
+			if hook == "input" {
+				rule(chain, established)
+			}
+
+			// DHCP, DHCPv6 and neighbor discovery
+			for _, port := range []uint16{67, 68, 546, 547} {
+				rule(chain, nftMatchUDPPort(port, false))
+			}
+			for _, icmpType := range []byte{133, 134, 135, 136} {
+				rule(chain, nftMatchICMPv6Type(icmpType))
+			}
+		}
+	}
+}
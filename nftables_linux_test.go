@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/binary"
+	"maps"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// nftTestRule is a rule as it goes to the kernel: its chain and the names
+// of its expressions in order
+type nftTestRule struct {
+	chain string
+	exprs []string
+}
+
+// nftTestBuild runs build against a fake netlink connection and returns the
+// rules it adds
+func nftTestBuild(t *testing.T, build nftBuilder) []nftTestRule {
+	t.Helper()
+	newRule := netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8 | unix.NFT_MSG_NEWRULE)
+	var rules []nftTestRule
+	c, err := nftables.New(nftables.WithTestDial(func(req []netlink.Message) ([]netlink.Message, error) {
+		for _, msg := range req {
+			if msg.Header.Type != newRule {
+				continue
+			}
+			rule, err := nftDecodeRule(msg.Data[4:]) // After the nfgenmsg header
+			if err != nil {
+				t.Fatal(err)
+			}
+			rules = append(rules, rule)
+		}
+		return req, nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := c.AddTable(&nftables.Table{Family: nftables.TableFamilyINet, Name: NFT_TABLE})
+	build(c, table)
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return rules
+}
+
+// nftDecodeRule decodes the chain and expression names of a NEWRULE message
+func nftDecodeRule(data []byte) (nftTestRule, error) {
+	var rule nftTestRule
+	ad, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return rule, err
+	}
+	ad.ByteOrder = binary.BigEndian
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.NFTA_RULE_CHAIN:
+			rule.chain = ad.String()
+		case unix.NFTA_RULE_EXPRESSIONS:
+			ad.Nested(func(list *netlink.AttributeDecoder) error {
+				for list.Next() {
+					list.Nested(func(elem *netlink.AttributeDecoder) error {
+						for elem.Next() {
+							if elem.Type() == unix.NFTA_EXPR_NAME {
+								rule.exprs = append(rule.exprs, elem.String())
+							}
+						}
+						return nil
+					})
+				}
+				return nil
+			})
+		}
+	}
+	return rule, ad.Err()
+}
+
+// nftTestChains counts the rules per chain
+func nftTestChains(rules []nftTestRule) map[string]int {
+	chains := make(map[string]int)
+	for _, rule := range rules {
+		chains[rule.chain]++
+	}
+	return chains
+}
+
+func TestNftNATRules(t *testing.T) {
+	subnet := netip.MustParsePrefix("10.8.0.0/24")
+	tests := []struct {
+		name   string
+		egress string
+		snat   netip.Addr
+		mss    uint16
+		chains map[string]int
+		target string // Expression that ends the postrouting rule
+	}{
+		{"masquerade", "eth0", netip.Addr{}, 0, map[string]int{"postrouting": 1, "forward": 2}, "masq"},
+		{"snat", "eth0", netip.MustParseAddr("203.0.113.1"), 0, map[string]int{"postrouting": 1, "forward": 2}, "nat"},
+		{"mss clamp", "eth0", netip.Addr{}, 1380, map[string]int{"postrouting": 1, "forward": 4}, "masq"},
+		{"forwarding only", "", netip.Addr{}, 0, map[string]int{"forward": 2}, ""},
+	}
+	for _, tt := range tests {
+		rules := nftTestBuild(t, nftNATRules(subnet, "tun0", tt.egress, tt.snat, tt.mss))
+		if got := nftTestChains(rules); !maps.Equal(got, tt.chains) {
+			t.Errorf("%s: rules per chain %v, want %v", tt.name, got, tt.chains)
+		}
+		clamps := 0
+		for _, rule := range rules {
+			if rule.chain == "postrouting" && rule.exprs[len(rule.exprs)-1] != tt.target {
+				t.Errorf("%s: postrouting rule ends in %s, want %s", tt.name, rule.exprs[len(rule.exprs)-1], tt.target)
+			}
+			if slices.Contains(rule.exprs, "exthdr") {
+				clamps++
+			}
+		}
+		want := 0
+		if tt.mss != 0 {
+			want = 2 // Into and out of the tunnel
+		}
+		if clamps != want {
+			t.Errorf("%s: %d MSS clamp rules, want %d", tt.name, clamps, want)
+		}
+	}
+}
+
+func TestNftMatchAddress(t *testing.T) {
+	tests := []struct {
+		prefix string
+		source bool
+		proto  byte
+		offset uint32
+		len    uint32
+	}{
+		{"10.8.0.0/24", true, unix.NFPROTO_IPV4, 12, 4},
+		{"10.8.0.0/24", false, unix.NFPROTO_IPV4, 16, 4},
+		{"fd00:8::/64", true, unix.NFPROTO_IPV6, 8, 16},
+		{"fd00:8::/64", false, unix.NFPROTO_IPV6, 24, 16},
+	}
+	for _, tt := range tests {
+		exprs := nftMatchAddress(netip.MustParsePrefix(tt.prefix), tt.source)
+		proto := exprs[1].(*expr.Cmp).Data
+		payload := exprs[2].(*expr.Payload)
+		if proto[0] != tt.proto || payload.Offset != tt.offset || payload.Len != tt.len {
+			t.Errorf("%s source %v: protocol %d, offset %d, length %d", tt.prefix, tt.source, proto[0], payload.Offset, payload.Len)
+		}
+		if want := netip.MustParsePrefix(tt.prefix).Addr().AsSlice(); !slices.Equal(exprs[4].(*expr.Cmp).Data, want) {
+			t.Errorf("%s: compares with %x", tt.prefix, exprs[4].(*expr.Cmp).Data)
+		}
+	}
+
+	// Host bits are masked off
+	exprs := nftMatchAddress(netip.MustParsePrefix("10.8.0.1/24"), true)
+	if got := exprs[4].(*expr.Cmp).Data; !slices.Equal(got, []byte{10, 8, 0, 0}) {
+		t.Errorf("10.8.0.1/24 compares with %v", got)
+	}
+}
+
+// The mark is saved in the connection on the way out and restored on replies
+func TestNftPolicyMarkRules(t *testing.T) {
+	rules := nftTestBuild(t, nftPolicyMarkRules(0xca6c))
+	want := []nftTestRule{
+		{"premangle", []string{"ct", "cmp", "meta"}},
+		{"postmangle", []string{"meta", "cmp", "ct"}},
+	}
+	if len(rules) != len(want) {
+		t.Fatalf("rules %v, want %v", rules, want)
+	}
+	for i := range want {
+		if rules[i].chain != want[i].chain || !slices.Equal(rules[i].exprs, want[i].exprs) {
+			t.Errorf("rule %d: %v, want %v", i, rules[i], want[i])
+		}
+	}
+}
+
+// Everything but loopback, the tunnel, the server flow, the allowed prefixes
+// and what keeps the underlay up falls through to the drop policy
+func TestNftKillSwitchRules(t *testing.T) {
+	server := netip.MustParseAddrPort("203.0.113.7:51820")
+	allow := []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24"), netip.MustParsePrefix("fd12::/48")}
+	tests := []struct {
+		name   string
+		tun    string
+		allow  []netip.Prefix
+		chains map[string]int
+	}{
+		// lo, tun, server, allowed, established (input only), DHCP 4, ND 4
+		{"connected", "tun0", allow, map[string]int{"input": 14, "output": 13}},
+		{"before the tunnel exists", "", nil, map[string]int{"input": 11, "output": 10}},
+	}
+	for _, tt := range tests {
+		rules := nftTestBuild(t, nftKillSwitchRules(server, tt.tun, tt.allow))
+		if got := nftTestChains(rules); !maps.Equal(got, tt.chains) {
+			t.Errorf("%s: rules per chain %v, want %v", tt.name, got, tt.chains)
+		}
+		for _, rule := range rules {
+			if rule.exprs[len(rule.exprs)-1] != "immediate" {
+				t.Errorf("%s: %s rule %v does not end in a verdict", tt.name, rule.chain, rule.exprs)
+			}
+		}
+	}
+}
@@ -0,0 +1,37 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net/netip"
+)
+
+// Our nftables tables; nftables only exists on Linux
+const (
+	NFT_TABLE             = "cipherwall"
+	NFT_KILL_SWITCH_TABLE = "cipherwall-killswitch"
+)
+
+type nftBuilder func()
+
+func nftReplaceTable(family, name string, build nftBuilder) error {
+	return errors.ErrUnsupported
+}
+
+func nftDeleteTable(family, name string) error {
+	return errors.ErrUnsupported
+}
+
+func nftNATRules(subnet netip.Prefix, tun, egress string, snat netip.Addr, mss uint16) nftBuilder {
+	return nil
+}
+
+func nftPolicyMarkRules(mark uint32) nftBuilder {
+	return nil
+}
+
+func nftKillSwitchRules(server netip.AddrPort, tun string, allow []netip.Prefix) nftBuilder {
+	return nil
+}
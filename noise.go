@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Noise protocol primitives for Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s
+const (
+	NOISE_CONSTRUCTION = "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s"
+	NOISE_IDENTIFIER   = "CipherWall v1 handshake"
+	NOISE_KEY_LEN      = 32
+
+	// Label used to turn the PBKDF2 master key into the Noise pre-shared key
+	LABEL_HANDSHAKE_PSK = "cipherwall handshake psk"
+)
+
+type noisePublicKey [NOISE_KEY_LEN]byte
+type noisePrivateKey [NOISE_KEY_LEN]byte
+
+var errWeakPublicKey = errors.New("invalid public key (low order point)")
+
+// newPrivateKey generates a clamped X25519 private key
+func newPrivateKey() (noisePrivateKey, error) {
+	var k noisePrivateKey
+	if _, err := io.ReadFull(rand.Reader, k[:]); err != nil {
+		return k, fmt.Errorf("failed to generate private key: %w", err)
+	}
+	k.clamp()
+	return k, nil
+}
+
+func (k *noisePrivateKey) clamp() {
+	k[0] &= 248
+	k[31] = (k[31] & 127) | 64
+}
+
+func (k noisePrivateKey) publicKey() noisePublicKey {
+	var pub noisePublicKey
+	curve25519.ScalarBaseMult((*[32]byte)(&pub), (*[32]byte)(&k))
+	return pub
+}
+
+// sharedSecret runs X25519 and rejects all-zero outputs
+func (k noisePrivateKey) sharedSecret(pub noisePublicKey) ([NOISE_KEY_LEN]byte, error) {
+	var ss [NOISE_KEY_LEN]byte
+	out, err := curve25519.X25519(k[:], pub[:])
+	if err != nil {
+		return ss, errWeakPublicKey
+	}
+	copy(ss[:], out)
+	return ss, nil
+}
+
+func (k noisePublicKey) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+func (k noisePrivateKey) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// parsePublicKey decodes a base64 X25519 public key
+func parsePublicKey(s string) (noisePublicKey, error) {
+	var k noisePublicKey
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return k, fmt.Errorf("invalid public key encoding: %w", err)
+	}
+	if len(raw) != NOISE_KEY_LEN {
+		return k, fmt.Errorf("public key must be %d bytes, got %d", NOISE_KEY_LEN, len(raw))
+	}
+	copy(k[:], raw)
+	return k, nil
+}
+
+// parsePrivateKey decodes a base64 X25519 private key
+func parsePrivateKey(s string) (noisePrivateKey, error) {
+	var k noisePrivateKey
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return k, fmt.Errorf("invalid private key encoding: %w", err)
+	}
+	if len(raw) != NOISE_KEY_LEN {
+		return k, fmt.Errorf("private key must be %d bytes, got %d", NOISE_KEY_LEN, len(raw))
+	}
+	copy(k[:], raw)
+	k.clamp()
+	return k, nil
+}
+
+// parsePresharedKey decodes a base64 32-byte handshake PSK
+func parsePresharedKey(s string) ([NOISE_KEY_LEN]byte, error) {
+	var k [NOISE_KEY_LEN]byte
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return k, fmt.Errorf("invalid PSK encoding: %w", err)
+	}
+	if len(raw) != NOISE_KEY_LEN {
+		return k, fmt.Errorf("PSK must be %d bytes, got %d", NOISE_KEY_LEN, len(raw))
+	}
+	copy(k[:], raw)
+	return k, nil
+}
+
+// loadOrCreatePrivateKey reads a base64 private key from path, generating and
+// saving a new one (mode 0600) if the file does not exist yet
+func loadOrCreatePrivateKey(path string) (noisePrivateKey, bool, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		k, err := parsePrivateKey(string(data))
+		if err != nil {
+			return k, false, fmt.Errorf("failed to parse key file %s: %w", path, err)
+		}
+		return k, false, nil
+	}
+	if !os.IsNotExist(err) {
+		return noisePrivateKey{}, false, fmt.Errorf("failed to read key file %s: %w", path, err)
+	}
+
+	k, err := newPrivateKey()
+	if err != nil {
+		return k, false, err
+	}
+	if err := os.WriteFile(path, []byte(k.String()+"\n"), 0600); err != nil {
+		return k, false, fmt.Errorf("failed to write key file %s: %w", path, err)
+	}
+	return k, true, nil
+}
+
+// deriveHandshakePSK turns the PBKDF2 master key into the 32-byte Noise PSK
+func deriveHandshakePSK(masterKey []byte) ([NOISE_KEY_LEN]byte, error) {
+	var psk [NOISE_KEY_LEN]byte
+	if _, err := io.ReadFull(hkdf.New(sha256.New, masterKey, nil, []byte(LABEL_HANDSHAKE_PSK)), psk[:]); err != nil {
+		return psk, fmt.Errorf("failed to derive handshake PSK: %w", err)
+	}
+	return psk, nil
+}
+
+func newBlake2s() hash.Hash {
+	h, _ := blake2s.New256(nil)
+	return h
+}
+
+// mixHash sets h = HASH(h || data)
+func mixHash(h *[blake2s.Size]byte, data []byte) {
+	hash := newBlake2s()
+	hash.Write(h[:])
+	hash.Write(data)
+	hash.Sum(h[:0])
+}
+
+func hmacBlake2s(key []byte, inputs ...[]byte) [blake2s.Size]byte {
+	var out [blake2s.Size]byte
+	mac := hmac.New(newBlake2s, key)
+	for _, in := range inputs {
+		mac.Write(in)
+	}
+	mac.Sum(out[:0])
+	return out
+}
+
+// noiseKDF is the Noise HKDF with HMAC-BLAKE2s, returning n (1 to 3) outputs
+func noiseKDF(chainKey [blake2s.Size]byte, input []byte, n int) [][blake2s.Size]byte {
+	prk := hmacBlake2s(chainKey[:], input)
+	outputs := make([][blake2s.Size]byte, n)
+	prev := []byte{}
+	for i := 0; i < n; i++ {
+		outputs[i] = hmacBlake2s(prk[:], prev, []byte{byte(i + 1)})
+		prev = outputs[i][:]
+	}
+	return outputs
+}
+
+// noiseSeal encrypts a handshake field with a single-use key (nonce zero)
+func noiseSeal(key [NOISE_KEY_LEN]byte, plaintext, ad []byte) []byte {
+	aead, _ := chacha20poly1305.New(key[:])
+	return aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), plaintext, ad)
+}
+
+// noiseOpen decrypts a handshake field sealed with noiseSeal
+func noiseOpen(key [NOISE_KEY_LEN]byte, ciphertext, ad []byte) ([]byte, error) {
+	aead, _ := chacha20poly1305.New(key[:])
+	return aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), ciphertext, ad)
+}
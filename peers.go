@@ -0,0 +1,193 @@
+//go:build !client
+// +build !client
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// How often the peers file is checked for changes
+const PEERS_RELOAD_INTERVAL = time.Second
+
+// peerConfig is one entry of the peers file or the config file's peers list:
+//
+//	[{"name": "laptop", "public_key": "<base64>", "psk": "<optional base64>"}]
+type peerConfig struct {
+	Name      string `json:"name" yaml:"name"`
+	PublicKey string `json:"public_key" yaml:"public_key"`
+	PSK       string `json:"psk,omitempty" yaml:"psk"` // Per-peer PSK, replaces the shared one for this peer
+}
+
+// peer is a client allowed to connect, identified by its static public key
+type peer struct {
+	name   string
+	static noisePublicKey
+	psk    [NOISE_KEY_LEN]byte
+}
+
+// peerList maps static public keys to registered peers. A list is never
+// modified once loaded; reloading builds a new one.
+type peerList map[noisePublicKey]*peer
+
+// readPeerConfigs collects the peers listed in the config file and the
+// peers file. Either path may be empty, and a missing peers file adds none.
+func readPeerConfigs(configPath, peersFile string) ([]peerConfig, error) {
+	var configs []peerConfig
+
+	if configPath != "" {
+		data, err := os.ReadFile(configPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+		var file struct {
+			Peers []peerConfig `yaml:"peers"`
+		}
+		if err := yaml.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", configPath, err)
+		}
+		configs = append(configs, file.Peers...)
+	}
+
+	if peersFile == "" {
+		return configs, nil
+	}
+	data, err := os.ReadFile(peersFile)
+	if os.IsNotExist(err) {
+		return configs, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read peers file %s: %w", peersFile, err)
+	}
+	var listed []peerConfig
+	if err := json.Unmarshal(data, &listed); err != nil {
+		return nil, fmt.Errorf("failed to parse peers file %s: %w", peersFile, err)
+	}
+	return append(configs, listed...), nil
+}
+
+// buildPeerList parses peer entries. Peers without their own PSK use
+// defaultPSK. An empty list is valid, but no client can connect.
+func buildPeerList(configs []peerConfig, defaultPSK [NOISE_KEY_LEN]byte) (peerList, error) {
+	var err error
+	peers := make(peerList, len(configs))
+	for i, cfg := range configs {
+		p := &peer{name: cfg.Name, psk: defaultPSK}
+		if p.static, err = parsePublicKey(cfg.PublicKey); err != nil {
+			return nil, fmt.Errorf("peer %d (%s): %w", i+1, cfg.Name, err)
+		}
+		if cfg.PSK != "" {
+			if p.psk, err = parsePresharedKey(cfg.PSK); err != nil {
+				return nil, fmt.Errorf("peer %d (%s): %w", i+1, cfg.Name, err)
+			}
+		}
+		if p.name == "" {
+			p.name = p.static.String()
+		}
+		if _, exists := peers[p.static]; exists {
+			return nil, fmt.Errorf("peer %d (%s): duplicate public key", i+1, cfg.Name)
+		}
+		peers[p.static] = p
+	}
+	return peers, nil
+}
+
+// loadPeers reads the registered peers from the config and peers files
+func (s *Server) loadPeers() (peerList, error) {
+	configs, err := readPeerConfigs(s.cfg.path, s.cfg.PeersFile)
+	if err != nil {
+		return nil, err
+	}
+	return buildPeerList(configs, s.handshakePSK)
+}
+
+// setupPeers loads the registered peers and starts watching their files for
+// changes
+func (s *Server) setupPeers() error {
+	lastMod := s.peersModTime()
+	peers, err := s.loadPeers()
+	if err != nil {
+		return err
+	}
+	if len(peers) == 0 {
+		log.Println("⚠️  No peers registered, no client can connect yet")
+	}
+	s.peers.Store(&peers)
+	log.Printf("👥 Loaded %d peer(s)", len(peers))
+	s.releaseLeases(peers)
+
+	go s.watchPeers(lastMod)
+	return nil
+}
+
+// watchPeers reloads the peers whenever the config or peers file changes
+func (s *Server) watchPeers(lastMod [2]time.Time) {
+	for range time.Tick(PEERS_RELOAD_INTERVAL) {
+		mod := s.peersModTime()
+		if mod == lastMod {
+			continue
+		}
+		lastMod = mod
+		if err := s.reloadPeers(); err != nil {
+			log.Printf("⚠️  Keeping previous peer list: %v", err)
+		}
+	}
+}
+
+// reloadPeers replaces the peer list with the one in the files. Sessions of
+// peers that were removed or whose PSK changed are dropped at once, and
+// removed peers lose their leases. Files that fail to parse keep the
+// previous list. Only the peers are reloaded; other settings need a
+// restart.
+func (s *Server) reloadPeers() error {
+	peers, err := s.loadPeers()
+	if err != nil {
+		return err
+	}
+	old := *s.peers.Swap(&peers)
+
+	for static, p := range old {
+		if next := peers[static]; next == nil || next.psk != p.psk {
+			if s.sessions.remove(static) {
+				log.Printf("🚫 Peer %s removed, session closed", p.name)
+			}
+		}
+	}
+	log.Printf("👥 Reloaded %d peer(s)", len(peers))
+	s.releaseLeases(peers)
+	return nil
+}
+
+// releaseLeases frees the tunnel addresses of clients that are not peers
+func (s *Server) releaseLeases(peers peerList) {
+	if n := s.pool.retain(peers); n > 0 {
+		log.Printf("🧹 Released the addresses of %d removed peer(s)", n)
+	}
+}
+
+// peersModTime returns the modification times of the config and peers
+// files, zero for files that are not set or do not exist
+func (s *Server) peersModTime() [2]time.Time {
+	var mod [2]time.Time
+	for i, path := range []string{s.cfg.path, s.cfg.PeersFile} {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			mod[i] = info.ModTime()
+		}
+	}
+	return mod
+}
+
+// lookupPeer returns the registered peer with the given static key
+func (s *Server) lookupPeer(static noisePublicKey) (*peer, bool) {
+	p, ok := (*s.peers.Load())[static]
+	return p, ok
+}
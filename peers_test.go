@@ -0,0 +1,173 @@
+//go:build !client
+// +build !client
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testPublicKey returns the base64 public key of a fresh static key
+func testPublicKey(t *testing.T) (noisePublicKey, string) {
+	t.Helper()
+	static, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return static.publicKey(), static.publicKey().String()
+}
+
+// writePeers writes a peers file
+func writePeers(t *testing.T, path string, peers []peerConfig) {
+	t.Helper()
+	data, err := json.Marshal(peers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuildPeerList(t *testing.T) {
+	key1, b64 := testPublicKey(t)
+	_, other := testPublicKey(t)
+	psk := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", NOISE_KEY_LEN)))
+	defaultPSK := [NOISE_KEY_LEN]byte{1}
+
+	peers, err := buildPeerList([]peerConfig{{PublicKey: b64}, {Name: "laptop", PublicKey: other, PSK: psk}}, defaultPSK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := peers[key1]; p == nil || p.name != b64 || p.psk != defaultPSK {
+		t.Errorf("unnamed peer without PSK: %+v", p)
+	}
+	for _, p := range peers {
+		if p.name == "laptop" && p.psk == defaultPSK {
+			t.Error("per-peer PSK ignored")
+		}
+	}
+
+	bad := []struct {
+		name    string
+		configs []peerConfig
+	}{
+		{"duplicate key", []peerConfig{{Name: "a", PublicKey: b64}, {Name: "b", PublicKey: b64}}},
+		{"bad key", []peerConfig{{Name: "a", PublicKey: "not-a-key"}}},
+		{"bad psk", []peerConfig{{Name: "a", PublicKey: b64, PSK: "short"}}},
+	}
+	for _, tt := range bad {
+		if _, err := buildPeerList(tt.configs, defaultPSK); err == nil {
+			t.Errorf("%s accepted", tt.name)
+		}
+	}
+}
+
+func TestReadPeerConfigs(t *testing.T) {
+	dir := t.TempDir()
+	_, key1 := testPublicKey(t)
+	_, key2 := testPublicKey(t)
+	config := filepath.Join(dir, "cipherwall.yaml")
+	if err := os.WriteFile(config, []byte("listen: [\":51820\"]\npeers:\n  - name: desk\n    public_key: "+key1+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	peersFile := filepath.Join(dir, "peers.json")
+	writePeers(t, peersFile, []peerConfig{{Name: "phone", PublicKey: key2}})
+
+	configs, err := readPeerConfigs(config, peersFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 2 || configs[0].Name != "desk" || configs[1].Name != "phone" {
+		t.Errorf("read %+v, want desk from the config and phone from the peers file", configs)
+	}
+
+	if configs, err = readPeerConfigs("", filepath.Join(dir, "missing.json")); err != nil || len(configs) != 0 {
+		t.Errorf("missing peers file: %+v, %v", configs, err)
+	}
+	if err := os.WriteFile(peersFile, []byte("[{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readPeerConfigs("", peersFile); err == nil {
+		t.Error("corrupt peers file accepted")
+	}
+}
+
+// Removing a peer closes its session and frees its addresses; changing its
+// PSK closes the session but keeps the addresses; a broken file changes
+// nothing
+func TestReloadPeers(t *testing.T) {
+	dir := t.TempDir()
+	peersFile := filepath.Join(dir, "peers.json")
+	pool, err := newIPPool("10.8.0.0/24", "", filepath.Join(dir, "leases.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{cfg: &serverConfig{PeersFile: peersFile}, pool: pool, sessions: newSessionTable()}
+
+	keys := make([]noisePublicKey, 3)
+	configs := make([]peerConfig, 3)
+	for i := range keys {
+		var b64 string
+		keys[i], b64 = testPublicKey(t)
+		configs[i] = peerConfig{Name: []string{"kept", "rekeyed", "removed"}[i], PublicKey: b64}
+	}
+	writePeers(t, peersFile, configs)
+	peers, err := s.loadPeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.peers.Store(&peers)
+
+	leases := make([]netip.Prefix, len(keys))
+	for i, static := range keys {
+		addrs, err := pool.lease(static)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leases[i] = addrs[0]
+		_, server, err := testKeypairs(uint32(20 + i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.sessions.installKeypair(peers[static], 1, server, []netip.Addr{addrs[0].Addr()}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	configs[1].PSK = base64.StdEncoding.EncodeToString([]byte(strings.Repeat("p", NOISE_KEY_LEN)))
+	writePeers(t, peersFile, configs[:2])
+	if err := s.reloadPeers(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := s.lookupPeer(keys[2]); ok {
+		t.Error("removed peer still registered")
+	}
+	for i, want := range []bool{true, false, false} {
+		if _, ok := s.sessions.byKey[keys[i]]; ok != want {
+			t.Errorf("%s: session kept %v, want %v", configs[i].Name, ok, want)
+		}
+	}
+	for i, want := range []bool{true, true, false} {
+		if _, ok := pool.leases[keys[i]]; ok != want {
+			t.Errorf("%s: lease kept %v, want %v", configs[i].Name, ok, want)
+		}
+	}
+
+	if err := os.WriteFile(peersFile, []byte("[{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.reloadPeers(); err == nil {
+		t.Fatal("corrupt peers file loaded")
+	}
+	if _, ok := s.lookupPeer(keys[0]); !ok {
+		t.Error("peer list lost on a corrupt file")
+	}
+}
@@ -0,0 +1,362 @@
+//go:build !client
+// +build !client
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTUN stands in for the TUN interface: packets written to in are read by
+// the server, packets the server writes come out of out
+type fakeTUN struct {
+	in     chan []byte
+	out    chan []byte
+	closed chan struct{}
+}
+
+func newFakeTUN() *fakeTUN {
+	return &fakeTUN{in: make(chan []byte, 64), out: make(chan []byte, 1024), closed: make(chan struct{})}
+}
+
+func (tun *fakeTUN) Name() string { return "tun-test" }
+
+func (tun *fakeTUN) Read(buffer []byte) (int, error) {
+	select {
+	case packet := <-tun.in:
+		return copy(buffer, packet), nil
+	case <-tun.closed:
+		return 0, os.ErrClosed
+	}
+}
+
+func (tun *fakeTUN) Write(packet []byte) (int, error) {
+	select {
+	case tun.out <- append([]byte(nil), packet...):
+		return len(packet), nil
+	case <-tun.closed:
+		return 0, os.ErrClosed
+	}
+}
+
+// testIPv4Packet returns a bare IPv4 header with a payload of size bytes
+func testIPv4Packet(src, dst netip.Addr, size int) []byte {
+	packet := make([]byte, 20+size)
+	packet[0] = 0x45
+	packet[2], packet[3] = byte(len(packet)>>8), byte(len(packet))
+	packet[9] = 17
+	copy(packet[12:16], src.AsSlice())
+	copy(packet[16:20], dst.AsSlice())
+	return packet
+}
+
+// testServer starts the packet handlers of a server on a loopback socket
+// and a fake TUN interface, with the given clients as its peers
+func testServer(t *testing.T, statics []noisePrivateKey) (*Server, *fakeTUN, *net.UDPAddr) {
+	t.Helper()
+	serverStatic, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := newIPPool("10.8.0.0/24", "", filepath.Join(t.TempDir(), "leases.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers := make(peerList)
+	for i, static := range statics {
+		p := &peer{name: fmt.Sprintf("client%d", i), static: static.publicKey()}
+		peers[p.static] = p
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun := newFakeTUN()
+
+	s := &Server{
+		cfg: &serverConfig{
+			MTU:        1420,
+			PushRoutes: []netip.Prefix{netip.MustParsePrefix("192.168.50.0/24")},
+			DNS:        []netip.Addr{netip.MustParseAddr("10.8.0.1")},
+			DNSSearch:  []string{"corp.example"},
+		},
+		staticKey:     serverStatic,
+		allowedSuites: []cipherSuite{suiteChaCha20Poly1305, suiteAES256GCM},
+		iface:         tun,
+		conns:         []*net.UDPConn{conn},
+		pool:          pool,
+		sessions:      newSessionTable(),
+		fragments:     newReassembler(),
+	}
+	s.peers.Store(&peers)
+
+	var handlers sync.WaitGroup
+	handlers.Add(2)
+	go func() {
+		defer handlers.Done()
+		s.handleIncomingPackets(conn)
+	}()
+	go func() {
+		defer handlers.Done()
+		s.handleOutgoingPackets()
+	}()
+	t.Cleanup(func() {
+		conn.Close()
+		close(tun.closed)
+		handlers.Wait()
+	})
+	return s, tun, conn.LocalAddr().(*net.UDPAddr)
+}
+
+// testClient is the client end of a tunnel to a test server
+type testClient struct {
+	conn   *net.UDPConn
+	kp     *keypair
+	addr   netip.Addr        // Leased tunnel address
+	pushed handshakeResponse // What the server sent in its response
+}
+
+// dialTestServer runs a handshake with the server and confirms the keys
+func dialTestServer(static noisePrivateKey, server noisePublicKey, addr *net.UDPAddr, suite cipherSuite) (*testClient, error) {
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(handshakeInit{Timestamp: time.Now().UnixNano(), Suites: []cipherSuite{suite}})
+	if err != nil {
+		return nil, err
+	}
+	hs, msg, err := createInitiation(static, server, 1, payload)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	buffer := make([]byte, MAX_DATAGRAM_SIZE)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buffer)
+	if err != nil {
+		return nil, fmt.Errorf("no handshake response: %w", err)
+	}
+	payload, err = hs.consumeResponse([NOISE_KEY_LEN]byte{}, buffer[:n])
+	if err != nil {
+		return nil, err
+	}
+	var resp handshakeResponse
+	if err := json.Unmarshal(payload, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Suite != suite || len(resp.Addresses) != 1 {
+		return nil, fmt.Errorf("unexpected handshake response %+v", resp)
+	}
+	kp, err := hs.deriveKeypair(resp.Suite, true)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &testClient{conn: conn, kp: kp, addr: resp.Addresses[0].Addr(), pushed: resp}
+	return c, c.send(nil)
+}
+
+// send seals a packet and sends it to the server
+func (c *testClient) send(packet []byte) error {
+	frame, err := c.kp.seal(packet)
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.Write(frame)
+	return err
+}
+
+// receive returns the next packet from the server
+func (c *testClient) receive() ([]byte, error) {
+	buffer := make([]byte, MAX_DATAGRAM_SIZE)
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := c.conn.Read(buffer)
+	if err != nil {
+		return nil, err
+	}
+	return openFrame(c.kp, buffer[:n])
+}
+
+// Several clients handshake and exchange traffic with the TUN side through
+// the real packet handlers at once, with replies routed back to each
+// client by address. Run it with -race.
+func TestServerPipeline(t *testing.T) {
+	const (
+		clients = 6
+		packets = 20 // Each way, per client
+	)
+	statics := make([]noisePrivateKey, clients)
+	for i := range statics {
+		var err error
+		if statics[i], err = newPrivateKey(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, tun, addr := testServer(t, statics)
+	gateway := netip.MustParseAddr("10.8.0.1")
+
+	// The TUN side answers each client once all its packets arrived
+	received := make(map[netip.Addr]int)
+	tunErrs := make(chan error, 1)
+	go func() {
+		for total := 0; total < clients*packets; total++ {
+			var packet []byte
+			select {
+			case packet = <-tun.out:
+			case <-time.After(10 * time.Second):
+				tunErrs <- fmt.Errorf("TUN got %d of %d packets", total, clients*packets)
+				return
+			}
+			src, dst, ok := packetAddrs(packet)
+			if !ok || dst != gateway {
+				tunErrs <- fmt.Errorf("unexpected packet on TUN: %x", packet)
+				return
+			}
+			if received[src]++; received[src] < packets {
+				continue
+			}
+			for i := 0; i < packets; i++ {
+				tun.in <- testIPv4Packet(gateway, src, 100+i)
+			}
+		}
+		tunErrs <- nil
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			suite := []cipherSuite{suiteChaCha20Poly1305, suiteAES256GCM}[i%2]
+			c, err := dialTestServer(statics[i], s.staticKey.publicKey(), addr, suite)
+			if err != nil {
+				errs <- fmt.Errorf("client %d: %w", i, err)
+				return
+			}
+			defer c.conn.Close()
+
+			for j := 0; j < packets; j++ {
+				if err := c.send(testIPv4Packet(c.addr, gateway, 50+j)); err != nil {
+					errs <- fmt.Errorf("client %d: %w", i, err)
+					return
+				}
+			}
+			for j := 0; j < packets; j++ {
+				packet, err := c.receive()
+				if err != nil {
+					errs <- fmt.Errorf("client %d, reply %d: %w", i, j, err)
+					return
+				}
+				if _, dst, ok := packetAddrs(packet); !ok || dst != c.addr {
+					errs <- fmt.Errorf("client %d got a packet for %s", i, dst)
+					return
+				}
+			}
+
+			// A forged source address never reaches the TUN side
+			if err := c.send(testIPv4Packet(netip.MustParseAddr("10.8.0.250"), gateway, 10)); err != nil {
+				errs <- fmt.Errorf("client %d: %w", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if err := <-tunErrs; err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(received); n != clients {
+		t.Errorf("TUN got packets from %d clients, want %d", n, clients)
+	}
+	select {
+	case packet := <-tun.out:
+		t.Errorf("forged packet reached the TUN side: %x", packet)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if n := len(s.sessions.active()); n != clients {
+		t.Errorf("%d active sessions, want %d", n, clients)
+	}
+}
+
+// The handshake response carries the server's DNS settings and routes
+func TestServerPushesSettings(t *testing.T) {
+	static, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _, addr := testServer(t, []noisePrivateKey{static})
+	c, err := dialTestServer(static, s.staticKey.publicKey(), addr, suiteChaCha20Poly1305)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.conn.Close()
+
+	if !slices.Equal(c.pushed.DNS, s.cfg.DNS) || !slices.Equal(c.pushed.Search, s.cfg.DNSSearch) {
+		t.Errorf("pushed DNS %v search %v, want %v search %v", c.pushed.DNS, c.pushed.Search, s.cfg.DNS, s.cfg.DNSSearch)
+	}
+	if !slices.Equal(c.pushed.Routes, s.cfg.PushRoutes) {
+		t.Errorf("pushed routes %v, want %v", c.pushed.Routes, s.cfg.PushRoutes)
+	}
+}
+
+// The server answers keepalives and path MTU probes, and caps what it sends
+// a client at the path MTU the client reports
+func TestServerControlMessages(t *testing.T) {
+	static, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _, addr := testServer(t, []noisePrivateKey{static})
+	c, err := dialTestServer(static, s.staticKey.publicKey(), addr, suiteChaCha20Poly1305)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.conn.Close()
+
+	if err := c.send([]byte{CONTROL_KEEPALIVE}); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := c.receive(); err != nil || len(reply) != 1 || reply[0] != CONTROL_KEEPALIVE_ACK {
+		t.Fatalf("keepalive answered with %x, %v", reply, err)
+	}
+
+	if err := c.send(pmtuMessage(CONTROL_PMTU_PROBE, 42, 1200)); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := c.receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := parsePMTUMessage(reply); err != nil || reply[0] != CONTROL_PMTU_ACK || id != 42 || len(reply) != 1200 {
+		t.Fatalf("probe answered with %d bytes of type %d for %d, %v", len(reply), reply[0], id, err)
+	}
+
+	if err := c.send(pmtuReport(1300)); err != nil {
+		t.Fatal(err)
+	}
+	sess := s.sessions.active()[0]
+	deadline := time.Now().Add(5 * time.Second)
+	for sess.maxDatagram() != 1300+FRAME_OVERHEAD {
+		if time.Now().After(deadline) {
+			t.Fatalf("max datagram %d after a path MTU report of 1300", sess.maxDatagram())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
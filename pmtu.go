@@ -0,0 +1,194 @@
+//go:build client
+// +build client
+
+package main
+
+import (
+	"log"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Path MTU discovery in the style of DPLPMTUD (RFC 8899): the client sends
+// padded probes through the tunnel and the server answers each with an ack
+// of the same size. The largest probe that is acked becomes the TUN MTU, and
+// is reported to the server so it splits bigger frames for this client.
+const (
+	PMTU_PROBE_TIMEOUT    = time.Second
+	PMTU_PROBE_ATTEMPTS   = 3 // Probes of one size before the size counts as too big
+	PMTU_SEARCH_PRECISION = 8 // The search stops once the range is this narrow
+	PMTU_REPROBE_INTERVAL = 10 * time.Minute
+
+	// Data sent this long without any coming back, while the server still
+	// answers keepalives, looks like a black hole for big packets
+	PMTU_BLACKHOLE_TIMEOUT = 10 * time.Second
+)
+
+var (
+	// Ids of acked probes, passed from the UDP reader to the prober
+	pmtuAcks = make(chan uint32, 8)
+
+	// Reasons to search again before PMTU_REPROBE_INTERVAL is up
+	pmtuSearches = make(chan string, 1)
+
+	// Unix nanoseconds of the last tunnel packet sent and received, without
+	// control messages
+	lastDataSent     atomic.Int64
+	lastDataReceived atomic.Int64
+)
+
+// discoverPathMTU searches for the path MTU now, every
+// PMTU_REPROBE_INTERVAL after and whenever it is asked to, and moves the TUN
+// MTU to it. The search stays between floor and ceiling, the configured or
+// underlay MTU.
+func discoverPathMTU(floor, ceiling int) {
+	defer cleanupOnPanic()
+	for {
+		mtu, ok := searchPathMTU(floor, ceiling, probePathMTU)
+		current := int(metrics.tunMTU.Load())
+		switch {
+		case !ok:
+			log.Printf("⚠️  No answer to path MTU probes, keeping TUN MTU %d", current)
+		case mtu == current:
+			debugf("📏 Path MTU confirmed at %d", mtu)
+		default:
+			if err := setTunnelMTU(mtu); err != nil {
+				log.Printf("⚠️  Failed to change TUN MTU to %d: %v", mtu, err)
+			} else {
+				log.Printf("📏 Path MTU is %d, TUN MTU changed from %d", mtu, current)
+			}
+		}
+		if ok {
+			metrics.pathMTU.Store(int64(mtu))
+			// The server sends no bigger packets than this either
+			if err := sendControl(serverConn.Load(), pmtuReport(mtu)); err != nil {
+				log.Printf("⚠️  Failed to report path MTU %d: %v", mtu, err)
+			}
+		}
+
+		select {
+		case <-time.After(PMTU_REPROBE_INTERVAL):
+		case reason := <-pmtuSearches:
+			log.Printf("📏 Searching the path MTU again: %s", reason)
+		}
+	}
+}
+
+// requestPathMTUSearch has the path MTU searched again, e.g. after the
+// tunnel moved to another path. It never blocks.
+func requestPathMTUSearch(reason string) {
+	select {
+	case pmtuSearches <- reason:
+	default:
+	}
+}
+
+// watchBlackHole looks for packets vanishing on the path: the socket's
+// don't fragment bit keeps the kernel from learning a smaller path MTU from
+// ICMP, so frames that got too big are dropped without a trace. When data
+// has gone unanswered for PMTU_BLACKHOLE_TIMEOUT, a keepalive checks
+// whether the server is still there; if it answers, the path MTU is
+// searched again, as RFC 8899 asks for black hole detection.
+func watchBlackHole() {
+	defer cleanupOnPanic()
+	ticker := time.NewTicker(KEEPALIVE_CHECK_INTERVAL)
+	defer ticker.Stop()
+	var checked, searched int64 // lastDataReceived when last checked and searched
+	var checkedAt time.Time
+
+	for range ticker.C {
+		received := lastDataReceived.Load()
+		if reconnecting.Load() || lastDataSent.Load() <= received || time.Since(time.Unix(0, received)) < PMTU_BLACKHOLE_TIMEOUT {
+			continue
+		}
+		switch {
+		case searched == received:
+			// One search per silence
+		case checked != received:
+			checked, checkedAt = received, time.Now()
+			if err := sendControl(serverConn.Load(), []byte{CONTROL_KEEPALIVE}); err != nil {
+				log.Printf("⚠️  Failed to send keepalive: %v", err)
+			}
+		case lastReceived.Load() > checkedAt.UnixNano():
+			searched = received
+			requestPathMTUSearch("data goes unanswered, keepalives do not")
+		}
+	}
+}
+
+// searchPathMTU finds the largest tunnel MTU between floor and ceiling whose
+// probes are acked, sending them with probe. The ceiling is tried first, as
+// it usually works. It fails if not even a floor-sized probe is acked, e.g.
+// when the server is too old to answer probes.
+func searchPathMTU(floor, ceiling int, probe func(mtu int) bool) (int, bool) {
+	if probe(ceiling) {
+		return ceiling, true
+	}
+	if floor >= ceiling || !probe(floor) {
+		return 0, false
+	}
+
+	low, high := floor, ceiling-1
+	for high-low >= PMTU_SEARCH_PRECISION {
+		mid := (low + high + 1) / 2
+		if probe(mid) {
+			low = mid
+		} else {
+			high = mid - 1
+		}
+	}
+	return low, true
+}
+
+// probePathMTU reports whether a probe as big as a packet of the given MTU
+// is acked. Each attempt goes out on the current socket, which a reconnect
+// may have replaced.
+func probePathMTU(mtu int) bool {
+	id, err := randomUint32()
+	if err != nil {
+		log.Printf("⚠️  Failed to create path MTU probe: %v", err)
+		return false
+	}
+	probe := pmtuMessage(CONTROL_PMTU_PROBE, id, mtu)
+
+	for attempt := 0; attempt < PMTU_PROBE_ATTEMPTS; attempt++ {
+		// Fails at once if the local interface is too small
+		if err := sendControl(serverConn.Load(), probe); err != nil {
+			debugf("📏 Probe of %d bytes not sent: %v", mtu, err)
+			return false
+		}
+
+		timeout := time.After(PMTU_PROBE_TIMEOUT)
+	wait:
+		for {
+			select {
+			case acked := <-pmtuAcks:
+				if acked == id {
+					debugf("📏 Probe of %d bytes acked", mtu)
+					return true
+				}
+			case <-timeout:
+				break wait
+			}
+		}
+	}
+	debugf("📏 Probe of %d bytes lost", mtu)
+	return false
+}
+
+// setTunnelMTU changes the MTU of the TUN interface at runtime
+func setTunnelMTU(mtu int) error {
+	var err error
+	if runtime.GOOS == "darwin" {
+		err = executeCommand("ifconfig", iface.Name(), "mtu", strconv.Itoa(mtu))
+	} else {
+		err = setLinkMTU(iface.Name(), mtu)
+	}
+	if err != nil {
+		return err
+	}
+	metrics.tunMTU.Store(int64(mtu))
+	return nil
+}
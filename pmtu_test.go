@@ -0,0 +1,120 @@
+//go:build client
+// +build client
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// fakePath acks probes up to its MTU and counts them
+type fakePath struct {
+	mtu    int
+	probes []int
+}
+
+func (p *fakePath) probe(mtu int) bool {
+	p.probes = append(p.probes, mtu)
+	return mtu <= p.mtu
+}
+
+func TestSearchPathMTU(t *testing.T) {
+	tests := []struct {
+		name           string
+		floor, ceiling int
+		pathMTU        int
+		ok             bool
+	}{
+		{"ceiling fits", 576, 1420, 1500, true},
+		{"ceiling exactly", 576, 1420, 1420, true},
+		{"pppoe", 576, 1420, 1412, true},
+		{"tunnel in a tunnel", 576, 1420, 1280, true},
+		{"just above the floor", 576, 1420, 580, true},
+		{"floor", 576, 1420, 576, true},
+		{"below the floor", 1280, 1420, 1200, false},
+		{"no answers", 576, 1420, 0, false},
+		{"floor is the ceiling", 1280, 1280, 1200, false},
+	}
+	for _, tt := range tests {
+		path := &fakePath{mtu: tt.pathMTU}
+		mtu, ok := searchPathMTU(tt.floor, tt.ceiling, path.probe)
+		if ok != tt.ok {
+			t.Errorf("%s: found %d, %v; want ok %v", tt.name, mtu, ok, tt.ok)
+			continue
+		}
+		if len(path.probes) > 12 {
+			t.Errorf("%s: %d probes: %v", tt.name, len(path.probes), path.probes)
+		}
+		if !ok {
+			continue
+		}
+		// Never above what gets through, at most the precision below it
+		want := min(tt.pathMTU, tt.ceiling)
+		if mtu > want || mtu <= want-PMTU_SEARCH_PRECISION || mtu < tt.floor {
+			t.Errorf("%s: found %d, want %d within %d", tt.name, mtu, want, PMTU_SEARCH_PRECISION)
+		}
+	}
+
+	// The usual case costs one probe
+	path := &fakePath{mtu: 1500}
+	searchPathMTU(576, 1420, path.probe)
+	if len(path.probes) != 1 {
+		t.Errorf("probes %v, want only the ceiling", path.probes)
+	}
+}
+
+// A probe goes out sealed, padded to its size, and counts once its ack
+// comes back
+func TestProbePathMTU(t *testing.T) {
+	sender, receiver := aeadPair(t, suiteChaCha20Poly1305)
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	conn, err := net.DialUDP("udp4", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	currentKeypair.Store(sender)
+	serverConn.Store(conn)
+	t.Cleanup(func() {
+		currentKeypair.Store(nil)
+		serverConn.Store(nil)
+	})
+
+	// The server end acks every probe through the client's reader
+	sizes := make(chan int, 1)
+	go func() {
+		buffer := make([]byte, MAX_DATAGRAM_SIZE)
+		for {
+			n, err := server.Read(buffer)
+			if err != nil {
+				return
+			}
+			probe, err := openFrame(receiver, buffer[:n])
+			if err != nil || probe[0] != CONTROL_PMTU_PROBE {
+				continue
+			}
+			id, _ := parsePMTUMessage(probe)
+			pmtuAcks <- id + 1 // An ack for someone else's probe
+			pmtuAcks <- id
+			sizes <- len(probe)
+		}
+	}()
+
+	if !probePathMTU(1400) {
+		t.Fatal("acked probe counted as lost")
+	}
+	if size := <-sizes; size != 1400 {
+		t.Errorf("probe of %d bytes, want 1400", size)
+	}
+
+	// Without a session nothing is sent
+	currentKeypair.Store(nil)
+	if probePathMTU(1400) {
+		t.Fatal("probe without a session counted as acked")
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// netlinkRule builds the policy routing rule a NET_CHANGE_RULE describes
+func netlinkRule(change netChange) *netlink.Rule {
+	rule := netlink.NewRule()
+	rule.Family = syscall.AF_INET
+	if change.Family == "ip6" {
+		rule.Family = syscall.AF_INET6
+	}
+	rule.Priority = change.Priority
+	rule.Table = unix.RT_TABLE_MAIN
+	if change.Table != 0 {
+		rule.Table = change.Table
+	}
+	if change.Mark != 0 {
+		rule.Mark = change.Mark
+		rule.Invert = true
+	}
+	if change.Suppress {
+		rule.SuppressPrefixlen = 0
+	}
+	return rule
+}
+
+func ruleAdd(change netChange) error {
+	return netlink.RuleAdd(netlinkRule(change))
+}
+
+func ruleDel(change netChange) error {
+	return netlink.RuleDel(netlinkRule(change))
+}
+
+// markSocket returns a dialer control function that sets SO_MARK on the
+// socket before it connects, so its packets match fwmark rules
+func markSocket(mark uint32) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if ctrlErr := c.Control(func(fd uintptr) {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, int(mark))
+		}); ctrlErr != nil {
+			return ctrlErr
+		}
+		return err
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestNetlinkRule(t *testing.T) {
+	tests := []struct {
+		name     string
+		change   netChange
+		family   int
+		table    int
+		mark     uint32
+		invert   bool
+		suppress int
+	}{
+		{"suppress default routes", netChange{Family: "ip", Priority: 1194, Suppress: true}, syscall.AF_INET, unix.RT_TABLE_MAIN, 0, false, 0},
+		{"unmarked to the tunnel table", netChange{Family: "ip", Priority: 1195, Table: 51820, Mark: 0xca6c}, syscall.AF_INET, 51820, 0xca6c, true, -1},
+		{"ipv6", netChange{Family: "ip6", Priority: 1195, Table: 51820, Mark: 0xca6c}, syscall.AF_INET6, 51820, 0xca6c, true, -1},
+	}
+	for _, tt := range tests {
+		rule := netlinkRule(tt.change)
+		if rule.Family != tt.family || rule.Priority != tt.change.Priority || rule.Table != tt.table {
+			t.Errorf("%s: family %d, priority %d, table %d", tt.name, rule.Family, rule.Priority, rule.Table)
+		}
+		if rule.Mark != tt.mark || rule.Invert != tt.invert || rule.SuppressPrefixlen != tt.suppress {
+			t.Errorf("%s: mark %#x, invert %v, suppress_prefixlength %d", tt.name, rule.Mark, rule.Invert, rule.SuppressPrefixlen)
+		}
+	}
+}
+
+// The dialer's socket carries the mark, so its packets skip the tunnel table
+func TestMarkSocket(t *testing.T) {
+	dialer := net.Dialer{Control: markSocket(0xca6c)}
+	conn, err := dialer.Dial("udp4", "127.0.0.1:9")
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("setting SO_MARK needs CAP_NET_ADMIN")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	raw, err := conn.(*net.UDPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mark int
+	raw.Control(func(fd uintptr) {
+		mark, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK)
+	})
+	if err != nil || mark != 0xca6c {
+		t.Fatalf("socket mark %#x, %v", mark, err)
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Policy routing and socket marks only exist on Linux
+
+func ruleAdd(change netChange) error {
+	return errors.ErrUnsupported
+}
+
+func ruleDel(change netChange) error {
+	return errors.ErrUnsupported
+}
+
+func markSocket(mark uint32) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return errors.ErrUnsupported
+	}
+}
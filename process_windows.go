@@ -0,0 +1,20 @@
+package main
+
+import "os"
+
+// watchStatusSignal does nothing: Windows has no SIGUSR1
+func watchStatusSignal() {}
+
+// processAlive reports whether a process with the given pid exists; on
+// Windows finding a process opens it, which fails once it has exited
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
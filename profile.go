@@ -0,0 +1,502 @@
+//go:build client
+// +build client
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Client defaults, used for anything the profile and flags leave unset
+const (
+	DEFAULT_CLIENT_CONFIG = "client.yaml" // In the user's config directory, under cipherwall/
+	DEFAULT_CLIENT_KEY    = "client.key"
+	DEFAULT_MTU           = 1420 // When the underlay MTU cannot be detected
+	DEFAULT_REKEY_BYTES   = 1 << 36
+
+	// Journal of the client's route and DNS changes, used to undo them after
+	// a crash
+	DEFAULT_STATE_FILE = "/var/lib/cipherwall/client-state.json"
+
+	// PBKDF2 parameters - MUST match server
+	DEFAULT_PBKDF2_ITERATIONS = 100000
+	DEFAULT_PBKDF2_SALT       = "cipherwall-salt-2025"
+
+	// Used when neither the profile nor VPN_PSK sets a PSK
+	DEFAULT_PSK = "this-is-strong-32byte-secret-key"
+
+	MIN_MTU = 576
+	MAX_MTU = 9000
+
+	// Policy routing: the client's UDP socket carries the mark, and the
+	// tunnel routes live in their own table
+	DEFAULT_FWMARK      = 0x1194
+	DEFAULT_ROUTE_TABLE = 1194
+)
+
+// Routing modes. main adds the tunnel routes to the main routing table and
+// pins the server to the underlay; policy (Linux only) puts them in a
+// separate table that the client's own, marked packets never consult.
+const (
+	ROUTING_MAIN   = "main"
+	ROUTING_POLICY = "policy"
+)
+
+// IP versions for reaching the server. auto takes what the server name
+// resolves to, IPv4 first.
+const (
+	UNDERLAY_AUTO = "auto"
+	UNDERLAY_IPV4 = "ipv4"
+	UNDERLAY_IPV6 = "ipv6"
+)
+
+// DNS modes. auto uses systemd-resolved when it is running and rewrites
+// /etc/resolv.conf otherwise; off leaves the host's resolver alone.
+const (
+	DNS_MODE_AUTO     = "auto"
+	DNS_MODE_RESOLVED = "resolved"
+	DNS_MODE_FILE     = "file"
+	DNS_MODE_OFF      = "off"
+)
+
+// clientConfig is the client's configuration file (YAML): named profiles,
+// one per server or deployment, and the profile used when -profile is not
+// given.
+//
+//	default: home
+//	profiles:
+//	  home:
+//	    server: vpn.example.com:1194
+//	    server_key: SERVER_PUBLIC_KEY
+type clientConfig struct {
+	Default  string                    `yaml:"default"`
+	Profiles map[string]*clientProfile `yaml:"profiles"`
+}
+
+// clientProfile holds everything needed to connect to one server
+type clientProfile struct {
+	Server     string  `yaml:"server"`     // Server endpoint (host:port, [v6]:port)
+	Underlay   string  `yaml:"underlay"`   // auto, ipv4 or ipv6
+	ServerKey  string  `yaml:"server_key"` // Server static public key (base64)
+	KeyFile    string  `yaml:"key_file"`   // Client private key, created if missing
+	PSK        string  `yaml:"psk"`        // Shared PSK, exactly 32 bytes
+	PSKFile    string  `yaml:"psk_file"`   // This client's own handshake PSK (base64)
+	Cipher     string  `yaml:"cipher"`
+	RekeyBytes *uint64 `yaml:"rekey_bytes"` // 0 disables byte-based rekeying
+	MTU        int     `yaml:"mtu"`         // 0 derives it from the underlay MTU
+
+	// Probe the path to the server and lower the TUN MTU to what gets
+	// through, never above mtu
+	PMTUDiscovery *bool `yaml:"pmtu_discovery"`
+
+	// Send the server a keepalive after this long without hearing from it,
+	// and reconnect after the dead peer timeout. 0 disables either.
+	Keepalive       *time.Duration `yaml:"keepalive"`
+	DeadPeerTimeout *time.Duration `yaml:"dead_peer_timeout"`
+
+	// Split frames bigger than this many bytes into fragments, and have the
+	// server do the same, for networks that drop IP fragments. 0 is off.
+	Fragment int `yaml:"fragment"`
+
+	// Split tunneling: routes are sent through the tunnel, everything else
+	// keeps using the local network. A 0.0.0.0/0 route makes it a full
+	// tunnel. Excluded prefixes always bypass the tunnel, and routes pushed
+	// by the server are added to the profile's unless accept_routes is off.
+	Routes       []string `yaml:"routes"`  // Prefixes sent through the tunnel, default everything
+	Exclude      []string `yaml:"exclude"` // Prefixes kept on the local network, e.g. the LAN
+	AcceptRoutes *bool    `yaml:"accept_routes"`
+
+	// DNS while connected: the profile's servers, or else the ones pushed by
+	// the server unless accept_dns is off. Search domains from both are used.
+	DNS       []string `yaml:"dns"`
+	DNSSearch []string `yaml:"dns_search"`
+	AcceptDNS *bool    `yaml:"accept_dns"`
+	DNSMode   string   `yaml:"dns_mode"` // auto, resolved, file or off
+
+	Routing string `yaml:"routing"` // main or policy
+	FwMark  uint32 `yaml:"fwmark"`  // Mark on the client's UDP socket (policy routing)
+	Table   int    `yaml:"table"`   // Routing table for the tunnel routes (policy routing)
+
+	// Block all traffic outside the tunnel (Linux), until an explicit
+	// disconnect, even if the client dies
+	KillSwitch bool `yaml:"kill_switch"`
+
+	PBKDF2Iterations int    `yaml:"pbkdf2_iterations"`
+	PBKDF2Salt       string `yaml:"pbkdf2_salt"`
+
+	LogLevel string `yaml:"log_level"` // info, or debug for per-packet logs
+
+	name    string
+	routes  []netip.Prefix
+	exclude []netip.Prefix
+	dns     []netip.Addr
+}
+
+// defaultClientConfigPath returns the config file used when -config is not
+// given
+func defaultClientConfigPath() string {
+	if path := os.Getenv("CIPHERWALL_CONFIG"); path != "" {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return DEFAULT_CLIENT_CONFIG
+	}
+	return filepath.Join(dir, "cipherwall", DEFAULT_CLIENT_CONFIG)
+}
+
+// loadClientConfig reads and validates every profile in the config file.
+// A missing file is only an error if required is set; otherwise the client
+// runs on flags alone.
+func loadClientConfig(path string, required bool) (*clientConfig, error) {
+	cfg := &clientConfig{}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) && !required {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	// Relative file paths in profiles are relative to the config file
+	dir := filepath.Dir(path)
+	for name, prof := range cfg.Profiles {
+		if prof == nil {
+			prof = &clientProfile{}
+			cfg.Profiles[name] = prof
+		}
+		prof.name = name
+		for _, file := range []*string{&prof.KeyFile, &prof.PSKFile} {
+			if *file != "" && !filepath.IsAbs(*file) {
+				*file = filepath.Join(dir, *file)
+			}
+		}
+		if err := prof.parse(); err != nil {
+			return nil, fmt.Errorf("profile %q: %w", name, err)
+		}
+	}
+
+	if cfg.Default != "" && cfg.Profiles[cfg.Default] == nil {
+		return nil, fmt.Errorf("default profile %q does not exist", cfg.Default)
+	}
+	return cfg, nil
+}
+
+// profileNames lists the profiles in alphabetical order
+func (cfg *clientConfig) profileNames() []string {
+	names := make([]string, 0, len(cfg.Profiles))
+	for name := range cfg.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// selectProfile returns a copy of the named profile. Without a name it picks
+// the default profile, or the only one. With no profiles at all it returns
+// an empty profile to be filled in from flags.
+func (cfg *clientConfig) selectProfile(name string) (*clientProfile, error) {
+	if name == "" {
+		name = cfg.Default
+	}
+	if name == "" {
+		switch len(cfg.Profiles) {
+		case 0:
+			return &clientProfile{}, nil
+		case 1:
+			name = cfg.profileNames()[0]
+		default:
+			return nil, fmt.Errorf("several profiles and no default, choose one with -profile: %v", cfg.profileNames())
+		}
+	}
+
+	prof := cfg.Profiles[name]
+	if prof == nil {
+		return nil, fmt.Errorf("unknown profile %q, available: %v", name, cfg.profileNames())
+	}
+	selected := *prof
+	return &selected, nil
+}
+
+// parse checks the profile's own fields and parses its routes and DNS
+// servers. Fields a flag may still fill in, such as the server, are checked
+// by validate.
+func (prof *clientProfile) parse() error {
+	if prof.PSK != "" && len(prof.PSK) != 32 {
+		return fmt.Errorf("psk must be exactly 32 bytes, got %d bytes", len(prof.PSK))
+	}
+	if prof.ServerKey != "" {
+		if _, err := parsePublicKey(prof.ServerKey); err != nil {
+			return fmt.Errorf("invalid server_key: %w", err)
+		}
+	}
+	if prof.Cipher != "" {
+		if _, err := offeredCipherSuites(prof.Cipher); err != nil {
+			return err
+		}
+	}
+	if prof.MTU != 0 && (prof.MTU < MIN_MTU || prof.MTU > MAX_MTU) {
+		return fmt.Errorf("mtu %d out of range (%d-%d)", prof.MTU, MIN_MTU, MAX_MTU)
+	}
+	if prof.Fragment != 0 && (prof.Fragment < MIN_FRAGMENT_SIZE || prof.Fragment > MAX_DATAGRAM_SIZE) {
+		return fmt.Errorf("fragment %d out of range (%d-%d)", prof.Fragment, MIN_FRAGMENT_SIZE, MAX_DATAGRAM_SIZE)
+	}
+	if prof.LogLevel != "" {
+		if err := validateLogLevel(prof.LogLevel); err != nil {
+			return err
+		}
+	}
+	for _, domain := range prof.DNSSearch {
+		if err := validateSearchDomain(domain); err != nil {
+			return err
+		}
+	}
+	switch prof.Underlay {
+	case "", UNDERLAY_AUTO, UNDERLAY_IPV4, UNDERLAY_IPV6:
+	default:
+		return fmt.Errorf("unknown underlay %q (use %s, %s or %s)", prof.Underlay, UNDERLAY_AUTO, UNDERLAY_IPV4, UNDERLAY_IPV6)
+	}
+	switch prof.DNSMode {
+	case "", DNS_MODE_AUTO, DNS_MODE_RESOLVED, DNS_MODE_FILE, DNS_MODE_OFF:
+	default:
+		return fmt.Errorf("unknown dns_mode %q (use %s, %s, %s or %s)", prof.DNSMode, DNS_MODE_AUTO, DNS_MODE_RESOLVED, DNS_MODE_FILE, DNS_MODE_OFF)
+	}
+	switch prof.Routing {
+	case "", ROUTING_MAIN, ROUTING_POLICY:
+	default:
+		return fmt.Errorf("unknown routing mode %q (use %s or %s)", prof.Routing, ROUTING_MAIN, ROUTING_POLICY)
+	}
+	// 253-255 are the kernel's default, main and local tables
+	if prof.Table < 0 || (prof.Table >= 253 && prof.Table <= 255) {
+		return fmt.Errorf("table %d is reserved or invalid", prof.Table)
+	}
+	if prof.PBKDF2Iterations < 0 {
+		return fmt.Errorf("pbkdf2_iterations must be positive, got %d", prof.PBKDF2Iterations)
+	}
+
+	prof.routes = nil
+	for _, route := range prof.Routes {
+		prefix, err := netip.ParsePrefix(route)
+		if err != nil {
+			return fmt.Errorf("invalid route: %w", err)
+		}
+		prof.routes = append(prof.routes, prefix.Masked())
+	}
+	prof.exclude = nil
+	for _, route := range prof.Exclude {
+		prefix, err := netip.ParsePrefix(route)
+		if err != nil {
+			return fmt.Errorf("invalid exclude: %w", err)
+		}
+		if prefix.Bits() == 0 {
+			return fmt.Errorf("cannot exclude %s, remove it from routes instead", prefix)
+		}
+		prof.exclude = append(prof.exclude, prefix.Masked())
+	}
+	prof.dns = nil
+	for _, server := range prof.DNS {
+		addr, err := netip.ParseAddr(server)
+		if err != nil {
+			return fmt.Errorf("invalid dns server: %w", err)
+		}
+		prof.dns = append(prof.dns, addr)
+	}
+	return nil
+}
+
+// applyDefaults fills in everything the profile and flags left unset
+func (prof *clientProfile) applyDefaults() {
+	if prof.KeyFile == "" {
+		prof.KeyFile = DEFAULT_CLIENT_KEY
+	}
+	if prof.PSK == "" {
+		prof.PSK = os.Getenv("VPN_PSK")
+	}
+	if prof.Cipher == "" {
+		prof.Cipher = "auto"
+	}
+	if prof.RekeyBytes == nil {
+		limit := uint64(DEFAULT_REKEY_BYTES)
+		prof.RekeyBytes = &limit
+	}
+	// An explicit empty list (routes: []) leaves only the pushed routes
+	if prof.Routes == nil {
+		prof.Routes = []string{"0.0.0.0/0"}
+	}
+	if prof.AcceptRoutes == nil {
+		accept := true
+		prof.AcceptRoutes = &accept
+	}
+	if prof.Underlay == "" {
+		prof.Underlay = UNDERLAY_AUTO
+	}
+	if prof.Keepalive == nil {
+		keepalive := DEFAULT_KEEPALIVE
+		prof.Keepalive = &keepalive
+	}
+	if prof.DeadPeerTimeout == nil {
+		timeout := DEFAULT_DEAD_PEER_TIMEOUT
+		prof.DeadPeerTimeout = &timeout
+	}
+	if prof.PMTUDiscovery == nil {
+		discover := true
+		prof.PMTUDiscovery = &discover
+	}
+	if prof.AcceptDNS == nil {
+		accept := true
+		prof.AcceptDNS = &accept
+	}
+	if prof.DNSMode == "" {
+		prof.DNSMode = DNS_MODE_AUTO
+	}
+	if prof.Routing == "" {
+		prof.Routing = ROUTING_MAIN
+	}
+	if prof.FwMark == 0 {
+		prof.FwMark = DEFAULT_FWMARK
+	}
+	if prof.Table == 0 {
+		prof.Table = DEFAULT_ROUTE_TABLE
+	}
+	if prof.PBKDF2Iterations == 0 {
+		prof.PBKDF2Iterations = DEFAULT_PBKDF2_ITERATIONS
+	}
+	if prof.PBKDF2Salt == "" {
+		prof.PBKDF2Salt = DEFAULT_PBKDF2_SALT
+	}
+	if prof.LogLevel == "" {
+		prof.LogLevel = LOG_LEVEL_INFO
+	}
+}
+
+// validate checks the final profile, after flags and defaults are applied
+func (prof *clientProfile) validate() error {
+	if err := prof.parse(); err != nil {
+		return err
+	}
+	if prof.Server == "" {
+		return errors.New("server address is required (server in the profile, or -server)")
+	}
+	if _, _, err := net.SplitHostPort(prof.Server); err != nil {
+		return fmt.Errorf("invalid server address %q: %w", prof.Server, err)
+	}
+	suites, err := offeredCipherSuites(prof.Cipher)
+	if err != nil {
+		return err
+	}
+	if suites[0] != suiteLegacyCFB && prof.ServerKey == "" {
+		return fmt.Errorf("server public key is required for cipher %s (server_key in the profile, or -server-key)", prof.Cipher)
+	}
+	if prof.Routing == ROUTING_POLICY && runtime.GOOS != "linux" {
+		return fmt.Errorf("routing mode %s is only supported on Linux", ROUTING_POLICY)
+	}
+	if prof.KillSwitch && runtime.GOOS != "linux" {
+		return errors.New("kill_switch is only supported on Linux")
+	}
+	return validateKeepalive(*prof.Keepalive, *prof.DeadPeerTimeout)
+}
+
+// includeRoutes returns the profile's routes plus, if it accepts them, the
+// routes pushed by the server, without duplicates. A full tunnel covers
+// IPv6 as well, even without an IPv6 tunnel address, so IPv6 traffic never
+// leaks around the tunnel.
+func (prof *clientProfile) includeRoutes(pushed []netip.Prefix) []netip.Prefix {
+	routes := slices.Clone(prof.routes)
+	if *prof.AcceptRoutes {
+		for _, route := range pushed {
+			if route = route.Masked(); !slices.Contains(routes, route) {
+				routes = append(routes, route)
+			}
+		}
+	}
+	allIPv6 := netip.PrefixFrom(netip.IPv6Unspecified(), 0)
+	if fullTunnel(routes) && !slices.Contains(routes, allIPv6) {
+		routes = append(routes, allIPv6)
+	}
+	return routes
+}
+
+// underlayNetwork returns the network to resolve and dial the server with
+func (prof *clientProfile) underlayNetwork() string {
+	switch prof.Underlay {
+	case UNDERLAY_IPV4:
+		return "udp4"
+	case UNDERLAY_IPV6:
+		return "udp6"
+	default:
+		return "udp"
+	}
+}
+
+// dnsSettings returns the DNS servers and search domains to use while
+// connected, given the ones pushed by the server. Pushed search domains the
+// client would not write to its resolver are dropped.
+func (prof *clientProfile) dnsSettings(pushedDNS []netip.Addr, pushedSearch []string) ([]netip.Addr, []string) {
+	servers := prof.dns
+	search := slices.Clone(prof.DNSSearch)
+	if !*prof.AcceptDNS {
+		return servers, search
+	}
+	if len(servers) == 0 {
+		servers = pushedDNS
+	}
+	for _, domain := range pushedSearch {
+		if err := validateSearchDomain(domain); err != nil {
+			log.Printf("⚠️  Ignoring pushed %v", err)
+			continue
+		}
+		if !slices.Contains(search, domain) {
+			search = append(search, domain)
+		}
+	}
+	return servers, search
+}
+
+// fullTunnel reports whether routes send all IPv4 traffic through the tunnel
+func fullTunnel(routes []netip.Prefix) bool {
+	for _, route := range routes {
+		if route.Bits() == 0 && route.Addr().Is4() {
+			return true
+		}
+	}
+	return false
+}
+
+// tunnelRoutes returns the routes to install on the TUN interface. A default
+// route is split into two halves, which win over the existing default route
+// without replacing it.
+func tunnelRoutes(routes []netip.Prefix) []netip.Prefix {
+	var split []netip.Prefix
+	for _, route := range routes {
+		switch {
+		case route.Bits() == 0 && route.Addr().Is4():
+			split = append(split, netip.MustParsePrefix("0.0.0.0/1"), netip.MustParsePrefix("128.0.0.0/1"))
+		case route.Bits() == 0:
+			split = append(split, netip.MustParsePrefix("::/1"), netip.MustParsePrefix("8000::/1"))
+		default:
+			split = append(split, route)
+		}
+	}
+	return split
+}
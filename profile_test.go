@@ -0,0 +1,305 @@
+//go:build client
+// +build client
+
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// prefixes parses a list of prefixes
+func prefixes(list ...string) []netip.Prefix {
+	var parsed []netip.Prefix
+	for _, s := range list {
+		parsed = append(parsed, netip.MustParsePrefix(s))
+	}
+	return parsed
+}
+
+// writeClientConfig writes a client config file
+func writeClientConfig(t *testing.T, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "client.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestProfileValidate(t *testing.T) {
+	static, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverKey := static.publicKey().String()
+
+	tests := []struct {
+		name    string
+		profile clientProfile
+		err     string // Substring of the error, empty if valid
+	}{
+		{"complete", clientProfile{Server: "vpn.example.com:51820", ServerKey: serverKey}, ""},
+		{"no server", clientProfile{ServerKey: serverKey}, "server address is required"},
+		{"server without port", clientProfile{Server: "vpn.example.com", ServerKey: serverKey}, "invalid server address"},
+		{"no server key", clientProfile{Server: "vpn.example.com:51820"}, "server public key is required"},
+		{"no server key for an AEAD", clientProfile{Server: "vpn.example.com:51820", Cipher: "aes-256-gcm"}, "server public key is required"},
+		{"no server key for legacy", clientProfile{Server: "vpn.example.com:51820", Cipher: "legacy-cfb"}, ""},
+		{"bad server key", clientProfile{Server: "vpn.example.com:51820", ServerKey: "not-a-key"}, "invalid server_key"},
+		{"unknown cipher", clientProfile{Server: "vpn.example.com:51820", ServerKey: serverKey, Cipher: "rot13"}, "rot13"},
+		{"short psk", clientProfile{Server: "vpn.example.com:51820", ServerKey: serverKey, PSK: "short"}, "psk must be exactly 32 bytes"},
+		{"mtu too small", clientProfile{Server: "vpn.example.com:51820", ServerKey: serverKey, MTU: 100}, "mtu 100 out of range"},
+	}
+	for _, tt := range tests {
+		prof := tt.profile
+		prof.applyDefaults()
+		err := prof.validate()
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: error %v, want one containing %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestLoadClientConfig(t *testing.T) {
+	path := writeClientConfig(t, "default: home\nprofiles:\n  home:\n    server: vpn.example.com:51820\n    key_file: home.key\n    routes: [10.0.0.0/8]\n  work:\n")
+	cfg, err := loadClientConfig(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	home := cfg.Profiles["home"]
+	if home.name != "home" || home.KeyFile != filepath.Join(filepath.Dir(path), "home.key") {
+		t.Errorf("home profile: name %q, key file %q", home.name, home.KeyFile)
+	}
+	if len(home.routes) != 1 || home.routes[0].String() != "10.0.0.0/8" {
+		t.Errorf("home routes parsed as %v", home.routes)
+	}
+	if cfg.Profiles["work"] == nil {
+		t.Error("empty profile dropped")
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing.yaml")
+	if cfg, err := loadClientConfig(missing, false); err != nil || len(cfg.Profiles) != 0 {
+		t.Errorf("missing optional config: %+v, %v", cfg, err)
+	}
+	if _, err := loadClientConfig(missing, true); err == nil {
+		t.Error("missing -config file accepted")
+	}
+
+	bad := []struct {
+		name string
+		yaml string
+		err  string
+	}{
+		{"unknown key", "profiles:\n  home:\n    sever: vpn.example.com:51820\n", "field sever not found"},
+		{"unknown default", "default: office\nprofiles:\n  home:\n", "default profile \"office\""},
+		{"bad route", "profiles:\n  home:\n    routes: [10.0.0.0]\n", "profile \"home\": invalid route"},
+		{"exclude everything", "profiles:\n  home:\n    exclude: [0.0.0.0/0]\n", "cannot exclude"},
+		{"reserved table", "profiles:\n  home:\n    table: 254\n", "table 254"},
+	}
+	for _, tt := range bad {
+		_, err := loadClientConfig(writeClientConfig(t, tt.yaml), true)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want one containing %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestSelectProfile(t *testing.T) {
+	two := &clientConfig{Profiles: map[string]*clientProfile{
+		"home": {name: "home", Server: "home.example.com:51820"},
+		"work": {name: "work", Server: "work.example.com:51820"},
+	}}
+	withDefault := &clientConfig{Default: "work", Profiles: two.Profiles}
+	one := &clientConfig{Profiles: map[string]*clientProfile{"home": two.Profiles["home"]}}
+
+	tests := []struct {
+		name string
+		cfg  *clientConfig
+		arg  string
+		want string // Selected profile, empty for an error
+	}{
+		{"explicit", two, "home", "home"},
+		{"explicit over default", withDefault, "home", "home"},
+		{"default", withDefault, "", "work"},
+		{"only profile", one, "", "home"},
+		{"several without default", two, "", ""},
+		{"unknown", two, "office", ""},
+		{"no profiles", &clientConfig{}, "", "-"},
+	}
+	for _, tt := range tests {
+		prof, err := tt.cfg.selectProfile(tt.arg)
+		switch {
+		case tt.want == "":
+			if err == nil {
+				t.Errorf("%s: selected %q", tt.name, prof.name)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.want == "-":
+			if prof.name != "" || prof.Server != "" {
+				t.Errorf("%s: got %+v, want an empty profile", tt.name, prof)
+			}
+		case prof.name != tt.want:
+			t.Errorf("%s: selected %q, want %q", tt.name, prof.name, tt.want)
+		}
+	}
+
+	// Flags and defaults are applied to a copy, never to the loaded profile
+	prof, _ := two.selectProfile("home")
+	prof.Server = "override.example.com:51820"
+	prof.applyDefaults()
+	if home := two.Profiles["home"]; home.Server != "home.example.com:51820" || home.Keepalive != nil {
+		t.Errorf("loaded profile modified: %+v", home)
+	}
+}
+
+// Unset settings get their defaults; explicit zero values are kept
+func TestProfileApplyDefaults(t *testing.T) {
+	t.Setenv("VPN_PSK", strings.Repeat("e", 32))
+	var zero uint64
+	off := false
+	prof := clientProfile{RekeyBytes: &zero, AcceptRoutes: &off, Routes: []string{}}
+	prof.applyDefaults()
+
+	if *prof.RekeyBytes != 0 || *prof.AcceptRoutes || len(prof.Routes) != 0 {
+		t.Errorf("explicit settings overwritten: rekey %d, accept routes %v, routes %v", *prof.RekeyBytes, *prof.AcceptRoutes, prof.Routes)
+	}
+	if prof.PSK != strings.Repeat("e", 32) {
+		t.Error("VPN_PSK not used")
+	}
+	if *prof.Keepalive != DEFAULT_KEEPALIVE || !*prof.PMTUDiscovery || prof.Cipher != "auto" || prof.Table != DEFAULT_ROUTE_TABLE {
+		t.Errorf("defaults not applied: %+v", prof)
+	}
+
+	prof = clientProfile{}
+	prof.applyDefaults()
+	if len(prof.Routes) != 1 || prof.Routes[0] != "0.0.0.0/0" {
+		t.Errorf("default routes %v, want a full tunnel", prof.Routes)
+	}
+}
+
+func TestIncludeRoutes(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes []string
+		accept bool
+		pushed []netip.Prefix
+		want   []netip.Prefix
+	}{
+		{"full tunnel covers IPv6", []string{"0.0.0.0/0"}, true, nil, prefixes("0.0.0.0/0", "::/0")},
+		{"split tunnel", []string{"10.0.0.0/8"}, true, nil, prefixes("10.0.0.0/8")},
+		{"pushed routes added", []string{"10.0.0.0/8"}, true, prefixes("172.16.0.0/12", "10.0.0.0/8"), prefixes("10.0.0.0/8", "172.16.0.0/12")},
+		{"pushed host bits masked", []string{}, true, prefixes("172.16.0.1/12"), prefixes("172.16.0.0/12")},
+		{"pushed routes refused", []string{"10.0.0.0/8"}, false, prefixes("172.16.0.0/12"), prefixes("10.0.0.0/8")},
+		{"pushed full tunnel", []string{}, true, prefixes("0.0.0.0/0"), prefixes("0.0.0.0/0", "::/0")},
+		{"explicit IPv6 default", []string{"0.0.0.0/0", "::/0"}, true, nil, prefixes("0.0.0.0/0", "::/0")},
+	}
+	for _, tt := range tests {
+		prof := clientProfile{Routes: tt.routes, AcceptRoutes: &tt.accept}
+		if err := prof.parse(); err != nil {
+			t.Fatal(err)
+		}
+		if got := prof.includeRoutes(tt.pushed); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: routes %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTunnelRoutes(t *testing.T) {
+	tests := []struct {
+		include []netip.Prefix
+		full    bool
+		want    []netip.Prefix
+	}{
+		{prefixes("0.0.0.0/0", "::/0"), true, prefixes("0.0.0.0/1", "128.0.0.0/1", "::/1", "8000::/1")},
+		{prefixes("10.0.0.0/8", "fd00::/8"), false, prefixes("10.0.0.0/8", "fd00::/8")},
+		{prefixes("::/0"), false, prefixes("::/1", "8000::/1")},
+		{nil, false, nil},
+	}
+	for _, tt := range tests {
+		if got := fullTunnel(tt.include); got != tt.full {
+			t.Errorf("fullTunnel(%v) = %v, want %v", tt.include, got, tt.full)
+		}
+		if got := tunnelRoutes(tt.include); !slices.Equal(got, tt.want) {
+			t.Errorf("tunnelRoutes(%v) = %v, want %v", tt.include, got, tt.want)
+		}
+	}
+}
+
+// Excludes are parsed and masked; excluding everything is refused
+func TestProfileExclude(t *testing.T) {
+	prof := clientProfile{Exclude: []string{"192.168.1.7/24", "fd12::/48"}}
+	if err := prof.parse(); err != nil {
+		t.Fatal(err)
+	}
+	if want := prefixes("192.168.1.0/24", "fd12::/48"); !slices.Equal(prof.exclude, want) {
+		t.Errorf("excludes %v, want %v", prof.exclude, want)
+	}
+	for _, exclude := range []string{"0.0.0.0/0", "::/0", "192.168.1.0"} {
+		prof := clientProfile{Exclude: []string{exclude}}
+		if err := prof.parse(); err == nil {
+			t.Errorf("exclude %s accepted", exclude)
+		}
+	}
+}
+
+func TestDarwinRouteArgs(t *testing.T) {
+	got := darwinRouteArgs("add", netip.MustParsePrefix("10.0.0.0/8"), "-interface", "utun4")
+	if want := []string{"route", "add", "-inet", "-net", "10.0.0.0/8", "-interface", "utun4"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	got = darwinRouteArgs("delete", netip.MustParsePrefix("fd00::/8"))
+	if want := []string{"route", "delete", "-inet6", "-net", "fd00::/8"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// The profile's DNS servers win over pushed ones; search domains from both
+// are used, and pushed ones that are unsafe are dropped
+func TestDNSSettings(t *testing.T) {
+	pushedDNS := []netip.Addr{netip.MustParseAddr("10.8.0.1")}
+	pushedSearch := []string{"corp.example", "bad domain", "home.example"}
+	tests := []struct {
+		name    string
+		dns     []string
+		search  []string
+		accept  bool
+		servers []netip.Addr
+		domains []string
+	}{
+		{"pushed", nil, nil, true, pushedDNS, []string{"corp.example", "home.example"}},
+		{"own servers", []string{"9.9.9.9"}, []string{"home.example"}, true, []netip.Addr{netip.MustParseAddr("9.9.9.9")}, []string{"home.example", "corp.example"}},
+		{"pushed refused", []string{"9.9.9.9"}, []string{"home.example"}, false, []netip.Addr{netip.MustParseAddr("9.9.9.9")}, []string{"home.example"}},
+		{"nothing", nil, nil, false, nil, nil},
+	}
+	for _, tt := range tests {
+		prof := clientProfile{DNS: tt.dns, DNSSearch: tt.search, AcceptDNS: &tt.accept}
+		if err := prof.parse(); err != nil {
+			t.Fatal(err)
+		}
+		servers, domains := prof.dnsSettings(pushedDNS, pushedSearch)
+		if !slices.Equal(servers, tt.servers) || !slices.Equal(domains, tt.domains) {
+			t.Errorf("%s: servers %v search %v, want %v search %v", tt.name, servers, domains, tt.servers, tt.domains)
+		}
+	}
+}
+
+func TestUnderlayNetwork(t *testing.T) {
+	for underlay, want := range map[string]string{UNDERLAY_AUTO: "udp", UNDERLAY_IPV4: "udp4", UNDERLAY_IPV6: "udp6"} {
+		prof := clientProfile{Underlay: underlay}
+		if got := prof.underlayNetwork(); got != want {
+			t.Errorf("underlay %s dials %s, want %s", underlay, got, want)
+		}
+	}
+	prof := clientProfile{Underlay: "ipx"}
+	if err := prof.parse(); err == nil {
+		t.Error("unknown underlay accepted")
+	}
+}
@@ -0,0 +1,192 @@
+//go:build client
+// +build client
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"runtime"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// Delay before a reconnect attempt, doubled after each failure up to
+// RECONNECT_MAX_DELAY
+const (
+	RECONNECT_MIN_DELAY = time.Second
+	RECONNECT_MAX_DELAY = time.Minute
+)
+
+var (
+	reconnectRequests = make(chan string, 1)
+	reconnecting      atomic.Bool // Set from the request until a new session is up
+)
+
+// requestReconnect asks the reconnect loop to start over with a new socket
+// and handshake. Requests made while reconnecting are ignored.
+func requestReconnect(reason string) {
+	if reconnecting.CompareAndSwap(false, true) {
+		reconnectRequests <- reason
+	}
+}
+
+// reconnectDelay is the backoff before the given attempt, counted from 0,
+// with jitter so clients cut off together do not come back together
+func reconnectDelay(attempt int) time.Duration {
+	delay := RECONNECT_MAX_DELAY
+	if attempt < 6 {
+		delay = min(RECONNECT_MIN_DELAY<<attempt, RECONNECT_MAX_DELAY)
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// reconnector reconnects to the server whenever it is asked to, until it
+// succeeds. The TUN interface, routes and DNS stay in place meanwhile, so
+// connections through the tunnel survive a short outage; their packets are
+// dropped until the new session is up.
+func reconnector(prof *clientProfile, dialer *net.Dialer, server netip.AddrPort) {
+	defer cleanupOnPanic()
+	for reason := range reconnectRequests {
+		log.Printf("🔁 Reconnecting: %s", reason)
+		started := time.Now()
+		for attempt := 0; ; attempt++ {
+			time.Sleep(reconnectDelay(attempt))
+			var err error
+			if server, err = reconnect(prof, dialer, server); err == nil {
+				break
+			}
+			log.Printf("⚠️  Reconnect attempt %d failed: %v", attempt+1, err)
+		}
+		reconnecting.Store(false)
+		log.Printf("✅ Reconnected to %s after %s", server, time.Since(started).Round(time.Second))
+		requestPathMTUSearch("reconnected")
+	}
+}
+
+// reconnect resolves the server again, moves the kill switch and server
+// route if its address changed, and runs a handshake over a new socket. It
+// returns the server's address, the new one once the server was moved.
+func reconnect(prof *clientProfile, dialer *net.Dialer, server netip.AddrPort) (netip.AddrPort, error) {
+	next := server
+	if addr, err := net.ResolveUDPAddr(prof.underlayNetwork(), prof.Server); err != nil {
+		log.Printf("⚠️  Failed to resolve %s, trying %s: %v", prof.Server, server, err)
+	} else {
+		next = netip.AddrPortFrom(addr.AddrPort().Addr().Unmap(), addr.AddrPort().Port())
+	}
+	if next != server {
+		log.Printf("🔀 Server %s moved from %s to %s", prof.Server, server, next)
+		if err := moveServer(prof, server, next); err != nil {
+			return server, err
+		}
+	}
+
+	conn, err := redial(dialer, prof.underlayNetwork(), next.String())
+	if err != nil {
+		return next, err
+	}
+
+	select {
+	case <-sessionReady:
+	default:
+	}
+	if err := initiateHandshake(conn); err != nil {
+		return next, err
+	}
+	select {
+	case <-sessionReady:
+		return next, nil
+	case <-time.After(HANDSHAKE_TIMEOUT):
+		return next, fmt.Errorf("no handshake response")
+	}
+}
+
+// moveServer lets the tunnel reach the server at its new address: through
+// the kill switch, and outside the tunnel on the route the old address
+// took. The route to the old address stays until exit.
+func moveServer(prof *clientProfile, from, to netip.AddrPort) error {
+	if prof.KillSwitch {
+		if err := enableKillSwitch(to, iface.Name(), prof.exclude); err != nil {
+			return fmt.Errorf("failed to update kill switch: %w", err)
+		}
+	}
+	if prof.Routing == ROUTING_POLICY {
+		return nil // The socket mark keeps the server outside the tunnel
+	}
+	if runtime.GOOS == "darwin" {
+		if from.Addr().Is4() != to.Addr().Is4() {
+			return fmt.Errorf("cannot route %s the way of %s, a different address family", to.Addr(), from.Addr())
+		}
+		return darwinPinHost(to.Addr(), from.Addr())
+	}
+	return pinUnderlay(netip.PrefixFrom(to.Addr(), to.Addr().BitLen()), "server "+to.Addr().String())
+}
+
+// redial replaces the socket to the server with a new one, which picks its
+// source address and port afresh, e.g. after the underlay changed
+func redial(dialer *net.Dialer, network, address string) (*net.UDPConn, error) {
+	udpConn, err := dialer.Dial(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to server: %w", err)
+	}
+	conn := udpConn.(*net.UDPConn)
+	if old := serverConn.Swap(conn); old != nil {
+		old.Close()
+	}
+	go handleIncomingPackets(conn)
+	return conn, nil
+}
+
+// watchLocalAddress moves the tunnel to a new socket when the address the
+// socket sends from goes away, e.g. when a laptop leaves Wi-Fi for a phone
+// hotspot. The session is kept: the server roams to the new address once a
+// frame from there authenticates, and a keepalive makes sure one is sent.
+func watchLocalAddress(dialer *net.Dialer, network string) {
+	defer cleanupOnPanic()
+	ticker := time.NewTicker(UNDERLAY_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if reconnecting.Load() {
+			continue
+		}
+		conn := serverConn.Load()
+		local := conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap()
+		if present, err := localAddress(local); err != nil || present {
+			continue
+		}
+
+		log.Printf("🔀 Local address %s is gone, moving the tunnel to a new socket", local)
+		next, err := redial(dialer, network, conn.RemoteAddr().String())
+		if err != nil {
+			debugf("⚠️  No new socket yet: %v", err)
+			continue
+		}
+		if err := sendControl(next, []byte{CONTROL_KEEPALIVE}); err != nil {
+			log.Printf("⚠️  Failed to send keepalive: %v", err)
+		}
+		log.Printf("✅ Tunnel moved to %s", next.LocalAddr())
+		requestPathMTUSearch("local address changed")
+	}
+}
+
+// localAddress reports whether addr is assigned to one of the host's
+// interfaces
+func localAddress(addr netip.Addr) (bool, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false, err
+	}
+	return slices.ContainsFunc(addrs, func(a net.Addr) bool {
+		prefix, ok := a.(*net.IPNet)
+		if !ok {
+			return false
+		}
+		ip, ok := netip.AddrFromSlice(prefix.IP)
+		return ok && ip.Unmap() == addr
+	}), nil
+}
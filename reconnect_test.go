@@ -0,0 +1,77 @@
+//go:build client
+// +build client
+
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// The backoff doubles up to a minute and is jittered into its upper half
+func TestReconnectDelay(t *testing.T) {
+	tests := []struct {
+		attempt int
+		base    time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{3, 8 * time.Second},
+		{5, 32 * time.Second},
+		{6, time.Minute},
+		{7, time.Minute},
+		{64, time.Minute}, // Would overflow the shift
+		{1000, time.Minute},
+	}
+	for _, tt := range tests {
+		seen := make(map[time.Duration]bool)
+		for i := 0; i < 100; i++ {
+			delay := reconnectDelay(tt.attempt)
+			if delay < tt.base/2 || delay > tt.base {
+				t.Fatalf("attempt %d: delay %s outside %s-%s", tt.attempt, delay, tt.base/2, tt.base)
+			}
+			seen[delay] = true
+		}
+		if len(seen) < 2 {
+			t.Errorf("attempt %d: no jitter", tt.attempt)
+		}
+	}
+}
+
+// Requests made while a reconnect is under way are dropped
+func TestRequestReconnect(t *testing.T) {
+	t.Cleanup(func() { reconnecting.Store(false) })
+	requestReconnect("keepalives unanswered")
+	requestReconnect("address gone")
+	if reason := <-reconnectRequests; reason != "keepalives unanswered" {
+		t.Errorf("reconnecting for %q", reason)
+	}
+	select {
+	case reason := <-reconnectRequests:
+		t.Errorf("second request queued: %q", reason)
+	default:
+	}
+	if !reconnecting.Load() {
+		t.Error("not marked as reconnecting")
+	}
+}
+
+func TestLocalAddress(t *testing.T) {
+	tests := []struct {
+		addr  string
+		local bool
+	}{
+		{"127.0.0.1", true},
+		{"192.0.2.1", false}, // TEST-NET-1
+	}
+	for _, tt := range tests {
+		local, err := localAddress(netip.MustParseAddr(tt.addr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if local != tt.local {
+			t.Errorf("localAddress(%s) = %v, want %v", tt.addr, local, tt.local)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+// Sliding-window replay protection (RFC 6479). The window is a ring of 64-bit
+// blocks; advancing the window only clears the blocks it moves past, so each
+// check is O(1) no matter how far the counter jumps.
+const (
+	REPLAY_BLOCK_BITS    = 64
+	REPLAY_RING_BLOCKS   = 32                                           // Must be a power of two
+	REPLAY_WINDOW_SIZE   = (REPLAY_RING_BLOCKS - 1) * REPLAY_BLOCK_BITS // 1984 packets
+	REPLAY_BLOCK_BIT_LOG = 6                                            // log2(REPLAY_BLOCK_BITS)
+	REPLAY_BLOCK_MASK    = REPLAY_RING_BLOCKS - 1
+	REPLAY_BIT_MASK      = REPLAY_BLOCK_BITS - 1
+)
+
+var errReplay = errors.New("replayed or too old packet")
+
+// replayWindow tracks which counters of one receive key have been seen
+type replayWindow struct {
+	mu   sync.Mutex
+	last uint64 // Highest counter accepted so far
+	ring [REPLAY_RING_BLOCKS]uint64
+}
+
+// check marks counter as seen and reports whether it was new and inside the
+// window. Call it only after the frame has authenticated, otherwise forged
+// counters could push the window forward.
+func (w *replayWindow) check(counter uint64) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	indexBlock := counter >> REPLAY_BLOCK_BIT_LOG
+	if counter > w.last {
+		// Move the window forward, clearing the blocks it skips over
+		current := w.last >> REPLAY_BLOCK_BIT_LOG
+		diff := indexBlock - current
+		if diff > REPLAY_RING_BLOCKS {
+			diff = REPLAY_RING_BLOCKS
+		}
+		for i := current + 1; i <= current+diff; i++ {
+			w.ring[i&REPLAY_BLOCK_MASK] = 0
+		}
+		w.last = counter
+	} else if w.last-counter > REPLAY_WINDOW_SIZE {
+		// Too old to track
+		return false
+	}
+
+	indexBlock &= REPLAY_BLOCK_MASK
+	bit := uint64(1) << (counter & REPLAY_BIT_MASK)
+	old := w.ring[indexBlock]
+	w.ring[indexBlock] = old | bit
+	return old&bit == 0
+}
+
+// latest returns the highest counter accepted so far
+func (w *replayWindow) latest() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.last
+}
@@ -0,0 +1,70 @@
+package main
+
+import "testing"
+
+func TestReplayWindow(t *testing.T) {
+	type step struct {
+		counter uint64
+		want    bool
+	}
+	const ringBits = REPLAY_RING_BLOCKS * REPLAY_BLOCK_BITS
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"in order", []step{{0, true}, {1, true}, {2, true}, {3, true}}},
+		{"duplicate", []step{{5, true}, {5, false}, {6, true}, {5, false}, {6, false}}},
+		{"reordered inside the window", []step{{10, true}, {8, true}, {9, true}, {8, false}, {11, true}}},
+		{"window edge", []step{
+			{3000, true},
+			{3000 - REPLAY_WINDOW_SIZE, true},
+			{3000 - REPLAY_WINDOW_SIZE - 1, false},
+		}},
+		{"out of the window", []step{{5000, true}, {1, false}, {5000 - REPLAY_WINDOW_SIZE - 100, false}}},
+		{"jump past the ring", []step{
+			{1, true},
+			{1 + 3*ringBits, true},
+			{1 + 2*ringBits, false}, // Too old, though its slot is clear
+			{1 + 3*ringBits - 1, true},
+			{1 + 3*ringBits, false},
+		}},
+		{"jump of exactly the ring", []step{{64, true}, {64 + ringBits, true}, {64 + ringBits - 64, true}, {64, false}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var w replayWindow
+			for i, s := range tt.steps {
+				if got := w.check(s.counter); got != s.want {
+					t.Fatalf("step %d: check(%d) = %v, want %v", i, s.counter, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+// A jump must clear the slots of counters it moves past, or their bits would
+// reject fresh counters that land in the same slots later
+func TestReplayWindowClearsAfterJump(t *testing.T) {
+	var w replayWindow
+	for counter := uint64(0); counter < 4000; counter++ {
+		if !w.check(counter) {
+			t.Fatalf("check(%d) rejected a fresh counter", counter)
+		}
+	}
+
+	for _, jump := range []uint64{REPLAY_BLOCK_BITS, REPLAY_WINDOW_SIZE, REPLAY_RING_BLOCKS * REPLAY_BLOCK_BITS * 5} {
+		top := w.latest() + jump
+		if !w.check(top) {
+			t.Fatalf("check(%d) rejected the jump", top)
+		}
+		for counter := top - 1; counter > top-jump && top-counter <= REPLAY_WINDOW_SIZE; counter-- {
+			if !w.check(counter) {
+				t.Fatalf("jump %d: check(%d) rejected a counter never seen", jump, counter)
+			}
+			if w.check(counter) {
+				t.Fatalf("jump %d: check(%d) accepted a duplicate", jump, counter)
+			}
+		}
+	}
+}
@@ -0,0 +1,457 @@
+//go:build !client
+// +build !client
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// endpoint is where a client is reached: its UDP address and the listening
+// socket its packets arrived on
+type endpoint struct {
+	conn *net.UDPConn
+	addr *net.UDPAddr
+}
+
+func (ep *endpoint) String() string {
+	return ep.addr.String()
+}
+
+func (ep *endpoint) equal(other *endpoint) bool {
+	return ep.conn == other.conn && ep.addr.String() == other.addr.String()
+}
+
+// clientSession is the server's state for one connected client. Sessions
+// established by a handshake are identified by the client's static key;
+// legacy sessions have no identity and are keyed by their UDP endpoint.
+//
+// The identity fields never change. Everything the packet handlers touch is
+// atomic, so the data path never takes a lock.
+type clientSession struct {
+	static noisePublicKey
+	name   string // Peer name from the peers file
+	legacy bool
+
+	endpoint  atomic.Pointer[endpoint]     // Nil until the first frame under the session's keys
+	tunnelIPs atomic.Pointer[[]netip.Addr] // Leased in the handshake, or learned from a legacy client's first packet
+	next      atomic.Pointer[keypair]      // Keys from the latest handshake, until the client uses them
+	current   atomic.Pointer[keypair]      // Newest keys the client has confirmed by using them; replies use these
+	previous  atomic.Pointer[keypair]      // Keys current before them, still accepted
+	lastSeen  atomic.Int64                 // Unix nanoseconds of the last authenticated packet
+	fragment  atomic.Int64                 // Largest datagram the client takes, 0 if it never asked for fragments
+	pathMTU   atomic.Int64                 // Path MTU the client reported, 0 until it does
+	lastPing  atomic.Int64                 // Unix nanoseconds of the last keepalive sent to the client
+}
+
+func (sess *clientSession) String() string {
+	if sess.legacy {
+		return "legacy@" + sess.endpoint.Load().String()
+	}
+	return sess.name
+}
+
+// maxDatagram is the largest datagram to send the client: the fragment size
+// it asked for or what fits its path MTU, whichever is smaller. 0 is no
+// limit.
+func (sess *clientSession) maxDatagram() int {
+	size := int(sess.fragment.Load())
+	if mtu := int(sess.pathMTU.Load()); mtu > 0 && (size == 0 || mtu+FRAME_OVERHEAD < size) {
+		size = mtu + FRAME_OVERHEAD
+	}
+	return size
+}
+
+func (sess *clientSession) touch() {
+	sess.lastSeen.Store(time.Now().UnixNano())
+}
+
+func (sess *clientSession) idle() time.Duration {
+	return time.Since(time.Unix(0, sess.lastSeen.Load()))
+}
+
+// sessionIndex is an immutable snapshot of the lookup maps used by the
+// packet handlers. Writers copy it, modify the copy and publish it
+// atomically (read-copy-update), so readers never block.
+type sessionIndex struct {
+	byIndex map[uint32]*clientSession
+	byIP    map[netip.Addr]*clientSession
+}
+
+func (idx *sessionIndex) clone() *sessionIndex {
+	next := &sessionIndex{
+		byIndex: make(map[uint32]*clientSession, len(idx.byIndex)+1),
+		byIP:    make(map[netip.Addr]*clientSession, len(idx.byIP)+1),
+	}
+	for k, v := range idx.byIndex {
+		next.byIndex[k] = v
+	}
+	for k, v := range idx.byIP {
+		next.byIP[k] = v
+	}
+	return next
+}
+
+// sessionTable indexes client sessions by static key, keypair index and
+// tunnel IP. Handshakes and other writers serialize on mu; the data path
+// only loads the published snapshot.
+type sessionTable struct {
+	mu       sync.Mutex
+	byKey    map[noisePublicKey]*clientSession
+	byLegacy map[string]*clientSession
+	reserved map[uint32]bool // Indexes handed out but not yet installed
+
+	// Newest initiation timestamp per static key. It outlives the session,
+	// so an initiation captured before the session expired cannot be
+	// replayed afterwards.
+	timestamps map[noisePublicKey]int64
+
+	index atomic.Pointer[sessionIndex]
+}
+
+func newSessionTable() *sessionTable {
+	t := &sessionTable{
+		byKey:      make(map[noisePublicKey]*clientSession),
+		byLegacy:   make(map[string]*clientSession),
+		reserved:   make(map[uint32]bool),
+		timestamps: make(map[noisePublicKey]int64),
+	}
+	t.index.Store(&sessionIndex{
+		byIndex: make(map[uint32]*clientSession),
+		byIP:    make(map[netip.Addr]*clientSession),
+	})
+	return t
+}
+
+// update applies fn to a copy of the lookup maps and publishes it. The
+// caller must hold t.mu.
+func (t *sessionTable) update(fn func(next *sessionIndex)) {
+	next := t.index.Load().clone()
+	fn(next)
+	t.index.Store(next)
+}
+
+// allocateIndex picks a random, unused local keypair index
+func (t *sessionTable) allocateIndex() (uint32, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	current := t.index.Load()
+	for {
+		index, err := randomUint32()
+		if err != nil {
+			return 0, err
+		}
+		if _, exists := current.byIndex[index]; !exists && !t.reserved[index] && index != 0 {
+			t.reserved[index] = true
+			return index, nil
+		}
+	}
+}
+
+// releaseIndex frees an index reserved by allocateIndex that was never used
+func (t *sessionTable) releaseIndex(index uint32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.reserved, index)
+}
+
+// installKeypair records the keys, leased tunnel IPs and fragment size of a
+// completed handshake, creating the session on first contact. It reports
+// whether this was a rekey. Initiations that are not newer than the last one
+// accepted from the same static key are rejected; the check and the record
+// happen under one lock, so two copies of an initiation cannot both pass.
+//
+// The keys wait as the session's next keypair until the client uses them.
+// Until then the client keeps sending under its current keys, which must
+// keep working; a retransmitted initiation, e.g. after a lost response,
+// replaces the unconfirmed keys instead of pushing the current ones out. The
+// endpoint is left alone: an initiation can be captured and passed on from
+// another address, so only a frame under the keys moves the session.
+func (t *sessionTable) installKeypair(p *peer, timestamp int64, kp *keypair, tunnelIPs []netip.Addr, fragment int) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if last, ok := t.timestamps[p.static]; ok && timestamp <= last {
+		return false, fmt.Errorf("replayed handshake initiation")
+	}
+	t.timestamps[p.static] = timestamp
+
+	sess := t.byKey[p.static]
+	rekey := sess != nil
+	if sess == nil {
+		sess = &clientSession{static: p.static, name: p.name}
+		t.byKey[p.static] = sess
+	}
+
+	replaced := sess.next.Swap(kp)
+	if replaced != nil {
+		replaced.revoke()
+	}
+	sess.fragment.Store(int64(fragment))
+	sess.touch()
+
+	oldIPs := sess.tunnelIPs.Load()
+	sess.tunnelIPs.Store(&tunnelIPs)
+
+	delete(t.reserved, kp.localIndex)
+	t.update(func(next *sessionIndex) {
+		if replaced != nil {
+			delete(next.byIndex, replaced.localIndex)
+		}
+		next.byIndex[kp.localIndex] = sess
+
+		if oldIPs != nil {
+			for _, ip := range *oldIPs {
+				if next.byIP[ip] == sess {
+					delete(next.byIP, ip)
+				}
+			}
+		}
+		for _, ip := range tunnelIPs {
+			// Leased addresses always win over a legacy client using them
+			if owner := next.byIP[ip]; owner != nil && owner != sess {
+				owner.tunnelIPs.Store(nil)
+				log.Printf("👤 Tunnel IP %s taken from legacy client %s", ip, owner)
+			}
+			next.byIP[ip] = sess
+		}
+	})
+
+	return rekey, nil
+}
+
+// remove drops the session of a static key, so its keys stop working at
+// once. It reports whether there was a session.
+func (t *sessionTable) remove(static noisePublicKey) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sess := t.byKey[static]
+	if sess == nil {
+		return false
+	}
+	t.removeLocked(sess)
+	return true
+}
+
+// confirmKeypair makes the session's next keypair current once the client
+// sent a frame under it. The keys current so far become the previous ones;
+// the keys previous so far are dropped.
+func (t *sessionTable) confirmKeypair(sess *clientSession, kp *keypair) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !sess.next.CompareAndSwap(kp, nil) {
+		return // Confirmed by another packet, or replaced
+	}
+	old := sess.previous.Swap(sess.current.Swap(kp))
+	if old != nil {
+		old.revoke()
+		t.update(func(next *sessionIndex) {
+			delete(next.byIndex, old.localIndex)
+		})
+	}
+}
+
+// expireIdle removes the sessions that sent nothing for longer than timeout
+// and returns them
+func (t *sessionTable) expireIdle(timeout time.Duration) []*clientSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var expired []*clientSession
+	for _, sess := range t.byKey {
+		if sess.idle() > timeout {
+			expired = append(expired, sess)
+		}
+	}
+	for _, sess := range t.byLegacy {
+		if sess.idle() > timeout {
+			expired = append(expired, sess)
+		}
+	}
+	for _, sess := range expired {
+		t.removeLocked(sess)
+	}
+	return expired
+}
+
+// active returns the sessions established by a handshake
+func (t *sessionTable) active() []*clientSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sessions := make([]*clientSession, 0, len(t.byKey))
+	for _, sess := range t.byKey {
+		sessions = append(sessions, sess)
+	}
+	return sessions
+}
+
+// removeLocked drops a session from every index and revokes its keys. The
+// caller must hold t.mu.
+func (t *sessionTable) removeLocked(sess *clientSession) {
+	if sess.legacy {
+		delete(t.byLegacy, sess.endpoint.Load().String())
+	} else {
+		delete(t.byKey, sess.static)
+	}
+
+	t.update(func(next *sessionIndex) {
+		for index, owner := range next.byIndex {
+			if owner == sess {
+				delete(next.byIndex, index)
+			}
+		}
+		for ip, owner := range next.byIP {
+			if owner == sess {
+				delete(next.byIP, ip)
+			}
+		}
+	})
+
+	// Packets already past the index lookup fail on the expired keys
+	for _, kp := range []*keypair{sess.next.Swap(nil), sess.current.Swap(nil), sess.previous.Swap(nil)} {
+		if kp != nil {
+			kp.revoke()
+		}
+	}
+}
+
+// open authenticates and decrypts a data frame and returns the session it
+// belongs to. A new session learns its endpoint from the first frame. The
+// session roams to the frame's endpoint only once the frame
+// has passed authentication and the replay check, and only if it is the
+// newest frame under the current keys, so a reordered frame from an address
+// the client left, under the current or older keys, cannot pull the session
+// back.
+func (t *sessionTable) open(packet []byte, ep *endpoint) ([]byte, *clientSession, error) {
+	hdr, err := parseFrameHeader(packet)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sess := t.index.Load().byIndex[hdr.ReceiverIndex]
+	var kp *keypair
+	if sess != nil {
+		for _, candidate := range []*keypair{sess.next.Load(), sess.current.Load(), sess.previous.Load()} {
+			if candidate != nil && candidate.localIndex == hdr.ReceiverIndex {
+				kp = candidate
+			}
+		}
+	}
+	if kp == nil {
+		return nil, nil, fmt.Errorf("no session for index %d", hdr.ReceiverIndex)
+	}
+
+	plaintext, err := kp.open(hdr, packet)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sess.touch()
+	if kp == sess.next.Load() {
+		t.confirmKeypair(sess, kp)
+	}
+	if old := sess.endpoint.Load(); (old == nil || !old.equal(ep)) && kp == sess.current.Load() && hdr.Counter == kp.replay.latest() {
+		sess.endpoint.Store(ep)
+		if old != nil {
+			log.Printf("👤 Client %s roamed from %s to %s", sess, old, ep)
+		}
+	}
+	return plaintext, sess, nil
+}
+
+// legacySession returns the session of a legacy client, creating it on first
+// contact. Legacy clients have no identity beyond their UDP endpoint.
+func (t *sessionTable) legacySession(ep *endpoint) *clientSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sess := t.byLegacy[ep.String()]
+	if sess == nil {
+		sess = &clientSession{legacy: true}
+		sess.endpoint.Store(ep)
+		t.byLegacy[ep.String()] = sess
+		log.Printf("👤 New legacy client connected from: %s", ep)
+	}
+	sess.touch()
+	return sess
+}
+
+// checkSource reports whether src is one of the session's tunnel IPs.
+// known is false if the session has none yet.
+func (sess *clientSession) checkSource(src netip.Addr) (known bool, err error) {
+	ips := sess.tunnelIPs.Load()
+	if ips == nil {
+		return false, nil
+	}
+	if !slices.Contains(*ips, src) {
+		return true, fmt.Errorf("source %s does not match tunnel IPs %v", src, *ips)
+	}
+	return true, nil
+}
+
+// claimSource checks the source address of an inner packet against the
+// session's tunnel IPs. Handshake sessions get theirs leased from the pool; a
+// legacy session learns its tunnel IP from its first packet, and can only
+// take over an IP held by another legacy session once that session has been
+// idle longer than keys live.
+func (t *sessionTable) claimSource(sess *clientSession, src netip.Addr) error {
+	if known, err := sess.checkSource(src); known {
+		return err
+	}
+	if !sess.legacy {
+		return fmt.Errorf("no tunnel IP leased")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Another packet of this session may have claimed an IP meanwhile
+	if known, err := sess.checkSource(src); known {
+		return err
+	}
+
+	owner := t.index.Load().byIP[src]
+	if owner != nil && owner != sess {
+		if !owner.legacy {
+			return fmt.Errorf("tunnel IP %s is leased to client %s", src, owner)
+		}
+		if owner.idle() < REJECT_AFTER_TIME {
+			return fmt.Errorf("tunnel IP %s is in use by client %s", src, owner)
+		}
+		owner.tunnelIPs.Store(nil)
+		log.Printf("👤 Tunnel IP %s released by idle client %s", src, owner)
+	}
+
+	sess.tunnelIPs.Store(&[]netip.Addr{src})
+	t.update(func(next *sessionIndex) {
+		next.byIP[src] = sess
+	})
+	log.Printf("👤 Client %s owns tunnel IP %s", sess, src)
+	return nil
+}
+
+// route returns the session, endpoint and send keys of the client owning a
+// tunnel IP. The keypair is nil for legacy clients.
+func (t *sessionTable) route(dst netip.Addr) (*clientSession, *endpoint, *keypair, bool) {
+	sess := t.index.Load().byIP[dst]
+	if sess == nil {
+		return nil, nil, nil, false
+	}
+
+	kp, ep := sess.current.Load(), sess.endpoint.Load()
+	if (!sess.legacy && kp == nil) || ep == nil {
+		return nil, nil, nil, false
+	}
+	return sess, ep, kp, true
+}
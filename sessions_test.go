@@ -0,0 +1,536 @@
+//go:build !client
+// +build !client
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testKeypairs returns matching client and server keys for a server index
+func testKeypairs(index uint32) (client, server *keypair, err error) {
+	send := bytes.Repeat([]byte{byte(index), 1}, NOISE_KEY_LEN/2)
+	recv := bytes.Repeat([]byte{byte(index), 2}, NOISE_KEY_LEN/2)
+	if client, err = newKeypair(suiteChaCha20Poly1305, send, recv, 0, index); err != nil {
+		return nil, nil, err
+	}
+	if server, err = newKeypair(suiteChaCha20Poly1305, recv, send, index, 0); err != nil {
+		return nil, nil, err
+	}
+	return client, server, nil
+}
+
+// testPeer returns a peer and an endpoint for client number i
+func testPeer(i int) (*peer, *endpoint) {
+	p := &peer{name: "client" + string(rune('a'+i))}
+	p.static[0], p.static[1] = byte(i), byte(i>>8)
+	ep := &endpoint{addr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, byte(i)), Port: 40000 + i}}
+	return p, ep
+}
+
+// sealFrame seals a packet under kp or fails the test
+func sealFrame(t *testing.T, kp *keypair, plaintext []byte) []byte {
+	t.Helper()
+	frame, err := kp.seal(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+// Many clients handshake, rekey, send and claim their addresses while the
+// TUN side routes to them and idle sessions expire, all at once. Run it with
+// -race.
+func TestSessionTableConcurrent(t *testing.T) {
+	const (
+		clients       = 8
+		legacyClients = 4
+		staleClients  = 4
+		rounds        = 100
+		framesPerKey  = 5
+	)
+	tbl := newSessionTable()
+
+	// Legacy sessions idle for an hour, for expireIdle to find
+	stale := make([]*clientSession, staleClients)
+	for i := range stale {
+		ep := &endpoint{addr: &net.UDPAddr{IP: net.IPv4(198, 51, 100, byte(i)), Port: 1}}
+		stale[i] = tbl.legacySession(ep)
+		if err := tbl.claimSource(stale[i], netip.AddrFrom4([4]byte{10, 9, 0, byte(i + 2)})); err != nil {
+			t.Fatal(err)
+		}
+		stale[i].lastSeen.Store(time.Now().Add(-time.Hour).UnixNano())
+	}
+
+	done := make(chan struct{})
+	var background sync.WaitGroup
+
+	// The TUN side looks up every client's address all the time
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for i := 0; i < clients; i++ {
+				tbl.route(netip.AddrFrom4([4]byte{10, 8, 0, byte(i + 2)}))
+			}
+			for i := 0; i < legacyClients; i++ {
+				tbl.route(netip.AddrFrom4([4]byte{10, 7, 0, byte(i + 2)}))
+			}
+		}
+	}()
+
+	// The maintenance loop expires idle sessions and pings active ones
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			tbl.expireIdle(10 * time.Minute)
+			for _, sess := range tbl.active() {
+				sess.idle()
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, clients+legacyClients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p, ep := testPeer(i)
+			ip := netip.AddrFrom4([4]byte{10, 8, 0, byte(i + 2)})
+			for round := 1; round <= rounds; round++ {
+				index, err := tbl.allocateIndex()
+				if err != nil {
+					errs <- err
+					return
+				}
+				timestamp := int64(round)
+				clientKP, serverKP, err := testKeypairs(index)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if _, err := tbl.installKeypair(p, timestamp, serverKP, []netip.Addr{ip}, 0); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := tbl.installKeypair(p, timestamp, serverKP, []netip.Addr{ip}, 0); err == nil {
+					errs <- fmt.Errorf("%s: replayed timestamp %d accepted", p.name, timestamp)
+					return
+				}
+
+				for n := 0; n < framesPerKey; n++ {
+					frame, err := clientKP.seal([]byte{0x45, byte(n)})
+					if err != nil {
+						errs <- err
+						return
+					}
+					plaintext, sess, err := tbl.open(frame, ep)
+					if err != nil {
+						errs <- fmt.Errorf("%s, round %d: %w", p.name, round, err)
+						return
+					}
+					if plaintext[1] != byte(n) {
+						errs <- fmt.Errorf("%s: frame %d opened as %v", p.name, n, plaintext)
+						return
+					}
+					if err := tbl.claimSource(sess, ip); err != nil {
+						errs <- err
+						return
+					}
+				}
+				if _, _, kp, ok := tbl.route(ip); !ok || kp != serverKP {
+					errs <- fmt.Errorf("%s, round %d: not routed under the new keys", p.name, round)
+					return
+				}
+			}
+		}(i)
+	}
+	for i := 0; i < legacyClients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ep := &endpoint{addr: &net.UDPAddr{IP: net.IPv4(203, 0, 113, byte(i)), Port: 1}}
+			ip := netip.AddrFrom4([4]byte{10, 7, 0, byte(i + 2)})
+			for round := 0; round < rounds; round++ {
+				if err := tbl.claimSource(tbl.legacySession(ep), ip); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(done)
+	background.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// The idle sessions are gone, everyone else is still reachable
+	tbl.expireIdle(10 * time.Minute)
+	for i, sess := range stale {
+		if _, _, _, ok := tbl.route(netip.AddrFrom4([4]byte{10, 9, 0, byte(i + 2)})); ok || sess.current.Load() != nil {
+			t.Errorf("idle session %s not expired", sess)
+		}
+	}
+	if n := len(tbl.active()); n != clients {
+		t.Errorf("%d active sessions, want %d", n, clients)
+	}
+	for i := 0; i < clients; i++ {
+		if _, _, _, ok := tbl.route(netip.AddrFrom4([4]byte{10, 8, 0, byte(i + 2)})); !ok {
+			t.Errorf("client %d not routable", i)
+		}
+	}
+	for i := 0; i < legacyClients; i++ {
+		if _, _, _, ok := tbl.route(netip.AddrFrom4([4]byte{10, 7, 0, byte(i + 2)})); !ok {
+			t.Errorf("legacy client %d not routable", i)
+		}
+	}
+	// Two keypairs per client: the current one and the previous one
+	if n := len(tbl.index.Load().byIndex); n != 2*clients {
+		t.Errorf("%d keypair indexes, want %d", n, 2*clients)
+	}
+}
+
+// A lost handshake response makes the client retransmit its initiation.
+// The server's keys for the first attempt are replaced, and the keys the
+// client still sends under keep working until it uses the new ones.
+func TestSessionRekeyWithLostResponse(t *testing.T) {
+	tbl := newSessionTable()
+	p, ep := testPeer(1)
+	ips := []netip.Addr{netip.MustParseAddr("10.8.0.2")}
+	keys := func(index uint32) (*keypair, *keypair) {
+		client, server, err := testKeypairs(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client, server
+	}
+	open := func(kp *keypair) error {
+		_, _, err := tbl.open(sealFrame(t, kp, []byte{0x45}), ep)
+		return err
+	}
+	install := func(timestamp int64, kp *keypair) {
+		if _, err := tbl.installKeypair(p, timestamp, kp, ips, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client0, server0 := keys(10)
+	install(1, server0)
+	if err := open(client0); err != nil {
+		t.Fatal(err)
+	}
+
+	client1, server1 := keys(11) // Response lost
+	install(2, server1)
+	client2, server2 := keys(12) // Retransmitted initiation
+	install(3, server2)
+
+	if err := open(client0); err != nil {
+		t.Fatalf("current keys rejected before the client switched: %v", err)
+	}
+	if _, _, kp, _ := tbl.route(ips[0]); kp != server0 {
+		t.Fatal("replies left the confirmed keys before the client switched")
+	}
+	if err := open(client1); err == nil {
+		t.Fatal("replaced keys still accepted")
+	}
+
+	if err := open(client2); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, kp, _ := tbl.route(ips[0]); kp != server2 {
+		t.Fatal("replies not moved to the confirmed keys")
+	}
+	if err := open(client0); err != nil {
+		t.Fatalf("previous keys rejected right after the switch: %v", err)
+	}
+}
+
+// A new session learns its endpoint from the first frame under its keys.
+// After that only the newest authenticated frame under the current keys
+// moves the session to another address; a handshake never does.
+func TestSessionRoaming(t *testing.T) {
+	tbl := newSessionTable()
+	p, home := testPeer(1)
+	_, away := testPeer(2)
+	_, later := testPeer(3)
+	ips := []netip.Addr{netip.MustParseAddr("10.8.0.2")}
+	client0, server0, err := testKeypairs(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client1, server1, err := testKeypairs(11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tbl.installKeypair(p, 1, server0, ips, 0); err != nil {
+		t.Fatal(err)
+	}
+	sess := tbl.byKey[p.static]
+	if _, _, _, ok := tbl.route(ips[0]); ok {
+		t.Fatal("session routable before the client sent a frame")
+	}
+
+	first := sealFrame(t, client0, []byte{0x45})
+	early := sealFrame(t, client0, []byte{0x45})
+	latest := sealFrame(t, client0, []byte{0x45})
+	forged := append([]byte(nil), latest...)
+	forged[len(forged)-1] ^= 1
+	stale := sealFrame(t, client0, []byte{0x45}) // Sent before the rekey, arrives after it
+
+	check := func(name string, frame []byte, from *endpoint, ok bool, want *endpoint) {
+		t.Helper()
+		if _, _, err := tbl.open(frame, from); (err == nil) != ok {
+			t.Fatalf("%s: open error %v", name, err)
+		}
+		if got := sess.endpoint.Load(); got != want {
+			t.Fatalf("%s: endpoint %s, want %s", name, got, want)
+		}
+	}
+	check("forged first frame", forged, away, false, nil)
+	check("first frame", first, home, true, home)
+	check("forged frame", forged, away, false, home)
+	check("newest frame", latest, away, true, away)
+	check("replayed frame", latest, home, false, away)
+	check("reordered older frame", early, home, true, away)
+
+	// The client rekeys and moves on; the handshake alone moves nothing
+	if _, err := tbl.installKeypair(p, 2, server1, ips, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := sess.endpoint.Load(); got != away {
+		t.Fatalf("handshake moved the session to %s", got)
+	}
+	check("frame under new keys", sealFrame(t, client1, []byte{0x45}), later, true, later)
+	check("late frame under the previous keys", stale, away, true, later)
+}
+
+// A captured initiation stays useless after the peer's session is gone
+func TestSessionTimestampOutlivesSession(t *testing.T) {
+	tbl := newSessionTable()
+	p, _ := testPeer(1)
+	ips := []netip.Addr{netip.MustParseAddr("10.8.0.2")}
+	install := func(timestamp int64) error {
+		_, server, err := testKeypairs(uint32(timestamp))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tbl.installKeypair(p, timestamp, server, ips, 0)
+		return err
+	}
+	if err := install(100); err != nil {
+		t.Fatal(err)
+	}
+
+	tbl.byKey[p.static].lastSeen.Store(time.Now().Add(-time.Hour).UnixNano())
+	if expired := tbl.expireIdle(time.Minute); len(expired) != 1 {
+		t.Fatalf("%d sessions expired, want 1", len(expired))
+	}
+	if err := install(100); err == nil {
+		t.Fatal("replayed initiation accepted after the session expired")
+	}
+	tbl.remove(p.static)
+	if err := install(99); err == nil {
+		t.Fatal("older initiation accepted after the session was removed")
+	}
+	if err := install(101); err != nil {
+		t.Fatalf("newer initiation rejected: %v", err)
+	}
+}
+
+// Frames to a client must fit both its fragment size and its path MTU
+func TestSessionMaxDatagram(t *testing.T) {
+	tests := []struct {
+		fragment, pathMTU, want int
+	}{
+		{0, 0, 0},
+		{600, 0, 600},
+		{0, 1400, 1400 + FRAME_OVERHEAD},
+		{600, 1400, 600},
+		{1500, 1400, 1400 + FRAME_OVERHEAD},
+	}
+	for _, tt := range tests {
+		var sess clientSession
+		sess.fragment.Store(int64(tt.fragment))
+		sess.pathMTU.Store(int64(tt.pathMTU))
+		if got := sess.maxDatagram(); got != tt.want {
+			t.Errorf("fragment %d, path MTU %d: max datagram %d, want %d", tt.fragment, tt.pathMTU, got, tt.want)
+		}
+	}
+}
+
+// Return traffic goes to the client owning the destination address, and no
+// client can send from or take over an address that is not its own
+func TestSessionTunnelIPs(t *testing.T) {
+	tbl := newSessionTable()
+	ip := func(s string) netip.Addr { return netip.MustParseAddr(s) }
+
+	// Two handshake clients, each with its own lease
+	sessions := make([]*clientSession, 2)
+	endpoints := make([]*endpoint, 2)
+	for i := range sessions {
+		p, ep := testPeer(i)
+		client, server, err := testKeypairs(uint32(10 + i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tbl.installKeypair(p, 1, server, []netip.Addr{ip(fmt.Sprintf("10.8.0.%d", i+2))}, 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, sessions[i], err = tbl.open(sealFrame(t, client, []byte{0x45}), ep); err != nil {
+			t.Fatal(err)
+		}
+		endpoints[i] = ep
+	}
+	for i, sess := range sessions {
+		got, ep, _, ok := tbl.route(ip(fmt.Sprintf("10.8.0.%d", i+2)))
+		if !ok || got != sess || ep != endpoints[i] {
+			t.Errorf("10.8.0.%d routed to %v at %v, want %s", i+2, got, ep, sess)
+		}
+		if err := tbl.claimSource(sess, ip(fmt.Sprintf("10.8.0.%d", i+2))); err != nil {
+			t.Errorf("%s: own address refused: %v", sess, err)
+		}
+	}
+	if err := tbl.claimSource(sessions[0], ip("10.8.0.3")); err == nil {
+		t.Error("client sent from another client's address")
+	}
+	if _, _, _, ok := tbl.route(ip("10.8.0.99")); ok {
+		t.Error("unleased address routed")
+	}
+
+	// Legacy clients learn their address from their first packet
+	legacyEP := func(i byte) *endpoint {
+		return &endpoint{addr: &net.UDPAddr{IP: net.IPv4(198, 51, 100, i), Port: 1}}
+	}
+	legacy := tbl.legacySession(legacyEP(1))
+	if err := tbl.claimSource(legacy, ip("10.8.0.2")); err == nil {
+		t.Error("legacy client took a leased address")
+	}
+	if err := tbl.claimSource(legacy, ip("10.8.0.50")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tbl.claimSource(legacy, ip("10.8.0.51")); err == nil {
+		t.Error("legacy client changed its address")
+	}
+	if got, _, kp, ok := tbl.route(ip("10.8.0.50")); !ok || got != legacy || kp != nil {
+		t.Error("legacy client not routed by its address")
+	}
+
+	other := tbl.legacySession(legacyEP(2))
+	if err := tbl.claimSource(other, ip("10.8.0.50")); err == nil {
+		t.Error("legacy client took an active legacy client's address")
+	}
+	legacy.lastSeen.Store(time.Now().Add(-REJECT_AFTER_TIME - time.Second).UnixNano())
+	if err := tbl.claimSource(other, ip("10.8.0.50")); err != nil {
+		t.Errorf("idle legacy client's address not taken over: %v", err)
+	}
+	if got, _, _, _ := tbl.route(ip("10.8.0.50")); got != other {
+		t.Error("address not routed to its new owner")
+	}
+
+	// A lease always wins over a legacy client
+	p, _ := testPeer(5)
+	_, server, err := testKeypairs(15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tbl.installKeypair(p, 1, server, []netip.Addr{ip("10.8.0.50")}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if known, _ := other.checkSource(ip("10.8.0.50")); known {
+		t.Error("legacy client kept a leased address")
+	}
+}
+
+// A dual-stack client is routed by either address and may send from both
+func TestSessionDualStack(t *testing.T) {
+	tbl := newSessionTable()
+	v4, v6 := netip.MustParseAddr("10.8.0.2"), netip.MustParseAddr("fd00:8::2")
+	p, ep := testPeer(0)
+	client, server, err := testKeypairs(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tbl.installKeypair(p, 1, server, []netip.Addr{v4, v6}, 0); err != nil {
+		t.Fatal(err)
+	}
+	_, sess, err := tbl.open(sealFrame(t, client, []byte{0x60}), ep)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, addr := range []netip.Addr{v4, v6} {
+		if got, _, _, ok := tbl.route(addr); !ok || got != sess {
+			t.Errorf("%s not routed to the client", addr)
+		}
+		if err := tbl.claimSource(sess, addr); err != nil {
+			t.Errorf("%s: own address refused: %v", addr, err)
+		}
+	}
+	if err := tbl.claimSource(sess, netip.MustParseAddr("fd00:8::3")); err == nil {
+		t.Error("client sent from an IPv6 address it was not given")
+	}
+	if _, _, _, ok := tbl.route(netip.MustParseAddr("::ffff:10.8.0.2")); ok {
+		t.Error("IPv4-mapped address routed")
+	}
+}
+
+// Clients silent for the dead peer timeout lose their session and routes
+func TestSessionExpireIdle(t *testing.T) {
+	tbl := newSessionTable()
+	addrs := []netip.Addr{netip.MustParseAddr("10.8.0.2"), netip.MustParseAddr("10.8.0.3")}
+	sessions := make([]*clientSession, len(addrs))
+	for i := range sessions {
+		p, ep := testPeer(i)
+		client, server, err := testKeypairs(uint32(10 + i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tbl.installKeypair(p, 1, server, addrs[i:i+1], 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, sessions[i], err = tbl.open(sealFrame(t, client, []byte{0x45}), ep); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sessions[1].lastSeen.Store(time.Now().Add(-3 * time.Minute).UnixNano())
+	silentKeys := sessions[1].current.Load()
+
+	expired := tbl.expireIdle(2 * time.Minute)
+	if len(expired) != 1 || expired[0] != sessions[1] {
+		t.Fatalf("expired %v, want only the silent client", expired)
+	}
+	if _, _, _, ok := tbl.route(addrs[1]); ok {
+		t.Error("expired client still routed")
+	}
+	if got, _, _, ok := tbl.route(addrs[0]); !ok || got != sessions[0] {
+		t.Error("active client lost its route")
+	}
+	if !silentKeys.expired() {
+		t.Error("expired client's keys still usable")
+	}
+	if len(tbl.expireIdle(2*time.Minute)) != 0 {
+		t.Error("session expired twice")
+	}
+}
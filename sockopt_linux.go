@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// dontFragment is a dialer or listener control function that sets the
+// don't fragment bit on everything the socket sends, ignoring the kernel's
+// path MTU cache. Path MTU probes rely on it: a probe that is too big must
+// be dropped on the way, not fragmented. An IPv6 socket may also carry IPv4
+// traffic, so it gets both options.
+func dontFragment(network, address string, c syscall.RawConn) error {
+	var err error
+	if ctrlErr := c.Control(func(fd uintptr) {
+		if strings.HasSuffix(network, "6") {
+			err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_PROBE)
+		}
+		if err == nil {
+			err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_PROBE)
+		}
+	}); ctrlErr != nil {
+		return ctrlErr
+	}
+	return err
+}
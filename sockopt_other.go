@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "syscall"
+
+// dontFragment leaves the socket alone: elsewhere the kernel decides, and
+// probes may get fragmented instead of dropped
+func dontFragment(network, address string, c syscall.RawConn) error {
+	return nil
+}